@@ -9,6 +9,7 @@
 :-(op(1200, fx, ?-)).
 :-(op(1100, xfy, ;)).
 :-(op(1050, xfy, ->)).
+:-(op(1050, xfy, *->)).
 :-(op(1000, xfy, ',')).
 :-(op(900, fy, \+)).
 :-(op(700, xfx, =)).
@@ -51,21 +52,11 @@
 true.
 fail :- \+true.
 
-% if then else
-If -> Then; _ :- If, !, Then.
-_ -> _; Else :- !, Else.
-If -> Then :- If, !, Then.
-
-% conjunction/disjunction
-P, Q :- call((P, Q)).
-P; Q :- call((P; Q)).
-
-% cut
-! :- !.
-
 % logic and control
 once(P) :- P, !.
 
+call_cleanup(Goal, Cleanup) :- setup_call_cleanup(true, Goal, Cleanup).
+
 % not unifiable
 X \= Y :- \+(X = Y).
 
@@ -164,3 +155,17 @@ member(X, [_|Xs]) :- member(X, Xs).
 
 length([], 0).
 length([_|Xs], N) :- length(Xs, L), N is L + 1.
+
+thread_get_message(Msg) :- thread_self(Self), thread_get_message(Self, Msg).
+
+concurrent_maplist(G, L) :- '$concurrent_goals'(L, G, Gs), current_prolog_flag(cpu_count, N), concurrent(N, Gs, []).
+concurrent_maplist(G, L1, L2) :- '$concurrent_goals'(L1, L2, G, Gs), current_prolog_flag(cpu_count, N), concurrent(N, Gs, []).
+
+'$concurrent_goals'([], _, []).
+'$concurrent_goals'([X|Xs], G, [C|Cs]) :- G =.. L0, append(L0, [X], L1), C =.. L1, '$concurrent_goals'(Xs, G, Cs).
+'$concurrent_goals'([], [], _, []).
+'$concurrent_goals'([X|Xs], [Y|Ys], G, [C|Cs]) :- G =.. L0, append(L0, [X, Y], L1), C =.. L1, '$concurrent_goals'(Xs, Ys, G, Cs).
+
+engine_create(Template, Goal, Engine) :- engine_create(Template, Goal, Engine, []).
+engine_next_reified(Engine, Answer) :- catch(engine_next(Engine, A), E, true) -> (var(E) -> Answer = the(A) ; Answer = throw(E)) ; Answer = no.
+engine_post(Engine, Term, Reply) :- engine_post(Engine, Term), engine_next(Engine, Reply).
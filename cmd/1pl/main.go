@@ -50,11 +50,16 @@ func main() {
 
 	log.SetOutput(t)
 
+	// halt/1 unwinds the query with *engine.HaltError. We exit the process after restoring the terminal.
+	halt := func(err error) {
+		var h *engine.HaltError
+		if errors.As(err, &h) {
+			restore()
+			os.Exit(h.Code)
+		}
+	}
+
 	i := prolog.New(bufio.NewReader(os.Stdin), t)
-	i.Register1("halt", func(t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
-		restore()
-		return engine.Halt(t, k, env)
-	})
 	i.Register1("cd", func(dir term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 		switch dir := env.Resolve(dir).(type) {
 		case term.Atom:
@@ -114,6 +119,7 @@ func main() {
 		}
 
 		if err := i.Exec(string(b)); err != nil {
+			halt(err)
 			log.Panicf("failed to execute %s: %v", a, err)
 		}
 	}
@@ -125,6 +131,7 @@ func main() {
 	keys := bufio.NewReader(os.Stdin)
 	for {
 		if err := handleLine(ctx, &buf, i, t, keys); err != nil {
+			halt(err)
 			log.Panic(err)
 		}
 	}
@@ -222,6 +229,10 @@ func handleLine(ctx context.Context, buf *strings.Builder, i *prolog.Interpreter
 	}
 
 	if err := sols.Err(); err != nil {
+		var h *engine.HaltError
+		if errors.As(err, &h) {
+			return err
+		}
 		log.Printf("failed: %v", err)
 		buf.Reset()
 		return nil
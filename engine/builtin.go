@@ -9,6 +9,7 @@ import (
 	"io"
 	"math"
 	"os"
+	"runtime"
 	"sort"
 	"strings"
 	"unicode"
@@ -26,18 +27,12 @@ func (vm *VM) Repeat(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.P
 	})
 }
 
+// Negation succeeds if goal fails. A cut inside goal doesn't affect outside of Negation.
 func (vm *VM) Negation(goal term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
-	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
-		env := env
-		ok, err := vm.Call(goal, Success, env).Force(ctx)
-		if err != nil {
-			return nondet.Error(err)
-		}
-		if ok {
-			return nondet.Bool(false)
-		}
-		return k(env)
-	})
+	return vm.Call(&term.Compound{
+		Functor: `\+`,
+		Args:    []term.Interface{goal},
+	}, k, env)
 }
 
 // Call executes goal. it succeeds if goal followed by k succeeds. A cut inside goal doesn't affect outside of Call.
@@ -46,8 +41,16 @@ func (vm *VM) Call(goal term.Interface, k func(*term.Env) *nondet.Promise, env *
 	case term.Variable:
 		return nondet.Error(instantiationError(goal))
 	default:
+		pi, args, err := piArgs(g, env)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		if !isControl(pi) {
+			return vm.arrive(pi, args, k, env)
+		}
+
 		fvs := env.FreeVariables(g)
-		args := make([]term.Interface, len(fvs))
+		args = make([]term.Interface, len(fvs))
 		for i, fv := range fvs {
 			args[i] = fv
 		}
@@ -67,6 +70,22 @@ func (vm *VM) Call(goal term.Interface, k func(*term.Env) *nondet.Promise, env *
 	}
 }
 
+// isControl checks if pi is a control construct which is compiled into dedicated instructions.
+func isControl(pi ProcedureIndicator) bool {
+	switch pi {
+	case ProcedureIndicator{Name: "!", Arity: 0},
+		ProcedureIndicator{Name: ",", Arity: 2},
+		ProcedureIndicator{Name: ";", Arity: 2},
+		ProcedureIndicator{Name: "->", Arity: 2},
+		ProcedureIndicator{Name: "*->", Arity: 2},
+		ProcedureIndicator{Name: `\+`, Arity: 1},
+		ProcedureIndicator{Name: "call", Arity: 1}:
+		return true
+	default:
+		return false
+	}
+}
+
 // Unify unifies t1 and t2 without occurs check (i.e., X = f(X) is allowed).
 func Unify(t1, t2 term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 	env, ok := t1.Unify(t2, false, env)
@@ -233,17 +252,25 @@ func Univ(t, list term.Interface, k func(*term.Env) *nondet.Promise, env *term.E
 			return nondet.Error(err)
 		}
 
-		return nondet.Delay(func(context.Context) *nondet.Promise {
+		return nondet.Delay(func(ctx context.Context) *nondet.Promise {
 			env := env
-			return Unify(t, &term.Compound{
+			c := term.Compound{
 				Functor: f,
 				Args:    args,
-			}, k, env)
+			}
+			if err := checkTermSize(ctx, &c, env); err != nil {
+				return nondet.Error(err)
+			}
+			return Unify(t, &c, k, env)
 		})
 	case *term.Compound:
-		return nondet.Delay(func(context.Context) *nondet.Promise {
+		return nondet.Delay(func(ctx context.Context) *nondet.Promise {
 			env := env
-			return Unify(list, term.List(append([]term.Interface{t.Functor}, t.Args...)...), k, env)
+			l := term.List(append([]term.Interface{t.Functor}, t.Args...)...)
+			if err := checkTermSize(ctx, l, env); err != nil {
+				return nondet.Error(err)
+			}
+			return Unify(list, l, k, env)
 		})
 	default:
 		return nondet.Delay(func(context.Context) *nondet.Promise {
@@ -255,7 +282,13 @@ func Univ(t, list term.Interface, k func(*term.Env) *nondet.Promise, env *term.E
 
 // CopyTerm clones in as out.
 func CopyTerm(in, out term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
-	return Unify(copyTerm(in, nil, env), out, k, env)
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		c := copyTerm(in, nil, env)
+		if err := checkTermSize(ctx, c, env); err != nil {
+			return nondet.Error(err)
+		}
+		return Unify(c, out, k, env)
+	})
 }
 
 func copyTerm(t term.Interface, vars map[term.Variable]term.Variable, env *term.Env) term.Interface {
@@ -310,34 +343,40 @@ func (vm *VM) Op(priority, specifier, operator term.Interface, k func(*term.Env)
 		return nondet.Error(typeErrorAtom(operator))
 	}
 
-	// already defined?
-	for i, op := range vm.operators {
-		if op.Specifier != s || op.Name != o {
+	vm.mu.Lock()
+
+	// operators are copy-on-write since parsers may be reading them.
+	ops := make(term.Operators, 0, len(vm.operators)+1)
+	removed := false
+	for _, op := range vm.operators {
+		// already defined? remove it first so that we can insert it again in the right position
+		if op.Specifier == s && op.Name == o {
+			removed = true
 			continue
 		}
+		ops = append(ops, op)
+	}
 
-		// remove it first so that we can insert it again in the right position
-		copy(vm.operators[i:], vm.operators[i+1:])
-		vm.operators[len(vm.operators)-1] = term.Operator{}
-		vm.operators = vm.operators[:len(vm.operators)-1]
-
-		// or keep it removed.
-		if p == 0 {
-			return k(env)
-		}
+	// or keep it removed.
+	if removed && p == 0 {
+		vm.operators = ops
+		vm.mu.Unlock()
+		return k(env)
 	}
 
 	// insert
-	i := sort.Search(len(vm.operators), func(i int) bool {
-		return vm.operators[i].Priority >= p
+	i := sort.Search(len(ops), func(i int) bool {
+		return ops[i].Priority >= p
 	})
-	vm.operators = append(vm.operators, term.Operator{})
-	copy(vm.operators[i+1:], vm.operators[i:])
-	vm.operators[i] = term.Operator{
+	ops = append(ops, term.Operator{})
+	copy(ops[i+1:], ops[i:])
+	ops[i] = term.Operator{
 		Priority:  p,
 		Specifier: s,
 		Name:      o,
 	}
+	vm.operators = ops
+	vm.mu.Unlock()
 
 	return k(env)
 }
@@ -377,9 +416,10 @@ func (vm *VM) CurrentOp(priority, specifier, operator term.Interface, k func(*te
 	}
 
 	pattern := term.Compound{Args: []term.Interface{priority, specifier, operator}}
-	ks := make([]func(context.Context) *nondet.Promise, len(vm.operators))
-	for i := range vm.operators {
-		op := vm.operators[i]
+	ops := vm.ops()
+	ks := make([]func(context.Context) *nondet.Promise, len(ops))
+	for i := range ops {
+		op := ops[i]
 		ks[i] = func(context.Context) *nondet.Promise {
 			env := env
 			return Unify(&pattern, &term.Compound{Args: []term.Interface{op.Priority, op.Specifier, op.Name}}, k, env)
@@ -390,19 +430,21 @@ func (vm *VM) CurrentOp(priority, specifier, operator term.Interface, k func(*te
 
 // Assertz appends t to the database.
 func (vm *VM) Assertz(t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
-	return vm.assert(t, k, func(existing clauses, new clauses) clauses {
+	return vm.assert(t, false, k, func(existing clauses, new clauses) clauses {
 		return append(existing, new...)
 	}, env)
 }
 
 // Asserta prepends t to the database.
 func (vm *VM) Asserta(t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
-	return vm.assert(t, k, func(existing clauses, new clauses) clauses {
-		return append(new, existing...)
+	return vm.assert(t, true, k, func(existing clauses, new clauses) clauses {
+		cs := make(clauses, 0, len(new)+len(existing))
+		cs = append(cs, new...)
+		return append(cs, existing...)
 	}, env)
 }
 
-func (vm *VM) assert(t term.Interface, k func(*term.Env) *nondet.Promise, merge func(clauses, clauses) clauses, env *term.Env) *nondet.Promise {
+func (vm *VM) assert(t term.Interface, front bool, k func(*term.Env) *nondet.Promise, merge func(clauses, clauses) clauses, env *term.Env) *nondet.Promise {
 	pi, args, err := piArgs(t, env)
 	if err != nil {
 		return nondet.Error(err)
@@ -410,13 +452,12 @@ func (vm *VM) assert(t term.Interface, k func(*term.Env) *nondet.Promise, merge
 
 	switch pi {
 	case ProcedureIndicator{Name: ":-", Arity: 1}: // directive
-		name, args, err := piArgs(args[0], env)
-		if err != nil {
+		if _, _, err := piArgs(args[0], env); err != nil {
 			return nondet.Error(err)
 		}
 		return nondet.Delay(func(context.Context) *nondet.Promise {
 			env := env
-			return vm.arrive(name, args, k, env)
+			return vm.Call(args[0], k, env)
 		})
 	case ProcedureIndicator{Name: ":-", Arity: 2}:
 		pi, _, err = piArgs(args[0], env)
@@ -425,8 +466,14 @@ func (vm *VM) assert(t term.Interface, k func(*term.Env) *nondet.Promise, merge
 		}
 	}
 
+	added, err := compile(t, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	vm.mu.Lock()
 	if vm.procedures == nil {
-		vm.procedures = map[ProcedureIndicator]procedure{}
+		vm.procedures = map[ProcedureIndicator]Procedure{}
 	}
 	p, ok := vm.procedures[pi]
 	if !ok {
@@ -435,18 +482,66 @@ func (vm *VM) assert(t term.Interface, k func(*term.Env) *nondet.Promise, merge
 
 	existing, ok := p.(clauses)
 	if !ok {
+		vm.mu.Unlock()
+		if d, ok := p.(DynamicProcedure); ok {
+			if err := d.Assert(t, front, env); err != nil {
+				return nondet.Error(err)
+			}
+			return k(env)
+		}
 		return nondet.Error(permissionErrorModifyStaticProcedure(pi.Term()))
 	}
 
-	added, err := compile(t, env)
-	if err != nil {
-		return nondet.Error(err)
-	}
-
 	vm.procedures[pi] = merge(existing, added)
+	vm.mu.Unlock()
 	return k(env)
 }
 
+// AppendFacts appends the facts of the procedure indicated by pi to the database at once. Each fact is given as its
+// arguments. It's faster than Assertz for a large number of facts since it neither copies nor simplifies the terms.
+func (vm *VM) AppendFacts(pi ProcedureIndicator, facts [][]term.Interface) error {
+	added := make(clauses, len(facts))
+	for i, args := range facts {
+		head, err := pi.Apply(args)
+		if err != nil {
+			return fmt.Errorf("%s: %w: %s", pi, err, term.List(args...))
+		}
+		c, err := compileClause(head, nil, nil)
+		if err != nil {
+			return err
+		}
+		c.raw = head
+		added[i] = &c
+	}
+
+	vm.mu.Lock()
+	if vm.procedures == nil {
+		vm.procedures = map[ProcedureIndicator]Procedure{}
+	}
+	p, ok := vm.procedures[pi]
+	if !ok {
+		p = clauses{}
+	}
+
+	existing, ok := p.(clauses)
+	if !ok {
+		vm.mu.Unlock()
+		if d, ok := p.(DynamicProcedure); ok {
+			for _, c := range added {
+				if err := d.Assert(c.raw, false, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return permissionErrorModifyStaticProcedure(pi.Term())
+	}
+
+	vm.procedures[pi] = append(existing, added...)
+	vm.mu.Unlock()
+	return nil
+}
+
 // BagOf collects all the solutions of goal as instances, which unify with template. instances may contain duplications.
 func (vm *VM) BagOf(template, goal, instances term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 	return vm.collectionOf(term.List, template, goal, instances, k, env)
@@ -542,13 +637,17 @@ func (vm *VM) collectionOf(agg func(...term.Interface) term.Interface, template,
 func (vm *VM) FindAll(template, goal, instances term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
 		var answers []term.Interface
-		if _, err := vm.Call(goal, func(env *term.Env) *nondet.Promise {
+		if _, err := vm.nested(goal, func(env *term.Env) *nondet.Promise {
 			answers = append(answers, env.Simplify(template))
 			return nondet.Bool(false) // ask for more solutions
 		}, env).Force(ctx); err != nil {
 			return nondet.Error(err)
 		}
-		return Unify(instances, term.List(answers...), k, env)
+		l := term.List(answers...)
+		if err := checkTermSize(ctx, l, env); err != nil {
+			return nondet.Error(err)
+		}
+		return Unify(instances, l, k, env)
 	})
 }
 
@@ -589,26 +688,100 @@ func Throw(ball term.Interface, _ func(*term.Env) *nondet.Promise, env *term.Env
 	})
 }
 
-// Catch calls goal. If an exception is thrown and unifies with catcher, it calls recover.
+// Catch calls goal. If an exception is thrown and unifies with catcher, it calls recover. On backtracking, it resumes
+// goal under the same catcher. The exceptions thrown after goal succeeds aren't caught.
 func (vm *VM) Catch(goal, catcher, recover term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
-	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
-		ok, err := vm.Call(goal, k, env).Force(ctx)
-		if err != nil {
-			ex, ok := err.(*Exception)
-			if !ok {
-				return nondet.Error(err)
-			}
+	return nondet.Delay(func(context.Context) *nondet.Promise {
+		var sol *term.Env
+		it := vm.nested(goal, func(env *term.Env) *nondet.Promise {
+			sol = env
+			return nondet.Bool(true)
+		}, env).Iterator()
+
+		var next func(context.Context) *nondet.Promise
+		next = func(ctx context.Context) *nondet.Promise {
+			ok, err := it.Next(ctx)
+			if err != nil {
+				ex, ok := err.(*Exception)
+				if !ok {
+					return nondet.Error(err)
+				}
 
-			env, ok := catcher.Unify(ex.Term, false, env)
+				env, ok := catcher.Unify(ex.Term, false, env)
+				if !ok {
+					return nondet.Error(err)
+				}
+
+				return nondet.Delay(func(context.Context) *nondet.Promise {
+					return vm.Call(recover, k, env)
+				})
+			}
 			if !ok {
-				return nondet.Error(err)
+				return nondet.Bool(false)
+			}
+			sol := sol
+			// If goal has no choice points left, neither does catch/3 so that the caller can tell it's deterministic.
+			if it.Det() {
+				return nondet.Delay(func(context.Context) *nondet.Promise {
+					return k(sol)
+				})
 			}
-
 			return nondet.Delay(func(context.Context) *nondet.Promise {
-				return vm.Call(recover, k, env)
-			})
+				return k(sol)
+			}, next)
 		}
-		return nondet.Bool(ok)
+		return nondet.Cleanup(it.Close, next)
+	})
+}
+
+// SetupCallCleanup calls setup once and then goal. cleanup is called exactly once when goal succeeds without choice
+// points, fails, raises an exception, or its choice points are cut or abandoned. cleanup runs without the resource
+// limits even if the query is canceled or exceeds its deadline. Then, it's stopped after VM.CleanupTimeout.
+func (vm *VM) SetupCallCleanup(setup, goal, cleanup term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		cleanupCtx := unlimited(ctx)
+		timeout := vm.CleanupTimeout
+		if timeout == 0 {
+			timeout = DefaultCleanupTimeout
+		}
+
+		env := env
+		ok, err := vm.nested(setup, func(e *term.Env) *nondet.Promise {
+			env = e
+			return nondet.Bool(true)
+		}, env).Force(ctx)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		if !ok {
+			return nondet.Bool(false)
+		}
+
+		var done bool
+		runCleanup := func(env *term.Env) {
+			if done {
+				return
+			}
+			done = true
+			ctx, cancel := graceful(cleanupCtx, timeout)
+			defer cancel()
+			// The result of cleanup is ignored as in once(cleanup) -> true; true.
+			_, _ = vm.nested(cleanup, Success, env).Force(ctx)
+		}
+
+		var marker *nondet.Promise
+		marker = nondet.Cleanup(func() {
+			runCleanup(env)
+		}, func(context.Context) *nondet.Promise {
+			return vm.Call(goal, func(env *term.Env) *nondet.Promise {
+				return nondet.Exit(marker, func() {
+					runCleanup(env)
+				}, func(context.Context) *nondet.Promise {
+					return k(env)
+				})
+			}, env)
+		})
+		return marker
 	})
 }
 
@@ -631,9 +804,13 @@ func (vm *VM) CurrentPredicate(pi term.Interface, k func(*term.Env) *nondet.Prom
 		return nondet.Error(typeErrorPredicateIndicator(pi))
 	}
 
+	vm.mu.RLock()
 	ks := make([]func(context.Context) *nondet.Promise, 0, len(vm.procedures))
 	for key, p := range vm.procedures {
-		if _, ok := p.(clauses); !ok {
+		switch p.(type) {
+		case clauses, DynamicProcedure, PublicProcedure:
+			break
+		default:
 			continue
 		}
 		c := key.Term()
@@ -641,10 +818,11 @@ func (vm *VM) CurrentPredicate(pi term.Interface, k func(*term.Env) *nondet.Prom
 			return Unify(pi, c, k, env)
 		})
 	}
+	vm.mu.RUnlock()
 	return nondet.Delay(ks...)
 }
 
-// Retract removes a clause which matches with t.
+// Retract removes a clause which matches with t. On backtracking, it removes the next clause which matches with t.
 func (vm *VM) Retract(t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 	t = term.Rulify(t, env)
 
@@ -654,44 +832,59 @@ func (vm *VM) Retract(t term.Interface, k func(*term.Env) *nondet.Promise, env *
 		return nondet.Error(err)
 	}
 
-	p, ok := vm.procedures[pi]
+	p, ok := vm.procedure(pi)
 	if !ok {
 		return nondet.Bool(false)
 	}
 
 	cs, ok := p.(clauses)
 	if !ok {
+		if d, ok := p.(DynamicProcedure); ok {
+			return d.Retract(t, k, env)
+		}
 		return nondet.Error(permissionErrorModifyStaticProcedure(pi.Term()))
 	}
 
-	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
-		updated := make(clauses, 0, len(cs))
-		defer func() { vm.procedures[pi] = updated }()
-
-		for i, c := range cs {
-			env := env
-
-			raw := term.Rulify(c.raw, env)
+	// We iterate over the snapshot of the clauses at the time of the call (logical update view).
+	ks := make([]func(context.Context) *nondet.Promise, len(cs))
+	for i := range cs {
+		c := cs[i]
+		ks[i] = func(context.Context) *nondet.Promise {
+			raw := term.Rulify(copyTerm(c.raw, nil, env), env)
 
 			env, ok := t.Unify(raw, false, env)
 			if !ok {
-				updated = append(updated, c)
-				continue
+				return nondet.Bool(false)
 			}
 
-			ok, err := k(env).Force(ctx)
-			if err != nil {
-				updated = append(updated, cs[i+1:]...)
-				return nondet.Error(err)
-			}
-			if ok {
-				updated = append(updated, cs[i+1:]...)
-				return nondet.Bool(true)
+			// A concurrent query may have removed it in the meantime.
+			if !vm.retract(pi, c) {
+				return nondet.Bool(false)
 			}
+			return k(env)
 		}
+	}
+	return nondet.Delay(ks...)
+}
 
-		return nondet.Bool(false)
-	})
+// retract removes c from the procedure indicated by pi if it's still there. It reports whether it removed c.
+func (vm *VM) retract(pi ProcedureIndicator, c *clause) bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	cs, ok := vm.procedures[pi].(clauses)
+	if !ok {
+		return false
+	}
+	for i := range cs {
+		if cs[i] != c {
+			continue
+		}
+		updated := make(clauses, 0, len(cs)-1)
+		updated = append(updated, cs[:i]...)
+		vm.procedures[pi] = append(updated, cs[i+1:]...)
+		return true
+	}
+	return false
 }
 
 // Abolish removes the procedure indicated by pi from the database.
@@ -718,13 +911,16 @@ func (vm *VM) Abolish(pi term.Interface, k func(*term.Env) *nondet.Promise, env
 					return nondet.Error(domainErrorNotLessThanZero(arity))
 				}
 				key := ProcedureIndicator{Name: name, Arity: arity}
+				vm.mu.Lock()
 				if _, ok := vm.procedures[key].(clauses); !ok {
+					vm.mu.Unlock()
 					return nondet.Error(permissionErrorModifyStaticProcedure(&term.Compound{
 						Functor: "/",
 						Args:    []term.Interface{name, arity},
 					}))
 				}
 				delete(vm.procedures, key)
+				vm.mu.Unlock()
 				return k(env)
 			default:
 				return nondet.Error(typeErrorInteger(arity))
@@ -746,8 +942,11 @@ func (vm *VM) CurrentInput(stream term.Interface, k func(*term.Env) *nondet.Prom
 		return nondet.Error(domainErrorStream(stream))
 	}
 
+	vm.mu.RLock()
+	input := vm.input
+	vm.mu.RUnlock()
 	return nondet.Delay(func(context.Context) *nondet.Promise {
-		return Unify(stream, vm.input, k, env)
+		return Unify(stream, input, k, env)
 	})
 }
 
@@ -760,9 +959,12 @@ func (vm *VM) CurrentOutput(stream term.Interface, k func(*term.Env) *nondet.Pro
 		return nondet.Error(domainErrorStream(stream))
 	}
 
+	vm.mu.RLock()
+	output := vm.output
+	vm.mu.RUnlock()
 	return nondet.Delay(func(context.Context) *nondet.Promise {
 		env := env
-		return Unify(stream, vm.output, k, env)
+		return Unify(stream, output, k, env)
 	})
 }
 
@@ -777,7 +979,9 @@ func (vm *VM) SetInput(streamOrAlias term.Interface, k func(*term.Env) *nondet.P
 		return nondet.Error(permissionErrorInputStream(streamOrAlias))
 	}
 
+	vm.mu.Lock()
 	vm.input = s
+	vm.mu.Unlock()
 	return k(env)
 }
 
@@ -792,7 +996,9 @@ func (vm *VM) SetOutput(streamOrAlias term.Interface, k func(*term.Env) *nondet.
 		return nondet.Error(permissionErrorOutputStream(streamOrAlias))
 	}
 
+	vm.mu.Lock()
 	vm.output = s
+	vm.mu.Unlock()
 	return k(env)
 }
 
@@ -894,7 +1100,10 @@ func (vm *VM) Open(SourceSink, mode, stream, options term.Interface, k func(*ter
 				case term.Variable:
 					return instantiationError(arg)
 				case term.Atom:
-					if _, ok := vm.streams[a]; ok {
+					vm.mu.RLock()
+					_, ok := vm.streams[a]
+					vm.mu.RUnlock()
+					if ok {
 						return permissionError(term.Atom("open"), term.Atom("source_sink"), option, term.Atom(fmt.Sprintf("%s is already defined as an alias.", a)))
 					}
 					s.Alias = a
@@ -933,16 +1142,9 @@ func (vm *VM) Open(SourceSink, mode, stream, options term.Interface, k func(*ter
 		return nondet.Error(err)
 	}
 
-	f, err := os.OpenFile(string(n), flag, perm)
+	f, err := vm.fileSystem().OpenFile(string(n), flag, perm)
 	if err != nil {
-		switch {
-		case os.IsNotExist(err):
-			return nondet.Error(existenceErrorSourceSink(SourceSink))
-		case os.IsPermission(err):
-			return nondet.Error(permissionError(term.Atom("open"), term.Atom("source_sink"), SourceSink, term.Atom(fmt.Sprintf("%s cannot be opened.", SourceSink))))
-		default:
-			return nondet.Error(systemError(err))
-		}
+		return nondet.Error(openError(SourceSink, err))
 	}
 
 	switch s.Mode {
@@ -959,6 +1161,7 @@ func (vm *VM) Open(SourceSink, mode, stream, options term.Interface, k func(*ter
 	}
 	s.Closer = f
 
+	vm.mu.Lock()
 	if vm.streams == nil {
 		vm.streams = map[term.Interface]*term.Stream{}
 	}
@@ -968,6 +1171,7 @@ func (vm *VM) Open(SourceSink, mode, stream, options term.Interface, k func(*ter
 	} else {
 		vm.streams[s.Alias] = &s
 	}
+	vm.mu.Unlock()
 
 	return nondet.Delay(func(context.Context) *nondet.Promise {
 		env := env
@@ -975,6 +1179,18 @@ func (vm *VM) Open(SourceSink, mode, stream, options term.Interface, k func(*ter
 	})
 }
 
+// openError converts an error from FileSystem.OpenFile into an exception.
+func openError(sourceSink term.Interface, err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return existenceErrorSourceSink(sourceSink)
+	case os.IsPermission(err):
+		return permissionError(term.Atom("open"), term.Atom("source_sink"), sourceSink, term.Atom(fmt.Sprintf("%s cannot be opened.", sourceSink)))
+	default:
+		return systemError(err)
+	}
+}
+
 // Close closes a stream specified by streamOrAlias.
 func (vm *VM) Close(streamOrAlias, options term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 	s, err := vm.stream(streamOrAlias, env)
@@ -1022,11 +1238,13 @@ func (vm *VM) Close(streamOrAlias, options term.Interface, k func(*term.Env) *no
 		return nondet.Error(resourceError(streamOrAlias, term.Atom(err.Error())))
 	}
 
+	vm.mu.Lock()
 	if s.Alias == "" {
 		delete(vm.streams, s)
 	} else {
 		delete(vm.streams, s.Alias)
 	}
+	vm.mu.Unlock()
 
 	return k(env)
 }
@@ -1070,7 +1288,7 @@ func (vm *VM) WriteTerm(streamOrAlias, t, options term.Interface, k func(*term.E
 		return nondet.Error(permissionErrorOutputBinaryStream(streamOrAlias))
 	}
 
-	opts := term.WriteTermOptions{Ops: vm.operators}
+	opts := term.WriteTermOptions{Ops: vm.ops()}
 	if err := Each(env.Resolve(options), func(option term.Interface) error {
 		switch option := env.Resolve(option).(type) {
 		case term.Variable:
@@ -1104,7 +1322,7 @@ func (vm *VM) WriteTerm(streamOrAlias, t, options term.Interface, k func(*term.E
 				if b {
 					opts.Ops = nil
 				} else {
-					opts.Ops = vm.operators
+					opts.Ops = vm.ops()
 				}
 			case "numbervars":
 				opts.NumberVars = b
@@ -1618,16 +1836,23 @@ func (vm *VM) PeekChar(streamOrAlias, char term.Interface, k func(*term.Env) *no
 	}
 }
 
-var osExit = os.Exit
+// HaltError is returned when halt/1 is called. It unwinds the query instead of exiting the process so that the host
+// can decide what to do with it.
+type HaltError struct {
+	Code int
+}
 
-// Halt exits the process with exit code of n.
-func Halt(n term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+func (e *HaltError) Error() string {
+	return fmt.Sprintf("halt(%d)", e.Code)
+}
+
+// Halt stops the query with *HaltError of which exit code is n. catch/3 can't catch it but the cleanup handlers run.
+func Halt(n term.Interface, _ func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 	switch code := env.Resolve(n).(type) {
 	case term.Variable:
 		return nondet.Error(instantiationError(n))
 	case term.Integer:
-		osExit(int(code))
-		return k(env)
+		return nondet.Error(&HaltError{Code: int(code)})
 	default:
 		return nondet.Error(typeErrorInteger(n))
 	}
@@ -1647,13 +1872,16 @@ func (vm *VM) Clause(head, body term.Interface, k func(*term.Env) *nondet.Promis
 		return nondet.Error(typeErrorCallable(body))
 	}
 
-	p, ok := vm.procedures[pi]
+	p, ok := vm.procedure(pi)
 	if !ok {
 		return nondet.Bool(false)
 	}
 
 	cs, ok := p.(clauses)
 	if !ok {
+		if p, ok := p.(PublicProcedure); ok {
+			return p.Clause(head, body, k, env)
+		}
 		return nondet.Error(permissionErrorAccessPrivateProcedure(pi.Term()))
 	}
 
@@ -2394,16 +2622,19 @@ func binaryNumber(fi func(i, j int64) int64, ff func(n, m float64) float64) func
 
 // StreamProperty succeeds iff the stream represented by streamOrAlias has the stream property property.
 func (vm *VM) StreamProperty(streamOrAlias, property term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
-	streams := make([]*term.Stream, 0, len(vm.streams))
+	var streams []*term.Stream
 	switch s := env.Resolve(streamOrAlias).(type) {
 	case term.Variable:
+		vm.mu.RLock()
+		streams = make([]*term.Stream, 0, len(vm.streams))
 		for _, v := range vm.streams {
 			streams = append(streams, v)
 		}
+		vm.mu.RUnlock()
 	case term.Atom: // ISO standard stream_property/2 doesn't take an alias but why not?
-		v, ok := vm.streams[s]
-		if !ok {
-			return nondet.Error(existenceErrorStream(streamOrAlias))
+		v, err := vm.stream(s, env)
+		if err != nil {
+			return nondet.Error(err)
 		}
 		streams = append(streams, v)
 	case *term.Stream:
@@ -2599,14 +2830,19 @@ func (vm *VM) CharConversion(inChar, outChar term.Interface, k func(*term.Env) *
 				return nondet.Error(representationError(term.Atom("character"), term.Atom(fmt.Sprintf("%s is not a character.", outChar))))
 			}
 
-			if vm.charConversions == nil {
-				vm.charConversions = map[rune]rune{}
+			// char conversions are copy-on-write since lexers may be reading them.
+			vm.mu.Lock()
+			conv := make(map[rune]rune, len(vm.charConversions)+1)
+			for k, v := range vm.charConversions {
+				conv[k] = v
 			}
 			if i[0] == o[0] {
-				delete(vm.charConversions, i[0])
-				return k(env)
+				delete(conv, i[0])
+			} else {
+				conv[i[0]] = o[0]
 			}
-			vm.charConversions[i[0]] = o[0]
+			vm.charConversions = conv
+			vm.mu.Unlock()
 			return k(env)
 		default:
 			return nondet.Error(representationError(term.Atom("character"), term.Atom(fmt.Sprintf("%s is not a character.", outChar))))
@@ -2642,9 +2878,13 @@ func (vm *VM) CurrentCharConversion(inChar, outChar term.Interface, k func(*term
 		return nondet.Error(representationError(term.Atom("character"), term.Atom(fmt.Sprintf("%s is not a character.", outChar))))
 	}
 
+	vm.mu.RLock()
+	conv := vm.charConversions
+	vm.mu.RUnlock()
+
 	if c1, ok := env.Resolve(inChar).(term.Atom); ok {
 		r := []rune(c1)
-		if r, ok := vm.charConversions[r[0]]; ok {
+		if r, ok := conv[r[0]]; ok {
 			return nondet.Delay(func(context.Context) *nondet.Promise {
 				env := env
 				return Unify(outChar, term.Atom(r), k, env)
@@ -2660,7 +2900,7 @@ func (vm *VM) CurrentCharConversion(inChar, outChar term.Interface, k func(*term
 	ks := make([]func(context.Context) *nondet.Promise, 256)
 	for i := 0; i < 256; i++ {
 		r := rune(i)
-		cr, ok := vm.charConversions[r]
+		cr, ok := conv[r]
 		if !ok {
 			cr = r
 		}
@@ -2680,7 +2920,7 @@ func (vm *VM) SetPrologFlag(flag, value term.Interface, k func(*term.Env) *nonde
 		return nondet.Error(instantiationError(flag))
 	case term.Atom:
 		switch f {
-		case "bounded", "max_integer", "min_integer", "integer_rounding_function", "max_arity":
+		case "bounded", "max_integer", "min_integer", "integer_rounding_function", "max_arity", "cpu_count":
 			return nondet.Error(permissionError(term.Atom("modify"), term.Atom("flag"), f, term.Atom(fmt.Sprintf("%s is not modifiable.", f))))
 		case "char_conversion":
 			switch a := env.Resolve(value).(type) {
@@ -2689,10 +2929,14 @@ func (vm *VM) SetPrologFlag(flag, value term.Interface, k func(*term.Env) *nonde
 			case term.Atom:
 				switch a {
 				case "on":
+					vm.mu.Lock()
 					vm.charConvEnabled = true
+					vm.mu.Unlock()
 					return k(env)
 				case "off":
+					vm.mu.Lock()
 					vm.charConvEnabled = false
+					vm.mu.Unlock()
 					return k(env)
 				default:
 					return nondet.Error(domainErrorFlagValue(&term.Compound{
@@ -2713,10 +2957,14 @@ func (vm *VM) SetPrologFlag(flag, value term.Interface, k func(*term.Env) *nonde
 			case term.Atom:
 				switch a {
 				case "on":
+					vm.mu.Lock()
 					vm.debug = true
+					vm.mu.Unlock()
 					return k(env)
 				case "off":
+					vm.mu.Lock()
 					vm.debug = false
+					vm.mu.Unlock()
 					return k(env)
 				default:
 					return nondet.Error(domainErrorFlagValue(&term.Compound{
@@ -2737,13 +2985,19 @@ func (vm *VM) SetPrologFlag(flag, value term.Interface, k func(*term.Env) *nonde
 			case term.Atom:
 				switch a {
 				case "error":
+					vm.mu.Lock()
 					vm.unknown = unknownError
+					vm.mu.Unlock()
 					return k(env)
 				case "warning":
+					vm.mu.Lock()
 					vm.unknown = unknownWarning
+					vm.mu.Unlock()
 					return k(env)
 				case "fail":
+					vm.mu.Lock()
 					vm.unknown = unknownFail
+					vm.mu.Unlock()
 					return k(env)
 				default:
 					return nondet.Error(domainErrorFlagValue(&term.Compound{
@@ -2764,13 +3018,19 @@ func (vm *VM) SetPrologFlag(flag, value term.Interface, k func(*term.Env) *nonde
 			case term.Atom:
 				switch a {
 				case "codes":
+					vm.mu.Lock()
 					vm.doubleQuotes = term.DoubleQuotesCodes
+					vm.mu.Unlock()
 					return k(env)
 				case "chars":
+					vm.mu.Lock()
 					vm.doubleQuotes = term.DoubleQuotesChars
+					vm.mu.Unlock()
 					return k(env)
 				case "atom":
+					vm.mu.Lock()
 					vm.doubleQuotes = term.DoubleQuotesAtom
+					vm.mu.Unlock()
 					return k(env)
 				default:
 					return nondet.Error(domainErrorFlagValue(&term.Compound{
@@ -2799,7 +3059,7 @@ func (vm *VM) CurrentPrologFlag(flag, value term.Interface, k func(*term.Env) *n
 		break
 	case term.Atom:
 		switch f {
-		case "bounded", "max_integer", "min_integer", "integer_rounding_function", "char_conversion", "debug", "max_arity", "unknown", "double_quotes":
+		case "bounded", "max_integer", "min_integer", "integer_rounding_function", "char_conversion", "debug", "max_arity", "unknown", "double_quotes", "cpu_count":
 			break
 		default:
 			return nondet.Error(domainErrorPrologFlag(f))
@@ -2809,6 +3069,7 @@ func (vm *VM) CurrentPrologFlag(flag, value term.Interface, k func(*term.Env) *n
 	}
 
 	pattern := term.Compound{Args: []term.Interface{flag, value}}
+	vm.mu.RLock()
 	flags := []term.Interface{
 		&term.Compound{Args: []term.Interface{term.Atom("bounded"), term.Atom("true")}},
 		&term.Compound{Args: []term.Interface{term.Atom("max_integer"), term.Integer(math.MaxInt64)}},
@@ -2819,7 +3080,9 @@ func (vm *VM) CurrentPrologFlag(flag, value term.Interface, k func(*term.Env) *n
 		&term.Compound{Args: []term.Interface{term.Atom("max_arity"), term.Atom("unbounded")}},
 		&term.Compound{Args: []term.Interface{term.Atom("unknown"), term.Atom(vm.unknown.String())}},
 		&term.Compound{Args: []term.Interface{term.Atom("double_quotes"), term.Atom(vm.doubleQuotes.String())}},
+		&term.Compound{Args: []term.Interface{term.Atom("cpu_count"), term.Integer(runtime.NumCPU())}},
 	}
+	vm.mu.RUnlock()
 	ks := make([]func(context.Context) *nondet.Promise, len(flags))
 	for i := range flags {
 		f := flags[i]
@@ -2843,7 +3106,9 @@ func (vm *VM) stream(streamOrAlias term.Interface, env *term.Env) (*term.Stream,
 	case term.Variable:
 		return nil, instantiationError(streamOrAlias)
 	case term.Atom:
+		vm.mu.RLock()
 		v, ok := vm.streams[s]
+		vm.mu.RUnlock()
 		if !ok {
 			return nil, existenceErrorStream(streamOrAlias)
 		}
@@ -2872,13 +3137,22 @@ func (vm *VM) Dynamic(pi term.Interface, k func(*term.Env) *nondet.Promise, env
 				return nondet.Error(instantiationError(pi))
 			case term.Integer:
 				pi := ProcedureIndicator{Name: f, Arity: a}
+				vm.mu.Lock()
+				if vm.procedures == nil {
+					vm.procedures = map[ProcedureIndicator]Procedure{}
+				}
 				p, ok := vm.procedures[pi]
 				if !ok {
 					vm.procedures[pi] = clauses{}
-					return k(env)
 				}
-				if _, ok := p.(clauses); !ok {
-					return nondet.Bool(false)
+				vm.mu.Unlock()
+				if ok {
+					switch p.(type) {
+					case clauses, DynamicProcedure:
+						break
+					default:
+						return nondet.Bool(false)
+					}
 				}
 				return k(env)
 			default:
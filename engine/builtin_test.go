@@ -11,6 +11,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 	"unicode"
@@ -35,7 +36,7 @@ func TestVM_Call(t *testing.T) {
 		assert.False(t, ok)
 	})
 
-	vm.procedures = map[ProcedureIndicator]procedure{{Name: "foo", Arity: 0}: clauses{}}
+	vm.procedures = map[ProcedureIndicator]Procedure{{Name: "foo", Arity: 0}: clauses{}}
 
 	t.Run("defined atom", func(t *testing.T) {
 		ok, err := vm.Call(term.Atom("foo"), Success, nil).Force(context.Background())
@@ -52,7 +53,7 @@ func TestVM_Call(t *testing.T) {
 		assert.False(t, ok)
 	})
 
-	vm.procedures = map[ProcedureIndicator]procedure{{Name: "bar", Arity: 2}: clauses{}}
+	vm.procedures = map[ProcedureIndicator]Procedure{{Name: "bar", Arity: 2}: clauses{}}
 
 	t.Run("defined compound", func(t *testing.T) {
 		ok, err := vm.Call(&term.Compound{Functor: "bar", Args: []term.Interface{term.NewVariable(), term.NewVariable()}}, Success, nil).Force(context.Background())
@@ -756,7 +757,7 @@ func TestVM_CurrentOp(t *testing.T) {
 func TestVM_BagOf(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 3}: clauses{
 					{xrTable: []term.Interface{term.Atom("a"), term.Atom("b"), term.Atom("c")}, bytecode: bytecode{
 						{opcode: opConst, operand: 0},
@@ -903,7 +904,7 @@ func TestVM_BagOf(t *testing.T) {
 
 	t.Run("disjunction", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 1}: predicate1(func(t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 					return nondet.Delay(func(ctx context.Context) *nondet.Promise {
 						return Unify(t, term.Atom("a"), k, env)
@@ -993,7 +994,7 @@ func TestVM_BagOf(t *testing.T) {
 func TestVM_SetOf(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 3}: clauses{
 					{xrTable: []term.Interface{term.Atom("a"), term.Atom("b"), term.Atom("c")}, bytecode: bytecode{
 						{opcode: opConst, operand: 0},
@@ -1160,7 +1161,7 @@ func TestVM_SetOf(t *testing.T) {
 func TestVM_FindAll(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 3}: clauses{
 					{xrTable: []term.Interface{term.Atom("a"), term.Atom("b"), term.Atom("c")}, bytecode: bytecode{
 						{opcode: opConst, operand: 0},
@@ -1237,7 +1238,7 @@ func TestVM_FindAll(t *testing.T) {
 		instances := term.Variable("instances")
 
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "fail", Arity: 0}: predicate0(func(f func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 					return nondet.Bool(false)
 				}),
@@ -1472,11 +1473,56 @@ func TestVM_Catch(t *testing.T) {
 		assert.Error(t, err)
 		assert.False(t, ok)
 	})
+
+	// g(1). g(2). g(3). g(_) :- throw(a).
+	vm.Register1("g", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return nondet.Delay(func(context.Context) *nondet.Promise {
+			return Unify(x, term.Integer(1), k, env)
+		}, func(context.Context) *nondet.Promise {
+			return Unify(x, term.Integer(2), k, env)
+		}, func(context.Context) *nondet.Promise {
+			return Unify(x, term.Integer(3), k, env)
+		}, func(context.Context) *nondet.Promise {
+			return Throw(term.Atom("a"), k, env)
+		})
+	})
+
+	t.Run("backtrack", func(t *testing.T) {
+		var xs []term.Interface
+		ok, err := vm.Catch(&term.Compound{
+			Functor: "g",
+			Args:    []term.Interface{term.Variable("X")},
+		}, term.Atom("a"), term.Atom("true"), func(env *term.Env) *nondet.Promise {
+			xs = append(xs, env.Resolve(term.Variable("X")))
+			return nondet.Bool(false)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, []term.Interface{term.Integer(1), term.Integer(2), term.Integer(3), term.Variable("X")}, xs)
+	})
+
+	t.Run("continuation", func(t *testing.T) {
+		var xs []term.Interface
+		ok, err := vm.Catch(&term.Compound{
+			Functor: "g",
+			Args:    []term.Interface{term.Variable("X")},
+		}, term.Variable("E"), term.Atom("true"), func(env *term.Env) *nondet.Promise {
+			x := env.Resolve(term.Variable("X"))
+			xs = append(xs, x)
+			if x == term.Integer(2) {
+				return Throw(term.Atom("b"), Success, env)
+			}
+			return nondet.Bool(false)
+		}, nil).Force(context.Background())
+		assert.Equal(t, &Exception{Term: term.Atom("b")}, err)
+		assert.False(t, ok)
+		assert.Equal(t, []term.Interface{term.Integer(1), term.Integer(2)}, xs)
+	})
 }
 
 func TestVM_CurrentPredicate(t *testing.T) {
 	t.Run("user defined predicate", func(t *testing.T) {
-		vm := VM{procedures: map[ProcedureIndicator]procedure{
+		vm := VM{procedures: map[ProcedureIndicator]Procedure{
 			{Name: "foo", Arity: 1}: clauses{},
 		}}
 		ok, err := vm.CurrentPredicate(&term.Compound{
@@ -1495,7 +1541,7 @@ func TestVM_CurrentPredicate(t *testing.T) {
 
 		v := term.Variable("V")
 
-		vm := VM{procedures: map[ProcedureIndicator]procedure{
+		vm := VM{procedures: map[ProcedureIndicator]Procedure{
 			{Name: "foo", Arity: 1}: clauses{},
 			{Name: "bar", Arity: 1}: clauses{},
 			{Name: "baz", Arity: 1}: clauses{},
@@ -1527,7 +1573,7 @@ func TestVM_CurrentPredicate(t *testing.T) {
 	})
 
 	t.Run("builtin predicate", func(t *testing.T) {
-		vm := VM{procedures: map[ProcedureIndicator]procedure{
+		vm := VM{procedures: map[ProcedureIndicator]Procedure{
 			{Name: "=", Arity: 2}: predicate2(Unify),
 		}}
 		ok, err := vm.CurrentPredicate(&term.Compound{
@@ -1650,7 +1696,7 @@ func TestVM_Assertz(t *testing.T) {
 	t.Run("directive", func(t *testing.T) {
 		var called bool
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "directive", Arity: 0}: predicate0(func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 					called = true
 					return k(env)
@@ -1755,7 +1801,7 @@ func TestVM_Assertz(t *testing.T) {
 
 	t.Run("static", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "static", Arity: 0}: predicate0(func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 					return k(env)
 				}),
@@ -1822,7 +1868,7 @@ func TestVM_Asserta(t *testing.T) {
 	t.Run("directive", func(t *testing.T) {
 		var called bool
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "directive", Arity: 0}: predicate0(func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 					called = true
 					return k(env)
@@ -1925,7 +1971,7 @@ func TestVM_Asserta(t *testing.T) {
 
 	t.Run("static", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "static", Arity: 0}: predicate0(func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 					return k(env)
 				}),
@@ -1947,7 +1993,7 @@ func TestVM_Asserta(t *testing.T) {
 func TestVM_Retract(t *testing.T) {
 	t.Run("retract the first one", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 1}: clauses{
 					{raw: &term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("a")}}},
 					{raw: &term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("b")}}},
@@ -1971,7 +2017,7 @@ func TestVM_Retract(t *testing.T) {
 
 	t.Run("retract the specific one", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 1}: clauses{
 					{raw: &term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("a")}}},
 					{raw: &term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("b")}}},
@@ -1995,7 +2041,7 @@ func TestVM_Retract(t *testing.T) {
 
 	t.Run("retract all", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 1}: clauses{
 					{raw: &term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("a")}}},
 					{raw: &term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("b")}}},
@@ -2042,7 +2088,7 @@ func TestVM_Retract(t *testing.T) {
 
 	t.Run("static", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 0}: predicate0(nil),
 			},
 		}
@@ -2057,7 +2103,7 @@ func TestVM_Retract(t *testing.T) {
 
 	t.Run("exception in continuation", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 1}: clauses{
 					{raw: &term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("a")}}},
 				},
@@ -2081,7 +2127,7 @@ func TestVM_Retract(t *testing.T) {
 func TestVM_Abolish(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 1}: clauses{
 					{raw: &term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("a")}}},
 					{raw: &term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("b")}}},
@@ -2175,7 +2221,7 @@ func TestVM_Abolish(t *testing.T) {
 
 	t.Run("The predicate indicator pi is that of a static procedure", func(t *testing.T) {
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "foo", Arity: 0}: predicate0(nil),
 			},
 		}
@@ -4311,20 +4357,9 @@ func TestVM_PeekChar(t *testing.T) {
 
 func Test_Halt(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
-		var exitCalled bool
-		osExit = func(code int) {
-			assert.Equal(t, 2, code)
-			exitCalled = true
-		}
-		defer func() {
-			osExit = os.Exit
-		}()
-
 		ok, err := Halt(term.Integer(2), Success, nil).Force(context.Background())
-		assert.NoError(t, err)
-		assert.True(t, ok)
-
-		assert.True(t, exitCalled)
+		assert.Equal(t, &HaltError{Code: 2}, err)
+		assert.False(t, ok)
 	})
 
 	t.Run("n is a variable", func(t *testing.T) {
@@ -4350,7 +4385,7 @@ func TestVM_Clause(t *testing.T) {
 		var c int
 
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "green", Arity: 1}: clauses{
 					{raw: &term.Compound{
 						Functor: ":-", Args: []term.Interface{
@@ -4407,7 +4442,7 @@ func TestVM_Clause(t *testing.T) {
 		what, body := term.Variable("What"), term.Variable("Body")
 
 		vm := VM{
-			procedures: map[ProcedureIndicator]procedure{
+			procedures: map[ProcedureIndicator]Procedure{
 				{Name: "green", Arity: 1}: predicate1(func(t term.Interface, f func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 					return nondet.Bool(true)
 				}),
@@ -5975,6 +6010,13 @@ func TestVM_SetPrologFlag(t *testing.T) {
 		assert.False(t, ok)
 	})
 
+	t.Run("cpu_count", func(t *testing.T) {
+		var vm VM
+		ok, err := vm.SetPrologFlag(term.Atom("cpu_count"), term.NewVariable(), Success, nil).Force(context.Background())
+		assert.Equal(t, permissionError(term.Atom("modify"), term.Atom("flag"), term.Atom("cpu_count"), term.Atom("cpu_count is not modifiable.")), err)
+		assert.False(t, ok)
+	})
+
 	t.Run("unknown", func(t *testing.T) {
 		t.Run("error", func(t *testing.T) {
 			vm := VM{unknown: unknownFail}
@@ -6086,6 +6128,10 @@ func TestVM_CurrentPrologFlag(t *testing.T) {
 		ok, err = vm.CurrentPrologFlag(term.Atom("unknown"), term.Atom("error"), Success, nil).Force(context.Background())
 		assert.NoError(t, err)
 		assert.True(t, ok)
+
+		ok, err = vm.CurrentPrologFlag(term.Atom("cpu_count"), term.Integer(runtime.NumCPU()), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
 	})
 
 	t.Run("not specified", func(t *testing.T) {
@@ -6120,6 +6166,9 @@ func TestVM_CurrentPrologFlag(t *testing.T) {
 			case 8:
 				assert.Equal(t, term.Atom("double_quotes"), env.Resolve(flag))
 				assert.Equal(t, term.Atom(vm.doubleQuotes.String()), env.Resolve(value))
+			case 9:
+				assert.Equal(t, term.Atom("cpu_count"), env.Resolve(flag))
+				assert.Equal(t, term.Integer(runtime.NumCPU()), env.Resolve(value))
 			default:
 				assert.Fail(t, "unreachable")
 			}
@@ -6128,7 +6177,7 @@ func TestVM_CurrentPrologFlag(t *testing.T) {
 		}, nil).Force(context.Background())
 		assert.NoError(t, err)
 		assert.False(t, ok)
-		assert.Equal(t, 9, c)
+		assert.Equal(t, 10, c)
 	})
 
 	t.Run("flag is neither a variable nor an atom", func(t *testing.T) {
@@ -6145,3 +6194,82 @@ func TestVM_CurrentPrologFlag(t *testing.T) {
 		assert.False(t, ok)
 	})
 }
+
+func TestVM_RegisterN(t *testing.T) {
+	var vm VM
+	// max/N is a variadic family of predicates of which the last argument is the maximum of the others.
+	max := func(args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		m := term.Integer(0)
+		for _, a := range args[:len(args)-1] {
+			i, ok := env.Resolve(a).(term.Integer)
+			if !ok {
+				return nondet.Error(typeErrorInteger(a))
+			}
+			if i > m {
+				m = i
+			}
+		}
+		return Unify(args[len(args)-1], m, k, env)
+	}
+	for n := 2; n <= 8; n++ {
+		vm.RegisterN("max", n, max)
+	}
+
+	ok, err := vm.Call(&term.Compound{
+		Functor: "max",
+		Args:    []term.Interface{term.Integer(3), term.Integer(1), term.Integer(4), term.Integer(1), term.Integer(5), term.Integer(9), term.Integer(2), term.Variable("M")},
+	}, func(env *term.Env) *nondet.Promise {
+		assert.Equal(t, term.Integer(9), env.Resolve(term.Variable("M")))
+		return nondet.Bool(true)
+	}, nil).Force(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = vm.Call(&term.Compound{
+		Functor: "max",
+		Args:    []term.Interface{term.Integer(3), term.Integer(3)},
+	}, Success, nil).Force(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	t.Run("negative arity", func(t *testing.T) {
+		assert.PanicsWithValue(t, "negative arity: -1", func() {
+			vm.RegisterN("max", -1, max)
+		})
+	})
+}
+
+func TestVM_AppendFacts(t *testing.T) {
+	var vm VM
+	pi := ProcedureIndicator{Name: "age", Arity: 2}
+	assert.NoError(t, vm.AppendFacts(pi, [][]term.Interface{
+		{term.Atom("alice"), term.Integer(30)},
+		{term.Atom("bob"), term.Integer(40)},
+	}))
+	assert.NoError(t, vm.AppendFacts(pi, [][]term.Interface{
+		{term.Atom("carol"), term.Integer(50)},
+	}))
+	assert.Error(t, vm.AppendFacts(pi, [][]term.Interface{
+		{term.Atom("dave")},
+	}))
+
+	var ages []term.Interface
+	ok, err := vm.Call(&term.Compound{
+		Functor: "age",
+		Args:    []term.Interface{term.Variable("N"), term.Variable("A")},
+	}, func(env *term.Env) *nondet.Promise {
+		ages = append(ages, env.Resolve(term.Variable("A")))
+		return nondet.Bool(false)
+	}, nil).Force(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, []term.Interface{term.Integer(30), term.Integer(40), term.Integer(50)}, ages)
+
+	t.Run("static", func(t *testing.T) {
+		var vm VM
+		vm.Register2("age", func(_, _ term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return k(env)
+		})
+		assert.Equal(t, permissionErrorModifyStaticProcedure(pi.Term()), vm.AppendFacts(pi, nil))
+	})
+}
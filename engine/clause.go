@@ -9,48 +9,41 @@ import (
 	"github.com/ichiban/prolog/term"
 )
 
-type clauses []clause
+// clauses is a copy-on-write list of clauses. Once a list is shared, its elements must not be modified so that
+// queries iterating over it keep seeing the same clauses. Appending is allowed though since it doesn't affect the
+// existing elements.
+type clauses []*clause
 
 func (cs clauses) Call(vm *VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
 	if len(cs) == 0 {
 		return nondet.Bool(false)
 	}
 
-	if vm.OnCall == nil {
-		vm.OnCall = func(pi ProcedureIndicator, args []term.Interface, env *term.Env) {}
-	}
-	if vm.OnExit == nil {
-		vm.OnExit = func(pi ProcedureIndicator, args []term.Interface, env *term.Env) {}
-	}
-	if vm.OnFail == nil {
-		vm.OnFail = func(pi ProcedureIndicator, args []term.Interface, env *term.Env) {}
-	}
-	if vm.OnRedo == nil {
-		vm.OnRedo = func(pi ProcedureIndicator, args []term.Interface, env *term.Env) {}
-	}
-
 	var p *nondet.Promise
 	ks := make([]func(context.Context) *nondet.Promise, len(cs))
 	for i := range cs {
 		i, c := i, cs[i]
 		ks[i] = func(context.Context) *nondet.Promise {
-			if i == 0 {
+			switch {
+			case i == 0 && vm.OnCall != nil:
 				vm.OnCall(c.pi, args, env)
-			} else {
+			case i > 0 && vm.OnRedo != nil:
 				vm.OnRedo(c.pi, args, env)
 			}
 			vars := make([]term.Variable, len(c.vars))
 			for i := range vars {
 				vars[i] = term.NewVariable()
 			}
-			return nondet.Delay(func(context.Context) *nondet.Promise {
+			exec := func(context.Context) *nondet.Promise {
 				env := env
 				return vm.exec(registers{
 					pc:   c.bytecode,
 					xr:   c.xrTable,
 					vars: vars,
 					cont: func(env *term.Env) *nondet.Promise {
-						vm.OnExit(c.pi, args, env)
+						if vm.OnExit != nil {
+							vm.OnExit(c.pi, args, env)
+						}
 						return k(env)
 					},
 					args:      term.List(args...),
@@ -59,7 +52,12 @@ func (cs clauses) Call(vm *VM, args []term.Interface, k func(*term.Env) *nondet.
 					env:       env,
 					cutParent: p,
 				})
-			}, func(context.Context) *nondet.Promise {
+			}
+			// Without OnFail, we don't leave an extra alternative so that a deterministic call leaves no choice points.
+			if vm.OnFail == nil {
+				return nondet.Delay(exec)
+			}
+			return nondet.Delay(exec, func(context.Context) *nondet.Promise {
 				env := env
 				vm.OnFail(c.pi, args, env)
 				return nondet.Bool(false)
@@ -90,43 +88,11 @@ func compile(t term.Interface, env *term.Env) (clauses, error) {
 			return nil, err
 		}
 		c.raw = t
-		return []clause{c}, nil
+		return clauses{&c}, nil
 	case *term.Compound:
-		if t.Functor == ":-" {
-			var cs []clause
-			head, body := env.Resolve(t.Args[0]), env.Resolve(t.Args[1])
-			exp := body
-			for {
-				e, ok := exp.(*term.Compound)
-				if !ok {
-					break
-				}
-
-				if e.Functor != ";" || len(e.Args) != 2 {
-					break
-				}
-
-				// if-then-else construct
-				if if_, ok := e.Args[0].(*term.Compound); ok && if_.Functor == "->" && len(if_.Args) == 2 {
-					break
-				}
-
-				c, err := compileClause(head, e.Args[0], env)
-				switch err {
-				case nil:
-					break
-				case errNotCallable:
-					return nil, typeErrorCallable(body)
-				default:
-					return nil, err
-				}
-				c.raw = t
-				cs = append(cs, c)
-
-				exp = env.Resolve(e.Args[1])
-			}
-
-			c, err := compileClause(head, exp, env)
+		if t.Functor == ":-" && len(t.Args) == 2 {
+			body := env.Resolve(t.Args[1])
+			c, err := compileClause(t.Args[0], body, env)
 			switch err {
 			case nil:
 				break
@@ -136,9 +102,7 @@ func compile(t term.Interface, env *term.Env) (clauses, error) {
 				return nil, err
 			}
 			c.raw = t
-			cs = append(cs, c)
-
-			return cs, nil
+			return clauses{&c}, nil
 		}
 		c, err := compileClause(t, nil, env)
 		switch err {
@@ -150,7 +114,7 @@ func compile(t term.Interface, env *term.Env) (clauses, error) {
 			return nil, err
 		}
 		c.raw = t
-		return []clause{c}, nil
+		return clauses{&c}, nil
 	default:
 		return nil, typeErrorCallable(t)
 	}
@@ -190,20 +154,7 @@ func compileClause(head term.Interface, body term.Interface, env *term.Env) (cla
 
 func (c *clause) compileBody(body term.Interface, env *term.Env) error {
 	c.bytecode = append(c.bytecode, instruction{opcode: opEnter})
-	for {
-		p, ok := env.Resolve(body).(*term.Compound)
-		if !ok || p.Functor != "," || len(p.Args) != 2 {
-			break
-		}
-		if err := c.compilePred(p.Args[0], env); err != nil {
-			return err
-		}
-		body = p.Args[1]
-	}
-	if err := c.compilePred(body, env); err != nil {
-		return err
-	}
-	return nil
+	return c.compilePred(body, env)
 }
 
 var errNotCallable = errors.New("not callable")
@@ -224,6 +175,33 @@ func (c *clause) compilePred(p term.Interface, env *term.Env) error {
 		c.bytecode = append(c.bytecode, instruction{opcode: opCall, operand: c.piOffset(ProcedureIndicator{Name: p, Arity: 0})})
 		return nil
 	case *term.Compound:
+		switch pi := (ProcedureIndicator{Name: p.Functor, Arity: term.Integer(len(p.Args))}); pi {
+		case ProcedureIndicator{Name: ",", Arity: 2}:
+			if err := c.compilePred(p.Args[0], env); err != nil {
+				return err
+			}
+			return c.compilePred(p.Args[1], env)
+		case ProcedureIndicator{Name: ";", Arity: 2}:
+			if cond, ok := env.Resolve(p.Args[0]).(*term.Compound); ok && len(cond.Args) == 2 {
+				switch cond.Functor {
+				case "->":
+					return c.compileIf(opIf, cond.Args[0], cond.Args[1], p.Args[1], env)
+				case "*->":
+					return c.compileIf(opSoftIf, cond.Args[0], cond.Args[1], p.Args[1], env)
+				}
+			}
+			return c.compileDisj(p.Args[0], p.Args[1], env)
+		case ProcedureIndicator{Name: "->", Arity: 2}:
+			return c.compileIf(opIf, p.Args[0], p.Args[1], nil, env)
+		case ProcedureIndicator{Name: "*->", Arity: 2}:
+			return c.compileIf(opSoftIf, p.Args[0], p.Args[1], nil, env)
+		case ProcedureIndicator{Name: `\+`, Arity: 1}:
+			return c.compileNot(p.Args[0], env)
+		case ProcedureIndicator{Name: "call", Arity: 1}:
+			if err := c.compileCall(p.Args[0], env); err != errNotCallable {
+				return err
+			}
+		}
 		for _, a := range p.Args {
 			if err := c.compileArg(a, env); err != nil {
 				return err
@@ -236,6 +214,117 @@ func (c *clause) compilePred(p term.Interface, env *term.Env) error {
 	}
 }
 
+// compileDisj compiles (Left ; Right) into:
+//
+//	disj L1
+//	<Left>
+//	jump L2
+//	L1: <Right>
+//	L2:
+func (c *clause) compileDisj(left, right term.Interface, env *term.Env) error {
+	disj := c.emitJump(opDisj)
+	if err := c.compilePred(left, env); err != nil {
+		return err
+	}
+	jump := c.emitJump(opJump)
+	c.patchJump(disj)
+	if err := c.compilePred(right, env); err != nil {
+		return err
+	}
+	c.patchJump(jump)
+	return nil
+}
+
+// compileIf compiles (Cond -> Then ; Else) and (Cond *-> Then ; Else) into:
+//
+//	if L1 (or soft_if L1)
+//	<Cond>
+//	then (or leave)
+//	<Then>
+//	jump L2
+//	L1: <Else>
+//	L2:
+//
+// If els is nil, the else branch fails.
+func (c *clause) compileIf(op opcode, cond, then, els term.Interface, env *term.Env) error {
+	if_ := c.emitJump(op)
+	if err := c.compilePred(cond, env); err != nil {
+		return err
+	}
+	switch op {
+	case opIf:
+		c.bytecode = append(c.bytecode, instruction{opcode: opThen})
+	case opSoftIf:
+		c.bytecode = append(c.bytecode, instruction{opcode: opLeave})
+	}
+	if err := c.compilePred(then, env); err != nil {
+		return err
+	}
+	jump := c.emitJump(opJump)
+	c.patchJump(if_)
+	if els == nil {
+		c.bytecode = append(c.bytecode, instruction{opcode: opFail})
+	} else if err := c.compilePred(els, env); err != nil {
+		return err
+	}
+	c.patchJump(jump)
+	return nil
+}
+
+// compileNot compiles \+Goal into:
+//
+//	if L1
+//	<Goal>
+//	then
+//	fail
+//	L1:
+func (c *clause) compileNot(goal term.Interface, env *term.Env) error {
+	if_ := c.emitJump(opIf)
+	if err := c.compilePred(goal, env); err != nil {
+		return err
+	}
+	c.bytecode = append(c.bytecode, instruction{opcode: opThen}, instruction{opcode: opFail})
+	c.patchJump(if_)
+	return nil
+}
+
+// compileCall compiles call(Goal) for a callable Goal into:
+//
+//	barrier
+//	<Goal>
+//	leave
+//
+// If Goal is not callable at compile time, it leaves the bytecode intact and returns errNotCallable so that the
+// error is raised at runtime by call/1.
+func (c *clause) compileCall(goal term.Interface, env *term.Env) error {
+	switch env.Resolve(goal).(type) {
+	case term.Atom, *term.Compound:
+		break
+	default:
+		return errNotCallable
+	}
+	n := len(c.bytecode)
+	c.bytecode = append(c.bytecode, instruction{opcode: opBarrier})
+	if err := c.compilePred(goal, env); err != nil {
+		c.bytecode = c.bytecode[:n]
+		return err
+	}
+	c.bytecode = append(c.bytecode, instruction{opcode: opLeave})
+	return nil
+}
+
+// emitJump appends an instruction of which operand is a relative jump offset and returns its position to be patched
+// by patchJump.
+func (c *clause) emitJump(op opcode) int {
+	c.bytecode = append(c.bytecode, instruction{opcode: op})
+	return len(c.bytecode) - 1
+}
+
+// patchJump sets the operand of the instruction at pos so that it jumps to the end of the current bytecode.
+func (c *clause) patchJump(pos int) {
+	c.bytecode[pos].operand = len(c.bytecode) - pos
+}
+
 func (c *clause) compileArg(a term.Interface, env *term.Env) error {
 	switch a := a.(type) {
 	case term.Variable:
@@ -256,32 +345,63 @@ func (c *clause) compileArg(a term.Interface, env *term.Env) error {
 	return nil
 }
 
-func (c *clause) xrOffset(o term.Interface) byte {
+func (c *clause) xrOffset(o term.Interface) int {
 	for i, r := range c.xrTable {
 		if _, ok := r.Unify(o, false, nil); ok {
-			return byte(i)
+			return i
 		}
 	}
 	c.xrTable = append(c.xrTable, o)
-	return byte(len(c.xrTable) - 1)
+	return len(c.xrTable) - 1
 }
 
-func (c *clause) varOffset(o term.Variable) byte {
+func (c *clause) varOffset(o term.Variable) int {
 	for i, v := range c.vars {
 		if v == o {
-			return byte(i)
+			return i
 		}
 	}
 	c.vars = append(c.vars, o)
-	return byte(len(c.vars) - 1)
+	return len(c.vars) - 1
 }
 
-func (c *clause) piOffset(o ProcedureIndicator) byte {
+func (c *clause) piOffset(o ProcedureIndicator) int {
 	for i, r := range c.piTable {
 		if r == o {
-			return byte(i)
+			return i
 		}
 	}
 	c.piTable = append(c.piTable, o)
-	return byte(len(c.piTable) - 1)
+	return len(c.piTable) - 1
+}
+
+// CompiledGoal is a goal compiled in advance so that it can be called many times without being compiled again.
+type CompiledGoal struct {
+	cs clauses
+}
+
+// CompileGoal compiles goal. The variables in params are replaced by the arguments on each call.
+func CompileGoal(goal term.Interface, params []term.Variable, env *term.Env) (*CompiledGoal, error) {
+	const query = term.Atom("$query")
+	args := make([]term.Interface, len(params))
+	for i, p := range params {
+		args[i] = p
+	}
+	cs, err := compile(&term.Compound{
+		Functor: ":-",
+		Args: []term.Interface{
+			query.Apply(args...),
+			goal,
+		},
+	}, env)
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledGoal{cs: cs}, nil
+}
+
+// Call calls the goal with args for the parameters. The call counts toward the resource limits as a call of a
+// procedure does.
+func (g *CompiledGoal) Call(vm *VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return vm.enter(g.cs, args, k, env)
 }
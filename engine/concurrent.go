@@ -0,0 +1,260 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+)
+
+// Concurrent runs goals in parallel with n workers and unifies the goals with their solutions. It succeeds if all the
+// goals succeed. If a goal fails or raises an exception, the other goals are canceled.
+func (vm *VM) Concurrent(n, goals, options term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	var workers int
+	switch n := env.Resolve(n).(type) {
+	case term.Variable:
+		return nondet.Error(instantiationError(n))
+	case term.Integer:
+		if n <= 0 {
+			return nondet.Error(domainErrorPositiveInteger(n))
+		}
+		workers = int(n)
+	default:
+		return nondet.Error(typeErrorInteger(n))
+	}
+
+	var gs []term.Interface
+	if err := Each(env.Resolve(goals), func(goal term.Interface) error {
+		if _, _, err := piArgs(goal, env); err != nil {
+			return err
+		}
+		gs = append(gs, goal)
+		return nil
+	}, env); err != nil {
+		return nondet.Error(err)
+	}
+
+	// There's no option for concurrent/3 for now.
+	if err := Each(env.Resolve(options), func(option term.Interface) error {
+		return domainErrorConcurrentOption(option)
+	}, env); err != nil {
+		return nondet.Error(err)
+	}
+
+	copies := make([]term.Interface, len(gs))
+	for i, g := range gs {
+		copies[i] = copyTerm(g, nil, env)
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		solutions, ok, err := vm.parallel(ctx, workers, copies)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		if !ok {
+			return nondet.Bool(false)
+		}
+		return Unify(term.List(gs...), term.List(solutions...), k, env)
+	})
+}
+
+// ConcurrentForAll runs action in parallel for each solution of cond. It succeeds if action succeeds for all the
+// solutions of cond. Bindings of action are discarded.
+func (vm *VM) ConcurrentForAll(cond, action term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		var actions []term.Interface
+		if _, err := vm.nested(cond, func(env *term.Env) *nondet.Promise {
+			actions = append(actions, copyTerm(action, nil, env))
+			return nondet.Bool(false) // ask for more solutions
+		}, env).Force(ctx); err != nil {
+			return nondet.Error(err)
+		}
+
+		for _, a := range actions {
+			if _, _, err := piArgs(a, nil); err != nil {
+				return nondet.Error(err)
+			}
+		}
+
+		_, ok, err := vm.parallel(ctx, runtime.NumCPU(), actions)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		if !ok {
+			return nondet.Bool(false)
+		}
+		return k(env)
+	})
+}
+
+// FirstSolution runs goals in parallel and unifies x with the instance of x of the first solution. The other goals
+// are canceled as soon as one of them succeeds. Even with on_error(continue), halt/1 and cancellation stop the goals.
+func (vm *VM) FirstSolution(x, goals, options term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	var gs []term.Interface
+	if err := Each(env.Resolve(goals), func(goal term.Interface) error {
+		if _, _, err := piArgs(goal, env); err != nil {
+			return err
+		}
+		gs = append(gs, goal)
+		return nil
+	}, env); err != nil {
+		return nondet.Error(err)
+	}
+
+	stopOnFail, stopOnError := true, true
+	if err := Each(env.Resolve(options), func(option term.Interface) error {
+		o, ok := env.Resolve(option).(*term.Compound)
+		if !ok || len(o.Args) != 1 {
+			return domainErrorFirstSolutionOption(option)
+		}
+		var stop *bool
+		switch o.Functor {
+		case "on_fail":
+			stop = &stopOnFail
+		case "on_error":
+			stop = &stopOnError
+		default:
+			return domainErrorFirstSolutionOption(option)
+		}
+		switch env.Resolve(o.Args[0]) {
+		case term.Atom("stop"):
+			*stop = true
+		case term.Atom("continue"):
+			*stop = false
+		default:
+			return domainErrorFirstSolutionOption(option)
+		}
+		return nil
+	}, env); err != nil {
+		return nondet.Error(err)
+	}
+
+	type result struct {
+		x   term.Interface
+		ok  bool
+		err error
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		// The other goals are canceled and then finish, including their cleanups, before first_solution/3 continues.
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		results := make(chan result, len(gs))
+		for _, g := range gs {
+			// Each goal has its own copy of x.
+			c := copyTerm(&term.Compound{Functor: "-", Args: []term.Interface{x, g}}, nil, env).(*term.Compound)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, exit := WithThread(afresh(ctx))
+				defer exit()
+				var r result
+				r.ok, r.err = vm.Call(c.Args[1], func(env *term.Env) *nondet.Promise {
+					r.x = env.Simplify(c.Args[0])
+					return nondet.Bool(true)
+				}, nil).Force(ctx)
+				results <- r
+			}()
+		}
+
+		for range gs {
+			r := <-results
+			switch {
+			case r.err != nil:
+				if stopOnError || !recoverable(r.err) {
+					return nondet.Error(r.err)
+				}
+			case !r.ok:
+				if stopOnFail {
+					return nondet.Bool(false)
+				}
+			default:
+				// We unify x after the other goals finish.
+				return nondet.Delay(func(context.Context) *nondet.Promise {
+					return Unify(x, r.x, k, env)
+				})
+			}
+		}
+		return nondet.Bool(false)
+	})
+}
+
+// recoverable checks if first_solution/3 with on_error(continue) can go on after err. It can't after halt/1 or
+// cancellation.
+func recoverable(err error) bool {
+	var (
+		h *HaltError
+		c *nondet.CanceledError
+	)
+	return !errors.As(err, &h) && !errors.As(err, &c)
+}
+
+// parallel runs goals with n workers and returns the solution of each goal. As soon as a goal fails or raises an
+// exception, the other goals are canceled.
+func (vm *VM) parallel(parent context.Context, n int, goals []term.Interface) ([]term.Interface, bool, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var (
+		mu  sync.Mutex
+		ok  = true
+		err error
+	)
+	stop := func(e error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ok && err == nil {
+			ok, err = false, e
+		}
+		cancel()
+	}
+
+	var (
+		wg        sync.WaitGroup
+		indices   = make(chan int)
+		solutions = make([]term.Interface, len(goals))
+	)
+	if n > len(goals) {
+		n = len(goals)
+	}
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, exit := WithThread(afresh(ctx))
+			defer exit()
+			for i := range indices {
+				g := goals[i]
+				found, err := vm.Call(g, func(env *term.Env) *nondet.Promise {
+					solutions[i] = env.Simplify(g)
+					return nondet.Bool(true)
+				}, nil).Force(ctx)
+				if err != nil || !found {
+					stop(err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range goals {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	if ok && err == nil && parent.Err() != nil {
+		return nil, false, &nondet.CanceledError{Err: parent.Err()}
+	}
+	return solutions, ok, err
+}
@@ -0,0 +1,277 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVM_Concurrent(t *testing.T) {
+	var vm VM
+	vm.Register2("double", func(x, y term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		n, ok := env.Resolve(x).(term.Integer)
+		if !ok {
+			return nondet.Error(typeErrorInteger(x))
+		}
+		return nondet.Delay(func(context.Context) *nondet.Promise {
+			return Unify(y, 2*n, k, env)
+		}, func(context.Context) *nondet.Promise {
+			return Unify(y, 3*n, k, env)
+		})
+	})
+	vm.Register0("block", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+			<-ctx.Done()
+			return nondet.Bool(false)
+		})
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		ok, err := vm.Concurrent(term.Integer(2), term.List(
+			&term.Compound{Functor: "double", Args: []term.Interface{term.Integer(1), term.Variable("X")}},
+			&term.Compound{Functor: "double", Args: []term.Interface{term.Integer(2), term.Variable("Y")}},
+			&term.Compound{Functor: "double", Args: []term.Interface{term.Integer(3), term.Variable("Z")}},
+		), term.List(), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Integer(2), env.Resolve(term.Variable("X")))
+			assert.Equal(t, term.Integer(4), env.Resolve(term.Variable("Y")))
+			assert.Equal(t, term.Integer(6), env.Resolve(term.Variable("Z")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("failure cancels the others", func(t *testing.T) {
+		ok, err := vm.Concurrent(term.Integer(2), term.List(
+			term.Atom("block"),
+			&term.Compound{Functor: "double", Args: []term.Interface{term.Integer(1), term.Integer(5)}},
+		), term.List(), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("exception cancels the others", func(t *testing.T) {
+		ok, err := vm.Concurrent(term.Integer(2), term.List(
+			term.Atom("block"),
+			&term.Compound{Functor: "double", Args: []term.Interface{term.Atom("a"), term.Variable("X")}},
+		), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, typeErrorInteger(term.Atom("a")), err)
+		assert.False(t, ok)
+	})
+
+	t.Run("bindings conflict", func(t *testing.T) {
+		ok, err := vm.Concurrent(term.Integer(2), term.List(
+			&term.Compound{Functor: "double", Args: []term.Interface{term.Integer(1), term.Variable("X")}},
+			&term.Compound{Functor: "double", Args: []term.Interface{term.Integer(2), term.Variable("X")}},
+		), term.List(), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("n is a variable", func(t *testing.T) {
+		_, err := vm.Concurrent(term.Variable("N"), term.List(), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, instantiationError(term.Variable("N")), err)
+	})
+
+	t.Run("n is not an integer", func(t *testing.T) {
+		_, err := vm.Concurrent(term.Atom("foo"), term.List(), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, typeErrorInteger(term.Atom("foo")), err)
+	})
+
+	t.Run("n is not positive", func(t *testing.T) {
+		_, err := vm.Concurrent(term.Integer(0), term.List(), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, domainErrorPositiveInteger(term.Integer(0)), err)
+	})
+
+	t.Run("goal is not callable", func(t *testing.T) {
+		_, err := vm.Concurrent(term.Integer(1), term.List(term.Integer(0)), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, typeErrorCallable(term.Integer(0)), err)
+	})
+
+	t.Run("unknown option", func(t *testing.T) {
+		_, err := vm.Concurrent(term.Integer(1), term.List(), term.List(term.Atom("foo")), Success, nil).Force(context.Background())
+		assert.Equal(t, domainErrorConcurrentOption(term.Atom("foo")), err)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := vm.Concurrent(term.Integer(1), term.List(term.Atom("block")), term.List(), Success, nil).Force(ctx)
+		assert.True(t, errors.Is(err, context.Canceled))
+	})
+}
+
+func TestVM_ConcurrentForAll(t *testing.T) {
+	var (
+		vm   VM
+		mu   sync.Mutex
+		seen []term.Interface
+	)
+	vm.Register1("num", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return nondet.Delay(func(context.Context) *nondet.Promise {
+			return Unify(x, term.Integer(1), k, env)
+		}, func(context.Context) *nondet.Promise {
+			return Unify(x, term.Integer(2), k, env)
+		}, func(context.Context) *nondet.Promise {
+			return Unify(x, term.Integer(3), k, env)
+		})
+	})
+	vm.Register2("less_than", func(x, y term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		mu.Lock()
+		seen = append(seen, env.Resolve(x))
+		mu.Unlock()
+		if env.Resolve(x).(term.Integer) >= env.Resolve(y).(term.Integer) {
+			return nondet.Bool(false)
+		}
+		return k(env)
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		seen = nil
+		ok, err := vm.ConcurrentForAll(&term.Compound{Functor: "num", Args: []term.Interface{term.Variable("X")}}, &term.Compound{Functor: "less_than", Args: []term.Interface{term.Variable("X"), term.Integer(4)}}, func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Variable("X"), env.Resolve(term.Variable("X")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.ElementsMatch(t, []term.Interface{term.Integer(1), term.Integer(2), term.Integer(3)}, seen)
+	})
+
+	t.Run("action fails", func(t *testing.T) {
+		ok, err := vm.ConcurrentForAll(&term.Compound{Functor: "num", Args: []term.Interface{term.Variable("X")}}, &term.Compound{Functor: "less_than", Args: []term.Interface{term.Variable("X"), term.Integer(3)}}, Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("action raises an exception", func(t *testing.T) {
+		ok, err := vm.ConcurrentForAll(&term.Compound{Functor: "num", Args: []term.Interface{term.Variable("X")}}, term.Atom("foo"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorProcedure(&term.Compound{
+			Functor: "/",
+			Args:    []term.Interface{term.Atom("foo"), term.Integer(0)},
+		}), err)
+		assert.False(t, ok)
+	})
+}
+
+func TestVM_FirstSolution(t *testing.T) {
+	var vm VM
+	vm.Register1("foo", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return Unify(x, term.Atom("foo"), k, env)
+	})
+	vm.Register1("block", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+			<-ctx.Done()
+			return nondet.Bool(false)
+		})
+	})
+	vm.Register1("fail", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return nondet.Bool(false)
+	})
+	vm.Register1("error", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return nondet.Error(&Exception{Term: term.Atom("oops")})
+	})
+	vm.Register1("halt", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return Halt(term.Integer(1), k, env)
+	})
+
+	goal := func(name term.Atom) term.Interface {
+		return &term.Compound{Functor: name, Args: []term.Interface{term.Variable("X")}}
+	}
+
+	t.Run("first solution cancels the others", func(t *testing.T) {
+		ok, err := vm.FirstSolution(term.Variable("X"), term.List(goal("block"), goal("foo")), term.List(), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Atom("foo"), env.Resolve(term.Variable("X")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("on_fail", func(t *testing.T) {
+		t.Run("stop", func(t *testing.T) {
+			ok, err := vm.FirstSolution(term.Variable("X"), term.List(goal("block"), goal("fail")), term.List(), Success, nil).Force(context.Background())
+			assert.NoError(t, err)
+			assert.False(t, ok)
+		})
+
+		t.Run("continue", func(t *testing.T) {
+			ok, err := vm.FirstSolution(term.Variable("X"), term.List(goal("fail"), goal("foo")), term.List(&term.Compound{
+				Functor: "on_fail",
+				Args:    []term.Interface{term.Atom("continue")},
+			}), Success, nil).Force(context.Background())
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		})
+	})
+
+	t.Run("on_error", func(t *testing.T) {
+		t.Run("stop", func(t *testing.T) {
+			_, err := vm.FirstSolution(term.Variable("X"), term.List(goal("block"), goal("error")), term.List(), Success, nil).Force(context.Background())
+			assert.Equal(t, &Exception{Term: term.Atom("oops")}, err)
+		})
+
+		t.Run("continue", func(t *testing.T) {
+			ok, err := vm.FirstSolution(term.Variable("X"), term.List(goal("error"), goal("fail")), term.List(
+				&term.Compound{Functor: "on_error", Args: []term.Interface{term.Atom("continue")}},
+				&term.Compound{Functor: "on_fail", Args: []term.Interface{term.Atom("continue")}},
+			), Success, nil).Force(context.Background())
+			assert.NoError(t, err)
+			assert.False(t, ok)
+		})
+
+		t.Run("halt", func(t *testing.T) {
+			_, err := vm.FirstSolution(term.Variable("X"), term.List(goal("halt"), goal("block")), term.List(
+				&term.Compound{Functor: "on_error", Args: []term.Interface{term.Atom("continue")}},
+			), Success, nil).Force(context.Background())
+			assert.Equal(t, &HaltError{Code: 1}, err)
+		})
+
+		t.Run("canceled", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := vm.FirstSolution(term.Variable("X"), term.List(goal("block"), goal("block")), term.List(
+				&term.Compound{Functor: "on_error", Args: []term.Interface{term.Atom("continue")}},
+			), Success, nil).Force(ctx)
+			assert.True(t, errors.Is(err, context.Canceled))
+		})
+	})
+
+	t.Run("wait for the others", func(t *testing.T) {
+		var (
+			vm      VM
+			started = make(chan struct{})
+			done    int32
+		)
+		vm.Register1("foo", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			<-started
+			return Unify(x, term.Atom("foo"), k, env)
+		})
+		vm.Register1("slow", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+				close(started)
+				<-ctx.Done()
+				time.Sleep(10 * time.Millisecond)
+				atomic.StoreInt32(&done, 1)
+				return nondet.Bool(false)
+			})
+		})
+		ok, err := vm.FirstSolution(term.Variable("X"), term.List(goal("slow"), goal("foo")), term.List(), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, int32(1), atomic.LoadInt32(&done))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("unknown option", func(t *testing.T) {
+		_, err := vm.FirstSolution(term.Variable("X"), term.List(), term.List(term.Atom("foo")), Success, nil).Force(context.Background())
+		assert.Equal(t, domainErrorFirstSolutionOption(term.Atom("foo")), err)
+	})
+}
@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+)
+
+// Continuation is a delimited continuation captured by shift/1.
+type Continuation struct {
+	k         func(*term.Env) *nondet.Promise
+	innermost *delimiter // the innermost delimiter at the time of capture.
+	target    *delimiter // the delimiter which caught the ball.
+}
+
+func (c *Continuation) String() string {
+	var buf bytes.Buffer
+	_ = c.WriteTerm(&buf, term.DefaultWriteTermOptions, nil)
+	return buf.String()
+}
+
+// WriteTerm writes the continuation into w.
+func (c *Continuation) WriteTerm(w io.Writer, _ term.WriteTermOptions, _ *term.Env) error {
+	_, err := fmt.Fprintf(w, "<continuation>(%p)", c)
+	return err
+}
+
+// Unify unifies the continuation with x.
+func (c *Continuation) Unify(x term.Interface, occursCheck bool, env *term.Env) (*term.Env, bool) {
+	switch x := env.Resolve(x).(type) {
+	case *Continuation:
+		return env, c == x
+	case term.Variable:
+		return x.Unify(c, occursCheck, env)
+	default:
+		return env, false
+	}
+}
+
+// delimiter is either a call of reset/3, an invocation of a continuation, or a nested search. An invocation of a
+// continuation has no ball so that shift/1 passes through it. A nested search stops shift/1 since its answers don't
+// return to the enclosing search.
+type delimiter struct {
+	nested  bool
+	ball    term.Interface
+	resume  func(term.Interface, *term.Env) *nondet.Promise // continues after reset/3 with the continuation.
+	exit    func(*term.Env) *nondet.Promise                 // continues after the goal succeeds.
+	outer   *delimiter
+	barrier *nondet.Promise
+}
+
+// delimitationKey is the key of the context for the delimitation. It's carried in the context of the promises which
+// follow from reset/3 or call_continuation/1, not in the environment, so that Prolog can't see it.
+type delimitationKey struct{}
+
+// delimitation is the innermost delimiter and the cut barrier of the execution.
+type delimitation struct {
+	innermost *delimiter
+	barrier   *nondet.Promise // a cut in an invoked continuation stops here.
+}
+
+func currentDelimitation(ctx context.Context) delimitation {
+	d, _ := ctx.Value(delimitationKey{}).(delimitation)
+	return d
+}
+
+// delimit continues with k within the delimitation.
+func delimit(d delimitation, k func(context.Context) *nondet.Promise) *nondet.Promise {
+	return nondet.WithValue(delimitationKey{}, d, k)
+}
+
+// leave continues with k outside of d, restoring the outer delimiter and cut barrier.
+func (d *delimiter) leave(k func() *nondet.Promise) *nondet.Promise {
+	return delimit(delimitation{innermost: d.outer, barrier: d.barrier}, func(context.Context) *nondet.Promise {
+		return k()
+	})
+}
+
+// currentCutBarrier returns the cut barrier if the execution is in an invoked continuation. Otherwise, nil.
+func currentCutBarrier(ctx context.Context) *nondet.Promise {
+	return currentDelimitation(ctx).barrier
+}
+
+// Reset calls goal. If goal calls shift/1 with a ball which unifies with ball, the rest of goal is captured as
+// call_continuation/1 and unified with cont. Otherwise, cont is unified with 0 when goal succeeds.
+//
+// The continuation can't be captured across a nested search, i.e. catch/3, findall/3, bagof/3, setof/3,
+// setup_call_cleanup/3, call_with_time_limit/2, call_with_inference_limit/3, with_mutex/2, or concurrent_forall/2,
+// since the answers of the nested search don't return to reset/3. shift/1 across one of them raises
+// permission_error(capture, continuation, Ball). Put catch/3 around reset/3 instead of inside it.
+func (vm *VM) Reset(goal, ball, cont term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		c := currentDelimitation(ctx)
+		d := delimiter{
+			ball: ball,
+			resume: func(c term.Interface, env *term.Env) *nondet.Promise {
+				return Unify(cont, c, k, env)
+			},
+			exit: func(env *term.Env) *nondet.Promise {
+				return Unify(cont, term.Integer(0), k, env)
+			},
+			outer:   c.innermost,
+			barrier: c.barrier,
+		}
+		return delimit(delimitation{innermost: &d, barrier: c.barrier}, func(context.Context) *nondet.Promise {
+			return vm.Call(goal, func(env *term.Env) *nondet.Promise {
+				// In an invoked continuation, the innermost delimiter is the one which replaces d.
+				return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+					d := currentDelimitation(ctx).innermost
+					return d.leave(func() *nondet.Promise {
+						return d.exit(env)
+					})
+				})
+			}, env)
+		})
+	})
+}
+
+// Shift captures the continuation up to the innermost reset/3 of which ball unifies with ball and continues after
+// the reset/3. The continuation can't be captured across a nested search such as catch/3 or findall/3.
+func (vm *VM) Shift(ball term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		innermost := currentDelimitation(ctx).innermost
+		for d := innermost; d != nil; d = d.outer {
+			if d.nested {
+				return nondet.Error(permissionErrorCaptureContinuation(ball))
+			}
+			if d.ball == nil {
+				continue
+			}
+			env, ok := ball.Unify(d.ball, false, env)
+			if !ok {
+				continue
+			}
+			c := Continuation{k: k, innermost: innermost, target: d}
+			d := d
+			return d.leave(func() *nondet.Promise {
+				return d.resume(&term.Compound{
+					Functor: "call_continuation",
+					Args:    []term.Interface{&c},
+				}, env)
+			})
+		}
+		return nondet.Error(existenceErrorReset(ball))
+	})
+}
+
+// ShiftForCopy is the same as Shift. Continuations are opaque and shared rather than copied.
+func (vm *VM) ShiftForCopy(ball term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return vm.Shift(ball, k, env)
+}
+
+// CallContinuation calls the continuation captured by shift/1. A cut in the continuation is local to the
+// continuation.
+func (vm *VM) CallContinuation(cont term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	var c *Continuation
+	switch cont := env.Resolve(cont).(type) {
+	case term.Variable:
+		return nondet.Error(instantiationError(cont))
+	case *Continuation:
+		c = cont
+	default:
+		return nondet.Error(typeErrorContinuation(cont))
+	}
+
+	var b *nondet.Promise
+	b = nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		outer := currentDelimitation(ctx)
+
+		// The delimiters captured inside the continuation now belong to this invocation. The target is replaced by
+		// the one which continues after this invocation.
+		var ds []delimiter
+		for d := c.innermost; d != c.target; d = d.outer {
+			ds = append(ds, *d)
+		}
+		innermost := &delimiter{
+			exit:    k,
+			outer:   outer.innermost,
+			barrier: outer.barrier,
+		}
+		for i := len(ds) - 1; i >= 0; i-- {
+			d := ds[i]
+			d.outer, d.barrier = innermost, b
+			innermost = &d
+		}
+
+		return delimit(delimitation{innermost: innermost, barrier: b}, func(context.Context) *nondet.Promise {
+			return c.k(env)
+		})
+	})
+	return b
+}
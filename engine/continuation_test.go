@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVM_Reset(t *testing.T) {
+	var vm VM
+	vm.Register1("shift", vm.Shift)
+	vm.Register3("reset", vm.Reset)
+	vm.Register1("call_continuation", vm.CallContinuation)
+	vm.Register1("ok", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return Unify(x, term.Atom("ok"), k, env)
+	})
+
+	t.Run("no shift", func(t *testing.T) {
+		ok, err := vm.Reset(&term.Compound{Functor: "ok", Args: []term.Interface{term.Variable("X")}}, term.Variable("B"), term.Variable("C"), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Atom("ok"), env.Resolve(term.Variable("X")))
+			assert.Equal(t, term.Variable("B"), env.Resolve(term.Variable("B")))
+			assert.Equal(t, term.Integer(0), env.Resolve(term.Variable("C")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("shift", func(t *testing.T) {
+		var c term.Interface
+		ok, err := vm.Reset(&term.Compound{
+			Functor: ",",
+			Args: []term.Interface{
+				&term.Compound{Functor: "shift", Args: []term.Interface{term.Atom("a")}},
+				&term.Compound{Functor: "ok", Args: []term.Interface{term.Variable("X")}},
+			},
+		}, term.Variable("B"), term.Variable("C"), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Variable("X"), env.Resolve(term.Variable("X")))
+			assert.Equal(t, term.Atom("a"), env.Resolve(term.Variable("B")))
+			c = env.Resolve(term.Variable("C"))
+			return vm.Call(c, func(env *term.Env) *nondet.Promise {
+				assert.Equal(t, term.Atom("ok"), env.Resolve(term.Variable("X")))
+				return nondet.Bool(true)
+			}, env)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		cc, ok := c.(*term.Compound)
+		assert.True(t, ok)
+		assert.Equal(t, term.Atom("call_continuation"), cc.Functor)
+		assert.IsType(t, &Continuation{}, cc.Args[0])
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		// The inner reset/3 doesn't catch the ball so that it goes to the outer one.
+		ok, err := vm.Reset(&term.Compound{
+			Functor: "reset",
+			Args: []term.Interface{
+				&term.Compound{Functor: "shift", Args: []term.Interface{term.Atom("outer")}},
+				term.Atom("inner"),
+				term.Variable("C1"),
+			},
+		}, term.Atom("outer"), term.Variable("C2"), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Variable("C1"), env.Resolve(term.Variable("C1")))
+			return vm.Call(env.Resolve(term.Variable("C2")), func(env *term.Env) *nondet.Promise {
+				assert.Equal(t, term.Integer(0), env.Resolve(term.Variable("C1")))
+				return nondet.Bool(true)
+			}, env)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+}
+
+func TestVM_Shift(t *testing.T) {
+	t.Run("no reset", func(t *testing.T) {
+		var vm VM
+		_, err := vm.Shift(term.Atom("a"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorReset(term.Atom("a")), err)
+	})
+
+	t.Run("no matching reset", func(t *testing.T) {
+		var vm VM
+		vm.Register1("shift", vm.Shift)
+		_, err := vm.Reset(&term.Compound{Functor: "shift", Args: []term.Interface{term.Atom("a")}}, term.Atom("b"), term.Variable("C"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorReset(term.Atom("a")), err)
+	})
+
+	t.Run("reset outside of the engine", func(t *testing.T) {
+		var vm VM
+		vm.Register1("shift", vm.Shift)
+		vm.Register2("engine_next", vm.EngineNext)
+		ok, err := vm.EngineCreate(term.Atom("x"), &term.Compound{Functor: "shift", Args: []term.Interface{term.Atom("a")}}, term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+			return vm.Reset(&term.Compound{
+				Functor: "engine_next",
+				Args:    []term.Interface{env.Resolve(term.Variable("E")), term.Variable("X")},
+			}, term.Atom("a"), term.Variable("C"), Success, env)
+		}, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorReset(term.Atom("a")), err)
+		assert.False(t, ok)
+	})
+}
+
+func TestVM_CallContinuation(t *testing.T) {
+	var vm VM
+
+	t.Run("cont is a variable", func(t *testing.T) {
+		_, err := vm.CallContinuation(term.Variable("C"), Success, nil).Force(context.Background())
+		assert.Equal(t, instantiationError(term.Variable("C")), err)
+	})
+
+	t.Run("cont is not a continuation", func(t *testing.T) {
+		_, err := vm.CallContinuation(term.Atom("foo"), Success, nil).Force(context.Background())
+		assert.Equal(t, typeErrorContinuation(term.Atom("foo")), err)
+	})
+}
@@ -0,0 +1,331 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+)
+
+type csvOptions struct {
+	functor    term.Atom
+	arity      term.Interface
+	separator  rune
+	strip      bool
+	convert    bool
+	matchArity bool
+}
+
+func parseCSVOptions(options term.Interface, env *term.Env) (*csvOptions, error) {
+	opts := csvOptions{
+		functor:    "row",
+		separator:  ',',
+		convert:    true,
+		matchArity: true,
+	}
+	if err := Each(env.Resolve(options), func(option term.Interface) error {
+		switch option := env.Resolve(option).(type) {
+		case term.Variable:
+			return instantiationError(option)
+		case *term.Compound:
+			if len(option.Args) != 1 {
+				return domainErrorCSVOption(option)
+			}
+
+			arg := env.Resolve(option.Args[0])
+			if _, ok := arg.(term.Variable); ok && option.Functor != "arity" {
+				return instantiationError(arg)
+			}
+			switch option.Functor {
+			case "functor":
+				f, ok := arg.(term.Atom)
+				if !ok {
+					return typeErrorAtom(arg)
+				}
+				opts.functor = f
+			case "arity":
+				opts.arity = arg
+			case "separator":
+				c, ok := arg.(term.Integer)
+				if !ok {
+					return typeErrorInteger(arg)
+				}
+				opts.separator = rune(c)
+			case "strip", "convert", "match_arity":
+				var b bool
+				switch arg {
+				case term.Atom("true"):
+					b = true
+				case term.Atom("false"):
+					b = false
+				default:
+					return domainErrorCSVOption(option)
+				}
+				switch option.Functor {
+				case "strip":
+					opts.strip = b
+				case "convert":
+					opts.convert = b
+				default:
+					opts.matchArity = b
+				}
+			default:
+				return domainErrorCSVOption(option)
+			}
+			return nil
+		default:
+			return domainErrorCSVOption(option)
+		}
+	}, env); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+func (o *csvOptions) reader(r io.Reader) *csv.Reader {
+	cr := csv.NewReader(r)
+	cr.Comma = o.separator
+	cr.FieldsPerRecord = -1
+	if o.matchArity {
+		cr.FieldsPerRecord = 0
+	}
+	cr.ReuseRecord = true
+	return cr
+}
+
+// row converts a record into a compound of which arguments are the fields.
+func (o *csvOptions) row(record []string) term.Interface {
+	args := make([]term.Interface, len(record))
+	for i, f := range record {
+		if o.strip {
+			f = strings.TrimSpace(f)
+		}
+		args[i] = o.field(f)
+	}
+	return o.functor.Apply(args...)
+}
+
+// field converts a field into an integer or a float if convert is on and it looks like a number. Otherwise, it's an
+// atom.
+func (o *csvOptions) field(f string) term.Interface {
+	if !o.convert {
+		return term.Atom(f)
+	}
+	if i, err := strconv.ParseInt(f, 10, 64); err == nil {
+		return term.Integer(i)
+	}
+	if strings.ContainsAny(f, "0123456789") && !strings.ContainsAny(f, "xXpP_") {
+		if x, err := strconv.ParseFloat(f, 64); err == nil && !math.IsInf(x, 0) && !math.IsNaN(x) {
+			return term.Float(x)
+		}
+	}
+	return term.Atom(f)
+}
+
+// CSVReadFile reads a CSV file and unifies rows with the list of the records. Each record is a compound row(Field, ...)
+// of which arguments are integers, floats, or atoms. The list is subject to Limits.TermSize. The options are:
+//
+//	functor(F): the functor of the records instead of row
+//	arity(A): unifies A with the number of the fields
+//	separator(C): the code of the separator, e.g. 0'\t for TSV, instead of 0',
+//	strip(B): if true, removes the leading and trailing white spaces of the fields
+//	convert(B): if false, the fields are always atoms
+//	match_arity(B): if false, the records may have different numbers of fields
+func (vm *VM) CSVReadFile(file, rows, options term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	opts, err := parseCSVOptions(options, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		var (
+			rs    []term.Interface
+			size  int
+			max   = termSizeLimit(ctx)
+			arity = -1
+		)
+		if err := vm.csvRecords(ctx, file, opts, env, func(record []string) error {
+			// The list cell, the record, and its fields.
+			if size += 2 + len(record); max > 0 && size > max {
+				return resourceErrorTermSize()
+			}
+			if arity < 0 {
+				arity = len(record)
+			}
+			rs = append(rs, opts.row(record))
+			return nil
+		}); err != nil {
+			return nondet.Error(err)
+		}
+
+		if opts.arity != nil && arity >= 0 {
+			var ok bool
+			env, ok = opts.arity.Unify(term.Integer(arity), false, env)
+			if !ok {
+				return nondet.Bool(false)
+			}
+		}
+		return Unify(rows, term.List(rs...), k, env)
+	})
+}
+
+// csvBatch is the number of the records CSVLoadFile adds to the database at once. The context is checked for each
+// batch.
+const csvBatch = 1024
+
+// CSVLoadFile reads a CSV file and appends the records to the database as facts row(Field, ...) without building a
+// list of them. If the procedure is a DynamicProcedure, e.g. Facts with a MutableFactStore, the facts are asserted to
+// it. It takes the same options as CSVReadFile.
+func (vm *VM) CSVLoadFile(file, options term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	opts, err := parseCSVOptions(options, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		var (
+			pi    ProcedureIndicator
+			facts [][]term.Interface
+		)
+		flush := func() error {
+			if len(facts) == 0 {
+				return nil
+			}
+			err := vm.AppendFacts(pi, facts)
+			facts = facts[:0]
+			return err
+		}
+		arity := -1
+		if err := vm.csvRecords(ctx, file, opts, env, func(record []string) error {
+			if arity < 0 {
+				arity = len(record)
+			}
+			// The records of different arities go to different procedures.
+			if p := (ProcedureIndicator{Name: opts.functor, Arity: term.Integer(len(record))}); p != pi || len(facts) == csvBatch {
+				if err := flush(); err != nil {
+					return err
+				}
+				pi = p
+			}
+			facts = append(facts, opts.row(record).(*term.Compound).Args)
+			return nil
+		}); err != nil {
+			return nondet.Error(err)
+		}
+		if err := flush(); err != nil {
+			return nondet.Error(err)
+		}
+
+		if opts.arity != nil && arity >= 0 {
+			return Unify(opts.arity, term.Integer(arity), k, env)
+		}
+		return k(env)
+	})
+}
+
+// csvRecords reads a CSV file and calls f for each record. It stops if ctx is done.
+func (vm *VM) csvRecords(ctx context.Context, file term.Interface, opts *csvOptions, env *term.Env, f func(record []string) error) error {
+	var name term.Atom
+	switch file := env.Resolve(file).(type) {
+	case term.Variable:
+		return instantiationError(file)
+	case term.Atom:
+		name = file
+	default:
+		return domainErrorSourceSink(file)
+	}
+
+	fd, err := vm.fileSystem().OpenFile(string(name), os.O_RDONLY, 0)
+	if err != nil {
+		return openError(file, err)
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+
+	r := opts.reader(bufio.NewReader(fd))
+	for n := 1; ; n++ {
+		if n%csvBatch == 0 {
+			if err := ctx.Err(); err != nil {
+				return &nondet.CanceledError{Err: err}
+			}
+		}
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return csvError(err)
+		}
+		if err := f(record); err != nil {
+			return err
+		}
+	}
+}
+
+// CSVReadRow reads a record from a CSV stream and unifies it with row. At the end of the stream, row is unified with
+// end_of_file. It takes the same options as CSVReadFile except match_arity.
+func (vm *VM) CSVReadRow(streamOrAlias, row, options term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	s, err := vm.stream(streamOrAlias, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	if s.Source == nil {
+		return nondet.Error(permissionErrorInputStream(streamOrAlias))
+	}
+
+	if s.StreamType == term.StreamTypeBinary {
+		return nondet.Error(permissionErrorInputBinaryStream(streamOrAlias))
+	}
+
+	// csv.Reader uses br as it is instead of wrapping it with another buffer. Since it reads line by line, the rest of
+	// the stream stays intact.
+	br, ok := s.Source.(*bufio.Reader)
+	if !ok {
+		return nondet.Error(permissionErrorInputBufferedStream(streamOrAlias))
+	}
+
+	opts, err := parseCSVOptions(options, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+	opts.matchArity = false
+
+	return nondet.Delay(func(context.Context) *nondet.Promise {
+		record, err := opts.reader(br).Read()
+		if err == io.EOF {
+			return Unify(row, term.Atom("end_of_file"), k, env)
+		}
+		if err != nil {
+			return nondet.Error(csvError(err))
+		}
+
+		env := env
+		if opts.arity != nil {
+			var ok bool
+			env, ok = opts.arity.Unify(term.Integer(len(record)), false, env)
+			if !ok {
+				return nondet.Bool(false)
+			}
+		}
+		return Unify(row, opts.row(record), k, env)
+	})
+}
+
+// csvError converts an error from csv.Reader into an exception.
+func csvError(err error) error {
+	var e *csv.ParseError
+	if errors.As(err, &e) {
+		return syntaxError(term.Atom("csv"), term.Atom(e.Error()))
+	}
+	return systemError(err)
+}
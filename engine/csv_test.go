@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVM_CSVReadFile(t *testing.T) {
+	vm := VM{FS: ReadOnlyFileSystem{FS: fstest.MapFS{
+		"users.csv":  &fstest.MapFile{Data: []byte("alice,30,1.5\n\"bob, jr.\",40,2e3\n")},
+		"users.tsv":  &fstest.MapFile{Data: []byte("alice\t 30 \n")},
+		"ragged.csv": &fstest.MapFile{Data: []byte("a,b\nc\n")},
+		"broken.csv": &fstest.MapFile{Data: []byte("\"a\n")},
+	}}}
+
+	call := func(file string, options ...term.Interface) (term.Interface, error) {
+		var rows term.Interface
+		_, err := vm.CSVReadFile(term.Atom(file), term.Variable("Rows"), term.List(options...), func(env *term.Env) *nondet.Promise {
+			rows = env.Simplify(term.Variable("Rows"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		return rows, err
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		rows, err := call("users.csv")
+		assert.NoError(t, err)
+		assert.Equal(t, term.List(
+			&term.Compound{Functor: "row", Args: []term.Interface{term.Atom("alice"), term.Integer(30), term.Float(1.5)}},
+			&term.Compound{Functor: "row", Args: []term.Interface{term.Atom("bob, jr."), term.Integer(40), term.Float(2000)}},
+		), rows)
+	})
+
+	t.Run("options", func(t *testing.T) {
+		rows, err := call("users.tsv",
+			&term.Compound{Functor: "functor", Args: []term.Interface{term.Atom("user")}},
+			&term.Compound{Functor: "separator", Args: []term.Interface{term.Integer('\t')}},
+			&term.Compound{Functor: "strip", Args: []term.Interface{term.Atom("true")}},
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, term.List(
+			&term.Compound{Functor: "user", Args: []term.Interface{term.Atom("alice"), term.Integer(30)}},
+		), rows)
+
+		rows, err = call("users.tsv",
+			&term.Compound{Functor: "separator", Args: []term.Interface{term.Integer('\t')}},
+			&term.Compound{Functor: "convert", Args: []term.Interface{term.Atom("false")}},
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, term.List(
+			&term.Compound{Functor: "row", Args: []term.Interface{term.Atom("alice"), term.Atom(" 30 ")}},
+		), rows)
+	})
+
+	t.Run("arity", func(t *testing.T) {
+		ok, err := vm.CSVReadFile(term.Atom("users.csv"), term.Variable("Rows"), term.List(
+			&term.Compound{Functor: "arity", Args: []term.Interface{term.Variable("A")}},
+		), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Integer(3), env.Resolve(term.Variable("A")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("match arity", func(t *testing.T) {
+		_, err := call("ragged.csv")
+		assert.Error(t, err)
+
+		rows, err := call("ragged.csv", &term.Compound{Functor: "match_arity", Args: []term.Interface{term.Atom("false")}})
+		assert.NoError(t, err)
+		assert.Equal(t, term.List(
+			&term.Compound{Functor: "row", Args: []term.Interface{term.Atom("a"), term.Atom("b")}},
+			&term.Compound{Functor: "row", Args: []term.Interface{term.Atom("c")}},
+		), rows)
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		_, err := call("broken.csv")
+		e, ok := err.(*Exception)
+		assert.True(t, ok)
+		assert.Equal(t, &term.Compound{Functor: "syntax_error", Args: []term.Interface{term.Atom("csv")}}, e.Term.(*term.Compound).Args[0])
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := call("foo.csv")
+		assert.Equal(t, existenceErrorSourceSink(term.Atom("foo.csv")), err)
+	})
+
+	t.Run("unknown option", func(t *testing.T) {
+		foo := &term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("bar")}}
+		_, err := call("users.csv", foo)
+		assert.Equal(t, domainErrorCSVOption(foo), err)
+	})
+
+	t.Run("term size", func(t *testing.T) {
+		_, err := vm.CSVReadFile(term.Atom("users.csv"), term.Variable("Rows"), term.List(), Success, nil).Force(vm.Limit(WithLimits(context.Background(), Limits{TermSize: 8})))
+		assert.Equal(t, resourceErrorTermSize(), err)
+	})
+}
+
+func TestVM_CSVLoadFile(t *testing.T) {
+	fsys := ReadOnlyFileSystem{FS: fstest.MapFS{
+		"users.csv":  &fstest.MapFile{Data: []byte("alice,30\nbob,40\n")},
+		"ragged.csv": &fstest.MapFile{Data: []byte("a,b\nc\nd,e\n")},
+		"broken.csv": &fstest.MapFile{Data: []byte("\"a\n")},
+	}}
+	user := func(name term.Atom, age term.Integer) []term.Interface {
+		return []term.Interface{name, age}
+	}
+
+	t.Run("clauses", func(t *testing.T) {
+		vm := VM{FS: fsys}
+		ok, err := vm.CSVLoadFile(term.Atom("users.csv"), term.List(
+			&term.Compound{Functor: "functor", Args: []term.Interface{term.Atom("user")}},
+		), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		var users []term.Interface
+		ok, err = vm.Call(&term.Compound{
+			Functor: "user",
+			Args:    []term.Interface{term.Variable("Name"), term.Variable("Age")},
+		}, func(env *term.Env) *nondet.Promise {
+			users = append(users, env.Resolve(term.Variable("Name")), env.Resolve(term.Variable("Age")))
+			return nondet.Bool(false)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, []term.Interface{term.Atom("alice"), term.Integer(30), term.Atom("bob"), term.Integer(40)}, users)
+	})
+
+	t.Run("fact store", func(t *testing.T) {
+		vm := VM{FS: fsys}
+		var s indexedStore
+		vm.RegisterProcedure(ProcedureIndicator{Name: "user", Arity: 2}, &Facts{Store: &s})
+		ok, err := vm.CSVLoadFile(term.Atom("users.csv"), term.List(
+			&term.Compound{Functor: "functor", Args: []term.Interface{term.Atom("user")}},
+		), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, [][]term.Interface{user("alice", 30), user("bob", 40)}, s.facts)
+	})
+
+	t.Run("different arities", func(t *testing.T) {
+		vm := VM{FS: fsys}
+		ok, err := vm.CSVLoadFile(term.Atom("ragged.csv"), term.List(
+			&term.Compound{Functor: "match_arity", Args: []term.Interface{term.Atom("false")}},
+		), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Len(t, vm.procedures[ProcedureIndicator{Name: "row", Arity: 2}], 2)
+		assert.Len(t, vm.procedures[ProcedureIndicator{Name: "row", Arity: 1}], 1)
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		vm := VM{FS: fsys}
+		_, err := vm.CSVLoadFile(term.Atom("broken.csv"), term.List(), Success, nil).Force(context.Background())
+		assert.Error(t, err)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		vm := VM{FS: ReadOnlyFileSystem{FS: fstest.MapFS{
+			"large.csv": &fstest.MapFile{Data: []byte(strings.Repeat("a,1\n", 4*csvBatch))},
+		}}}
+
+		p := vm.CSVLoadFile(term.Atom("large.csv"), term.List(), Success, nil)
+		assert.Empty(t, vm.procedures)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := p.Force(ctx)
+		assert.True(t, errors.Is(err, context.Canceled))
+		cs, _ := vm.procedures[ProcedureIndicator{Name: "row", Arity: 2}].(clauses)
+		assert.Less(t, len(cs), 4*csvBatch)
+	})
+}
+
+func TestVM_CSVReadRow(t *testing.T) {
+	var vm VM
+	s := term.Stream{Source: bufio.NewReader(strings.NewReader("a,1\nb,2\nnot csv.\n"))}
+
+	var rows []term.Interface
+	for i := 0; i < 3; i++ {
+		ok, err := vm.CSVReadRow(&s, term.Variable("Row"), term.List(), func(env *term.Env) *nondet.Promise {
+			rows = append(rows, env.Resolve(term.Variable("Row")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		if i == 1 {
+			// The rest of the stream is intact.
+			rest, err := s.Source.(*bufio.Reader).ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "not csv.\n", rest)
+		}
+	}
+	assert.Equal(t, []term.Interface{
+		&term.Compound{Functor: "row", Args: []term.Interface{term.Atom("a"), term.Integer(1)}},
+		&term.Compound{Functor: "row", Args: []term.Interface{term.Atom("b"), term.Integer(2)}},
+		term.Atom("end_of_file"),
+	}, rows)
+
+	t.Run("lazy", func(t *testing.T) {
+		s := term.Stream{Source: bufio.NewReader(strings.NewReader("a,1\n"))}
+		_ = vm.CSVReadRow(&s, term.Variable("Row"), term.List(), Success, nil)
+		rest, err := s.Source.(*bufio.Reader).ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "a,1\n", rest)
+	})
+
+	t.Run("not buffered", func(t *testing.T) {
+		s := term.Stream{Source: strings.NewReader("a,1\n")}
+		_, err := vm.CSVReadRow(&s, term.Variable("Row"), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, permissionErrorInputBufferedStream(&s), err)
+	})
+}
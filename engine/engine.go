@@ -0,0 +1,398 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+)
+
+// Engine is a Prolog engine which runs a goal and yields its answers on demand. The goal is resumed by the caller of
+// engine_next/2 with the caller's context so that it's limited and canceled along with the caller. The rest of the
+// search is abandoned by engine_destroy/1 or, if it's not destroyed, when the thread which created the engine ends.
+type Engine struct {
+	Alias term.Atom
+
+	vm     *VM
+	owner  *Thread       // the thread which created the engine.
+	sem    chan struct{} // held while the goal is running.
+	it     *nondet.Iterator
+	answer *term.Interface // the answer found by the last search.
+	posted chan term.Interface
+
+	mu        sync.Mutex // protects the fields below and the release of sem.
+	doomed    bool       // the engine is destroyed as soon as the goal stops running.
+	destroyed bool
+}
+
+func (e *Engine) String() string {
+	var buf bytes.Buffer
+	_ = e.WriteTerm(&buf, term.DefaultWriteTermOptions, nil)
+	return buf.String()
+}
+
+// WriteTerm writes the engine into w.
+func (e *Engine) WriteTerm(w io.Writer, _ term.WriteTermOptions, _ *term.Env) error {
+	if e.Alias != "" {
+		_, err := fmt.Fprintf(w, "<engine>(%s)", e.Alias)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "<engine>(%p)", e)
+	return err
+}
+
+// Unify unifies the engine with x.
+func (e *Engine) Unify(x term.Interface, occursCheck bool, env *term.Env) (*term.Env, bool) {
+	switch x := env.Resolve(x).(type) {
+	case *Engine:
+		return env, e == x
+	case term.Variable:
+		return x.Unify(e, occursCheck, env)
+	default:
+		return env, false
+	}
+}
+
+// id returns the alias of the engine if any. Otherwise, the engine itself.
+func (e *Engine) id() term.Interface {
+	if e.Alias != "" {
+		return e.Alias
+	}
+	return e
+}
+
+// acquire waits for the engine to be available. The engine is unavailable to the goal it's running.
+func (e *Engine) acquire(ctx context.Context) error {
+	for r, _ := ctx.Value(engineKey{}).(*engineRun); r != nil; r = r.parent {
+		if r.engine == e {
+			return permissionErrorAccessEngine(e.id())
+		}
+	}
+
+	select {
+	case e.sem <- struct{}{}:
+	case <-ctx.Done():
+		return &nondet.CanceledError{Err: ctx.Err()}
+	}
+
+	if e.isDestroyed() {
+		<-e.sem
+		return existenceErrorEngine(e.id())
+	}
+	return nil
+}
+
+// release makes the engine available again. If the engine is doomed, it's destroyed here instead.
+func (e *Engine) release() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.doomed && !e.destroyed {
+		e.it.Close()
+		e.destroyed = true
+	}
+	<-e.sem
+}
+
+func (e *Engine) isDestroyed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.destroyed
+}
+
+// next resumes the goal and returns the next answer.
+func (e *Engine) next(ctx context.Context) (term.Interface, bool, error) {
+	if err := e.acquire(ctx); err != nil {
+		return nil, false, err
+	}
+	defer e.release()
+
+	parent, _ := ctx.Value(engineKey{}).(*engineRun)
+	ok, err := e.it.Next(context.WithValue(afresh(ctx), engineKey{}, &engineRun{engine: e, parent: parent}))
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return *e.answer, true, nil
+}
+
+// close waits for the engine to be available and abandons the rest of the search.
+func (e *Engine) close(ctx context.Context) error {
+	if err := e.acquire(ctx); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.doomed = true
+	e.mu.Unlock()
+	e.release()
+	e.vm.forget(e)
+	return nil
+}
+
+// destroy abandons the rest of the search without waiting. If the goal is running, it's abandoned as soon as it
+// stops.
+func (e *Engine) destroy() {
+	e.mu.Lock()
+	e.doomed = true
+	select {
+	case e.sem <- struct{}{}:
+		e.it.Close()
+		e.destroyed = true
+		<-e.sem
+	default:
+		// The running goal releases the engine later.
+	}
+	e.mu.Unlock()
+	e.vm.forget(e)
+}
+
+type engineKey struct{}
+
+// engineRun is an engine running its goal. The engines running nested goals are chained by parent. If nested, the
+// goal is in a nested search such as catch/3 or findall/3 of which answers don't return to the engine.
+type engineRun struct {
+	engine *Engine
+	parent *engineRun
+	nested bool
+}
+
+// running returns the engine running the goal.
+func running(ctx context.Context) (*Engine, bool) {
+	r, ok := ctx.Value(engineKey{}).(*engineRun)
+	if !ok {
+		return nil, false
+	}
+	return r.engine, true
+}
+
+// EngineCreate creates a new engine which finds the instances of template by solving goal and unifies engine with it.
+func (vm *VM) EngineCreate(template, goal, engine, options term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	if _, _, err := piArgs(goal, env); err != nil {
+		return nondet.Error(err)
+	}
+
+	if _, ok := env.Resolve(engine).(term.Variable); !ok {
+		return nondet.Error(typeErrorVariable(engine))
+	}
+
+	e := Engine{
+		vm:     vm,
+		sem:    make(chan struct{}, 1),
+		answer: new(term.Interface),
+		posted: make(chan term.Interface, 1),
+	}
+	if err := Each(env.Resolve(options), func(option term.Interface) error {
+		switch o := env.Resolve(option).(type) {
+		case term.Variable:
+			return instantiationError(option)
+		case *term.Compound:
+			if o.Functor != "alias" || len(o.Args) != 1 {
+				return domainErrorEngineOption(option)
+			}
+			switch a := env.Resolve(o.Args[0]).(type) {
+			case term.Variable:
+				return instantiationError(o.Args[0])
+			case term.Atom:
+				e.Alias = a
+				return nil
+			default:
+				return typeErrorAtom(a)
+			}
+		default:
+			return domainErrorEngineOption(option)
+		}
+	}, env); err != nil {
+		return nondet.Error(err)
+	}
+
+	if e.Alias != "" {
+		vm.mu.Lock()
+		if _, ok := vm.engines[e.Alias]; ok {
+			vm.mu.Unlock()
+			return nondet.Error(permissionErrorCreateEngine(e.Alias))
+		}
+		if vm.engines == nil {
+			vm.engines = map[term.Atom]*Engine{}
+		}
+		vm.engines[e.Alias] = &e
+		vm.mu.Unlock()
+	}
+
+	c := copyTerm(&term.Compound{Functor: "-", Args: []term.Interface{template, goal}}, nil, env).(*term.Compound)
+	template, goal = c.Args[0], c.Args[1]
+
+	e.it = vm.Call(goal, func(env *term.Env) *nondet.Promise {
+		*e.answer = copyTerm(template, nil, env)
+		return nondet.Bool(true)
+	}, nil).Iterator()
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		vm.self(ctx).own(&e)
+		vm.mu.Lock()
+		if vm.alive == nil {
+			vm.alive = map[*Engine]struct{}{}
+		}
+		vm.alive[&e] = struct{}{}
+		vm.mu.Unlock()
+
+		return Unify(engine, e.id(), k, env)
+	})
+}
+
+// forget removes the destroyed engine from the VM and the thread which created it.
+func (vm *VM) forget(e *Engine) {
+	vm.mu.Lock()
+	if e.Alias != "" && vm.engines[e.Alias] == e {
+		delete(vm.engines, e.Alias)
+	}
+	delete(vm.alive, e)
+	vm.mu.Unlock()
+
+	if t := e.owner; t != nil {
+		t.mu.Lock()
+		delete(t.engines, e)
+		t.mu.Unlock()
+	}
+}
+
+// DestroyEngines destroys the engines which are not destroyed yet and runs the pending cleanups of their goals. The
+// engines running goals are destroyed as soon as the goals stop.
+func (vm *VM) DestroyEngines() {
+	vm.mu.RLock()
+	es := make([]*Engine, 0, len(vm.alive))
+	for e := range vm.alive {
+		es = append(es, e)
+	}
+	vm.mu.RUnlock()
+
+	for _, e := range es {
+		e.destroy()
+	}
+}
+
+// EngineNext asks the engine for the next answer and unifies it with t. It fails if there's no more answers. It waits
+// while the engine is running for another thread.
+func (vm *VM) EngineNext(engine, t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	e, err := vm.engine(engine, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		a, ok, err := e.next(ctx)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		if !ok {
+			return nondet.Bool(false)
+		}
+		return Unify(t, a, k, env)
+	})
+}
+
+// EnginePost posts a copy of t to the engine so that the engine can fetch it with engine_fetch/1.
+func (vm *VM) EnginePost(engine, t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	e, err := vm.engine(engine, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	select {
+	case e.posted <- copyTerm(t, nil, env):
+		return k(env)
+	default:
+		return nondet.Error(permissionErrorPostToEngine(engine))
+	}
+}
+
+// EngineFetch unifies t with the term posted to the engine running the goal.
+func (vm *VM) EngineFetch(t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		e, ok := running(ctx)
+		if !ok {
+			return nondet.Error(existenceErrorDelivery())
+		}
+
+		select {
+		case p := <-e.posted:
+			return Unify(t, p, k, env)
+		default:
+			return nondet.Error(existenceErrorDelivery())
+		}
+	})
+}
+
+// EngineYield makes the caller of engine_next/2 receive t as an answer. The engine resumes from here on the next
+// call of engine_next/2. It can't yield from a nested search such as catch/3 or findall/3.
+func (vm *VM) EngineYield(t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		r, ok := ctx.Value(engineKey{}).(*engineRun)
+		if !ok {
+			return nondet.Error(permissionErrorYieldEngine())
+		}
+		if r.nested {
+			return nondet.Error(permissionErrorYieldNestedEngine(r.engine.id()))
+		}
+		e := r.engine
+
+		// The search stops with the answer here and, on the next call of engine_next/2, backtracks into k.
+		answer := e.answer
+		return nondet.Delay(func(context.Context) *nondet.Promise {
+			*answer = copyTerm(t, nil, env)
+			return nondet.Bool(true)
+		}, func(context.Context) *nondet.Promise {
+			return k(env)
+		})
+	})
+}
+
+// EngineSelf unifies engine with the engine running the goal. It fails outside of engines.
+func (vm *VM) EngineSelf(engine term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		e, ok := running(ctx)
+		if !ok {
+			return nondet.Bool(false)
+		}
+		return Unify(engine, e.id(), k, env)
+	})
+}
+
+// EngineDestroy terminates the engine and runs the pending cleanups of its goal. An engine can't destroy itself.
+func (vm *VM) EngineDestroy(engine term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	e, err := vm.engine(engine, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		if err := e.close(ctx); err != nil {
+			return nondet.Error(err)
+		}
+		return k(env)
+	})
+}
+
+func (vm *VM) engine(engineOrAlias term.Interface, env *term.Env) (*Engine, error) {
+	switch e := env.Resolve(engineOrAlias).(type) {
+	case term.Variable:
+		return nil, instantiationError(engineOrAlias)
+	case term.Atom:
+		vm.mu.RLock()
+		v, ok := vm.engines[e]
+		vm.mu.RUnlock()
+		if !ok {
+			return nil, existenceErrorEngine(engineOrAlias)
+		}
+		return v, nil
+	case *Engine:
+		if e.isDestroyed() {
+			return nil, existenceErrorEngine(e)
+		}
+		return e, nil
+	default:
+		return nil, domainErrorEngineOrAlias(engineOrAlias)
+	}
+}
@@ -0,0 +1,434 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVM_EngineCreate(t *testing.T) {
+	var vm VM
+	vm.Register1("foo", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return nondet.Delay(func(context.Context) *nondet.Promise {
+			return Unify(x, term.Atom("a"), k, env)
+		}, func(context.Context) *nondet.Promise {
+			return Unify(x, term.Atom("b"), k, env)
+		})
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		var e term.Interface
+		ok, err := vm.EngineCreate(term.Variable("X"), &term.Compound{Functor: "foo", Args: []term.Interface{term.Variable("X")}}, term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+			e = env.Resolve(term.Variable("E"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.IsType(t, &Engine{}, e)
+
+		ok, err = vm.EngineNext(e, term.Atom("a"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = vm.EngineNext(e, term.Atom("b"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = vm.EngineNext(e, term.Variable("X"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = vm.EngineNext(e, term.Variable("X"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = vm.EngineDestroy(e, Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("alias", func(t *testing.T) {
+		alias := term.List(&term.Compound{Functor: "alias", Args: []term.Interface{term.Atom("bar")}})
+
+		ok, err := vm.EngineCreate(term.Variable("X"), &term.Compound{Functor: "foo", Args: []term.Interface{term.Variable("X")}}, term.Variable("E"), alias, func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Atom("bar"), env.Resolve(term.Variable("E")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		t.Run("already in use", func(t *testing.T) {
+			_, err := vm.EngineCreate(term.Variable("X"), term.Atom("true"), term.Variable("E"), alias, Success, nil).Force(context.Background())
+			assert.Equal(t, permissionErrorCreateEngine(term.Atom("bar")), err)
+		})
+
+		ok, err = vm.EngineNext(term.Atom("bar"), term.Atom("a"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = vm.EngineDestroy(term.Atom("bar"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		t.Run("destroyed", func(t *testing.T) {
+			_, err := vm.EngineNext(term.Atom("bar"), term.Variable("X"), Success, nil).Force(context.Background())
+			assert.Equal(t, existenceErrorEngine(term.Atom("bar")), err)
+		})
+	})
+
+	t.Run("exception", func(t *testing.T) {
+		var e term.Interface
+		_, err := vm.EngineCreate(term.Variable("X"), term.Atom("bar"), term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+			e = env.Resolve(term.Variable("E"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+
+		_, err = vm.EngineNext(e, term.Variable("X"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorProcedure(&term.Compound{
+			Functor: "/",
+			Args:    []term.Interface{term.Atom("bar"), term.Integer(0)},
+		}), err)
+
+		ok, err := vm.EngineNext(e, term.Variable("X"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("no goroutines", func(t *testing.T) {
+		n := runtime.NumGoroutine()
+		for i := 0; i < 100; i++ {
+			ok, err := vm.EngineCreate(term.Variable("X"), &term.Compound{Functor: "foo", Args: []term.Interface{term.Variable("X")}}, term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+				return vm.EngineNext(env.Resolve(term.Variable("E")), term.Atom("a"), Success, env)
+			}, nil).Force(context.Background())
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+		assert.Equal(t, n, runtime.NumGoroutine())
+	})
+
+	t.Run("goal is a variable", func(t *testing.T) {
+		_, err := vm.EngineCreate(term.Variable("X"), term.Variable("G"), term.Variable("E"), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, instantiationError(term.Variable("G")), err)
+	})
+
+	t.Run("unknown option", func(t *testing.T) {
+		_, err := vm.EngineCreate(term.Variable("X"), term.Atom("true"), term.Variable("E"), term.List(term.Atom("foo")), Success, nil).Force(context.Background())
+		assert.Equal(t, domainErrorEngineOption(term.Atom("foo")), err)
+	})
+}
+
+func TestVM_EngineNext(t *testing.T) {
+	t.Run("not an engine", func(t *testing.T) {
+		var vm VM
+		_, err := vm.EngineNext(term.Integer(0), term.Variable("X"), Success, nil).Force(context.Background())
+		assert.Equal(t, domainErrorEngineOrAlias(term.Integer(0)), err)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		var vm VM
+		vm.Register0("block", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+				<-ctx.Done()
+				return nondet.Error(&nondet.CanceledError{Err: ctx.Err()})
+			})
+		})
+
+		var e term.Interface
+		_, err := vm.EngineCreate(term.Variable("X"), term.Atom("block"), term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+			e = env.Resolve(term.Variable("E"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		ok, err := vm.EngineNext(e, term.Variable("X"), Success, nil).Force(ctx)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.False(t, ok)
+
+		ok, err = vm.EngineDestroy(e, Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	var vm VM
+	vm.Register0("next", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return vm.EngineSelf(term.Variable("Self"), func(env *term.Env) *nondet.Promise {
+			return vm.EngineNext(term.Variable("Self"), term.Variable("X"), k, env)
+		}, env)
+	})
+	vm.Register0("destroy", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return vm.EngineSelf(term.Variable("Self"), func(env *term.Env) *nondet.Promise {
+			return vm.EngineDestroy(term.Variable("Self"), k, env)
+		}, env)
+	})
+
+	for _, g := range []term.Atom{"next", "destroy"} {
+		t.Run("itself by "+string(g), func(t *testing.T) {
+			var e term.Interface
+			_, err := vm.EngineCreate(term.Atom("a"), g, term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+				e = env.Resolve(term.Variable("E"))
+				return nondet.Bool(true)
+			}, nil).Force(context.Background())
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err = vm.EngineNext(e, term.Variable("X"), Success, nil).Force(ctx)
+			assert.Equal(t, permissionErrorAccessEngine(e), err)
+		})
+	}
+
+	t.Run("running for another thread", func(t *testing.T) {
+		var vm VM
+		entered, block := make(chan struct{}), make(chan struct{})
+		vm.Register0("block", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			close(entered)
+			<-block
+			return k(env)
+		})
+
+		var e term.Interface
+		_, err := vm.EngineCreate(term.Atom("a"), term.Atom("block"), term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+			e = env.Resolve(term.Variable("E"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ok, err := vm.EngineNext(e, term.Atom("a"), Success, nil).Force(context.Background())
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}()
+		<-entered
+
+		// It waits for the other thread until the deadline.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = vm.EngineNext(e, term.Atom("a"), Success, nil).Force(ctx)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+		close(block)
+		<-done
+	})
+}
+
+func TestVM_EnginePost(t *testing.T) {
+	var vm VM
+	vm.Register1("fetch", vm.EngineFetch)
+
+	var e term.Interface
+	_, err := vm.EngineCreate(term.Variable("X"), &term.Compound{Functor: "fetch", Args: []term.Interface{term.Variable("X")}}, term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+		e = env.Resolve(term.Variable("E"))
+		return nondet.Bool(true)
+	}, nil).Force(context.Background())
+	assert.NoError(t, err)
+
+	ok, err := vm.EnginePost(e, term.Atom("a"), Success, nil).Force(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	t.Run("already posted", func(t *testing.T) {
+		_, err := vm.EnginePost(e, term.Atom("b"), Success, nil).Force(context.Background())
+		assert.Equal(t, permissionErrorPostToEngine(e), err)
+	})
+
+	ok, err = vm.EngineNext(e, term.Atom("a"), Success, nil).Force(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestVM_EngineFetch(t *testing.T) {
+	t.Run("outside of engines", func(t *testing.T) {
+		var vm VM
+		_, err := vm.EngineFetch(term.Variable("X"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorDelivery(), err)
+	})
+
+	t.Run("nothing posted", func(t *testing.T) {
+		var vm VM
+		vm.Register1("fetch", vm.EngineFetch)
+
+		var e term.Interface
+		_, err := vm.EngineCreate(term.Variable("X"), &term.Compound{Functor: "fetch", Args: []term.Interface{term.Variable("X")}}, term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+			e = env.Resolve(term.Variable("E"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+
+		_, err = vm.EngineNext(e, term.Variable("X"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorDelivery(), err)
+	})
+}
+
+func TestVM_EngineYield(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		var vm VM
+		vm.Register1("yield", vm.EngineYield)
+		vm.Register0("foo", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return vm.EngineYield(term.Atom("a"), func(env *term.Env) *nondet.Promise {
+				return vm.EngineYield(term.Atom("b"), k, env)
+			}, env)
+		})
+
+		var e term.Interface
+		_, err := vm.EngineCreate(term.Atom("c"), term.Atom("foo"), term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+			e = env.Resolve(term.Variable("E"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+
+		for _, a := range []term.Atom{"a", "b", "c"} {
+			ok, err := vm.EngineNext(e, a, Success, nil).Force(context.Background())
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+
+		ok, err := vm.EngineNext(e, term.Variable("X"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("outside of engines", func(t *testing.T) {
+		var vm VM
+		_, err := vm.EngineYield(term.Atom("a"), Success, nil).Force(context.Background())
+		assert.Equal(t, permissionErrorYieldEngine(), err)
+	})
+}
+
+func TestVM_EngineSelf(t *testing.T) {
+	var vm VM
+	ok, err := vm.EngineSelf(term.Variable("E"), Success, nil).Force(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	vm.Register1("self", vm.EngineSelf)
+	_, err = vm.EngineCreate(term.Variable("S"), &term.Compound{Functor: "self", Args: []term.Interface{term.Variable("S")}}, term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+		e := env.Resolve(term.Variable("E"))
+		return vm.EngineNext(e, e, Success, env)
+	}, nil).Force(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestVM_EngineDestroy(t *testing.T) {
+	var vm VM
+	vm.Register0("loop", vm.Repeat)
+
+	var e term.Interface
+	_, err := vm.EngineCreate(term.Atom("a"), term.Atom("loop"), term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+		e = env.Resolve(term.Variable("E"))
+		return nondet.Bool(true)
+	}, nil).Force(context.Background())
+	assert.NoError(t, err)
+
+	ok, err := vm.EngineNext(e, term.Atom("a"), Success, nil).Force(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = vm.EngineDestroy(e, Success, nil).Force(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = vm.EngineNext(e, term.Atom("a"), Success, nil).Force(context.Background())
+	assert.Equal(t, existenceErrorEngine(e), err)
+
+	t.Run("cleanup", func(t *testing.T) {
+		var vm VM
+		var closed bool
+		vm.Register0("foo", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return nondet.Cleanup(func() {
+				closed = true
+			}, func(context.Context) *nondet.Promise {
+				return nondet.Delay(func(context.Context) *nondet.Promise {
+					return k(env)
+				}, func(context.Context) *nondet.Promise {
+					return k(env)
+				})
+			})
+		})
+
+		var e term.Interface
+		_, err := vm.EngineCreate(term.Atom("a"), term.Atom("foo"), term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+			e = env.Resolve(term.Variable("E"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+
+		ok, err := vm.EngineNext(e, term.Atom("a"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.False(t, closed)
+
+		ok, err = vm.EngineDestroy(e, Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.True(t, closed)
+	})
+	t.Run("thread ends", func(t *testing.T) {
+		var vm VM
+		var closed bool
+		vm.Register0("foo", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return nondet.Cleanup(func() {
+				closed = true
+			}, func(context.Context) *nondet.Promise {
+				return nondet.Delay(func(context.Context) *nondet.Promise {
+					return k(env)
+				}, func(context.Context) *nondet.Promise {
+					return k(env)
+				})
+			})
+		})
+
+		ctx, exit := WithThread(context.Background())
+		var e term.Interface
+		_, err := vm.EngineCreate(term.Atom("a"), term.Atom("foo"), term.Variable("E"), term.List(), func(env *term.Env) *nondet.Promise {
+			e = env.Resolve(term.Variable("E"))
+			return vm.EngineNext(e, term.Atom("a"), Success, env)
+		}, nil).Force(ctx)
+		assert.NoError(t, err)
+		assert.False(t, closed)
+
+		exit()
+		assert.True(t, closed)
+
+		_, err = vm.EngineNext(e, term.Atom("a"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorEngine(e), err)
+	})
+
+	t.Run("interpreter ends", func(t *testing.T) {
+		var vm VM
+		var closed bool
+		vm.Register0("foo", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return nondet.Cleanup(func() {
+				closed = true
+			}, func(context.Context) *nondet.Promise {
+				return nondet.Delay(func(context.Context) *nondet.Promise {
+					return k(env)
+				}, func(context.Context) *nondet.Promise {
+					return k(env)
+				})
+			})
+		})
+
+		_, err := vm.EngineCreate(term.Atom("a"), term.Atom("foo"), term.Variable("E"), term.List(&term.Compound{Functor: "alias", Args: []term.Interface{term.Atom("e")}}), func(env *term.Env) *nondet.Promise {
+			return vm.EngineNext(term.Atom("e"), term.Atom("a"), Success, env)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, closed)
+
+		vm.DestroyEngines()
+		assert.True(t, closed)
+
+		_, err = vm.EngineNext(term.Atom("e"), term.Atom("a"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorEngine(term.Atom("e")), err)
+	})
+}
@@ -15,6 +15,26 @@ func (e *Exception) Error() string {
 	return e.Term.String()
 }
 
+// InstantiationError returns an exception error(instantiation_error, _) for culprit.
+func InstantiationError(culprit term.Interface) *Exception {
+	return instantiationError(culprit)
+}
+
+// TypeError returns an exception error(type_error(validType, culprit), info).
+func TypeError(validType, culprit, info term.Interface) *Exception {
+	return typeError(validType, culprit, info)
+}
+
+// RepresentationError returns an exception error(representation_error(limit), info).
+func RepresentationError(limit, info term.Interface) *Exception {
+	return representationError(limit, info)
+}
+
+// SystemError returns an exception error(system_error, _) for err.
+func SystemError(err error) *Exception {
+	return systemError(err)
+}
+
 func instantiationError(culprit term.Interface) *Exception {
 	return &Exception{
 		Term: &term.Compound{
@@ -39,6 +59,10 @@ func typeErrorCallable(culprit term.Interface) *Exception {
 	return typeError(term.Atom("callable"), culprit, term.Atom(fmt.Sprintf("%s is not callable.", culprit)))
 }
 
+func typeErrorContinuation(culprit term.Interface) *Exception {
+	return typeError(term.Atom("continuation"), culprit, term.Atom(fmt.Sprintf("%s is not a continuation.", culprit)))
+}
+
 func typeErrorCharacter(culprit term.Interface) *Exception {
 	return typeError(term.Atom("character"), culprit, term.Atom(fmt.Sprintf("%s is not a character.", culprit)))
 }
@@ -114,6 +138,10 @@ func domainErrorNotLessThanZero(culprit term.Interface) *Exception {
 	return domainError(term.Atom("not_less_than_zero"), culprit, term.Atom(fmt.Sprintf("%s is less than zero.", culprit)))
 }
 
+func domainErrorPositiveInteger(culprit term.Interface) *Exception {
+	return domainError(term.Atom("positive_integer"), culprit, term.Atom(fmt.Sprintf("%s is not a positive integer.", culprit)))
+}
+
 func domainErrorOperatorPriority(culprit term.Interface) *Exception {
 	return domainError(term.Atom("operator_priority"), culprit, term.Atom(fmt.Sprintf("%s is not between 0 and 1200.", culprit)))
 }
@@ -150,6 +178,38 @@ func domainErrorStreamProperty(culprit term.Interface) *Exception {
 	return domainError(term.Atom("stream_property"), culprit, term.Atom(fmt.Sprintf("%s is not a stream property.", culprit)))
 }
 
+func domainErrorThreadOption(culprit term.Interface) *Exception {
+	return domainError(term.Atom("thread_option"), culprit, term.Atom(fmt.Sprintf("%s is not a thread option.", culprit)))
+}
+
+func domainErrorThreadOrAlias(culprit term.Interface) *Exception {
+	return domainError(term.Atom("thread_or_alias"), culprit, term.Atom(fmt.Sprintf("%s is neither a thread nor an alias.", culprit)))
+}
+
+func domainErrorQueueOrAlias(culprit term.Interface) *Exception {
+	return domainError(term.Atom("queue_or_alias"), culprit, term.Atom(fmt.Sprintf("%s is neither a message queue nor an alias.", culprit)))
+}
+
+func domainErrorMutexOrAlias(culprit term.Interface) *Exception {
+	return domainError(term.Atom("mutex_or_alias"), culprit, term.Atom(fmt.Sprintf("%s is neither a mutex nor an alias.", culprit)))
+}
+
+func domainErrorConcurrentOption(culprit term.Interface) *Exception {
+	return domainError(term.Atom("concurrent_option"), culprit, term.Atom(fmt.Sprintf("%s is not a concurrent option.", culprit)))
+}
+
+func domainErrorFirstSolutionOption(culprit term.Interface) *Exception {
+	return domainError(term.Atom("first_solution_option"), culprit, term.Atom(fmt.Sprintf("%s is not a first_solution option.", culprit)))
+}
+
+func domainErrorEngineOption(culprit term.Interface) *Exception {
+	return domainError(term.Atom("engine_option"), culprit, term.Atom(fmt.Sprintf("%s is not an engine option.", culprit)))
+}
+
+func domainErrorEngineOrAlias(culprit term.Interface) *Exception {
+	return domainError(term.Atom("engine_or_alias"), culprit, term.Atom(fmt.Sprintf("%s is neither an engine nor an alias.", culprit)))
+}
+
 func domainErrorWriteOption(culprit term.Interface) *Exception {
 	return domainError(term.Atom("write_option"), culprit, term.Atom(fmt.Sprintf("%s is not a write option.", culprit)))
 }
@@ -158,6 +218,10 @@ func domainErrorOrder(culprit term.Interface) *Exception {
 	return domainError(term.Atom("order"), culprit, term.Atom(fmt.Sprintf("%s is neither <, =, nor >.", culprit)))
 }
 
+func domainErrorCSVOption(culprit term.Interface) *Exception {
+	return domainError(term.Atom("csv_option"), culprit, term.Atom(fmt.Sprintf("%s is not a csv option.", culprit)))
+}
+
 func domainError(validDomain, culprit, info term.Interface) *Exception {
 	return &Exception{
 		Term: &term.Compound{
@@ -185,6 +249,29 @@ func existenceErrorStream(culprit term.Interface) *Exception {
 	return existenceError(term.Atom("stream"), culprit, term.Atom(fmt.Sprintf("stream %s doesn't exist.", culprit)))
 }
 
+func existenceErrorThread(culprit term.Interface) *Exception {
+	return existenceError(term.Atom("thread"), culprit, term.Atom(fmt.Sprintf("thread %s doesn't exist.", culprit)))
+}
+
+func existenceErrorQueue(culprit term.Interface) *Exception {
+	return existenceError(term.Atom("message_queue"), culprit, term.Atom(fmt.Sprintf("message queue %s doesn't exist.", culprit)))
+}
+
+func existenceErrorEngine(culprit term.Interface) *Exception {
+	return existenceError(term.Atom("engine"), culprit, term.Atom(fmt.Sprintf("engine %s doesn't exist.", culprit)))
+}
+
+func existenceErrorDelivery() *Exception {
+	return existenceError(term.Atom("term"), term.Atom("delivery"), term.Atom("no term is posted to the engine."))
+}
+
+func existenceErrorReset(culprit term.Interface) *Exception {
+	return existenceError(&term.Compound{
+		Functor: "/",
+		Args:    []term.Interface{term.Atom("reset"), term.Integer(3)},
+	}, culprit, term.Atom(fmt.Sprintf("no reset/3 catches %s.", culprit)))
+}
+
 func existenceError(objectType, culprit, info term.Interface) *Exception {
 	return &Exception{
 		Term: &term.Compound{
@@ -208,6 +295,42 @@ func permissionErrorAccessPrivateProcedure(culprit term.Interface) *Exception {
 	return permissionError(term.Atom("access"), term.Atom("private_procedure"), culprit, term.Atom(fmt.Sprintf("%s is private.", culprit)))
 }
 
+func permissionErrorCreateThread(culprit term.Interface) *Exception {
+	return permissionError(term.Atom("create"), term.Atom("thread"), culprit, term.Atom(fmt.Sprintf("%s is already in use.", culprit)))
+}
+
+func permissionErrorJoinThread(culprit term.Interface) *Exception {
+	return permissionError(term.Atom("join"), term.Atom("thread"), culprit, term.Atom(fmt.Sprintf("%s cannot be joined.", culprit)))
+}
+
+func permissionErrorUnlockMutex(culprit term.Interface) *Exception {
+	return permissionError(term.Atom("unlock"), term.Atom("mutex"), culprit, term.Atom(fmt.Sprintf("%s is not locked by this thread.", culprit)))
+}
+
+func permissionErrorCreateEngine(culprit term.Interface) *Exception {
+	return permissionError(term.Atom("create"), term.Atom("engine"), culprit, term.Atom(fmt.Sprintf("%s is already in use.", culprit)))
+}
+
+func permissionErrorAccessEngine(culprit term.Interface) *Exception {
+	return permissionError(term.Atom("access"), term.Atom("engine"), culprit, term.Atom(fmt.Sprintf("%s is running the goal.", culprit)))
+}
+
+func permissionErrorPostToEngine(culprit term.Interface) *Exception {
+	return permissionError(term.Atom("post_to"), term.Atom("engine"), culprit, term.Atom(fmt.Sprintf("%s already has a posted term.", culprit)))
+}
+
+func permissionErrorYieldEngine() *Exception {
+	return permissionError(term.Atom("yield"), term.Atom("engine"), term.Atom("main"), term.Atom("engine_yield/1 is called outside of an engine."))
+}
+
+func permissionErrorYieldNestedEngine(culprit term.Interface) *Exception {
+	return permissionError(term.Atom("yield"), term.Atom("engine"), culprit, term.Atom("engine_yield/1 is called in a nested search such as catch/3 or findall/3."))
+}
+
+func permissionErrorCaptureContinuation(culprit term.Interface) *Exception {
+	return permissionError(term.Atom("capture"), term.Atom("continuation"), culprit, term.Atom(fmt.Sprintf("shift(%s) is called in a nested search such as catch/3 or findall/3.", culprit)))
+}
+
 func permissionErrorOutputStream(culprit term.Interface) *Exception {
 	return permissionError(term.Atom("output"), term.Atom("stream"), culprit, term.Atom(fmt.Sprintf("%s is not an output stream.", culprit)))
 }
@@ -240,6 +363,14 @@ func permissionErrorInputPastEndOfStream(culprit term.Interface) *Exception {
 	return permissionError(term.Atom("input"), term.Atom("past_end_of_stream"), culprit, term.Atom(fmt.Sprintf("%s has past end of stream.", culprit)))
 }
 
+func permissionErrorSandboxed(culprit term.Interface) *Exception {
+	return permissionError(term.Atom("call"), term.Atom("sandboxed"), culprit, term.Atom(fmt.Sprintf("%s is not allowed in a sandbox.", culprit)))
+}
+
+func permissionErrorAssertRule(culprit term.Interface) *Exception {
+	return permissionError(term.Atom("assert"), term.Atom("rule"), culprit, term.Atom(fmt.Sprintf("%s is not a fact.", culprit)))
+}
+
 func permissionError(operation, permissionType, culprit, info term.Interface) *Exception {
 	return &Exception{
 		Term: &term.Compound{
@@ -289,6 +420,26 @@ func evaluationError(error, info term.Interface) *Exception {
 	}
 }
 
+func resourceErrorInferences() *Exception {
+	return resourceError(term.Atom("inferences"), term.Atom("inference limit exceeded."))
+}
+
+func resourceErrorDepth() *Exception {
+	return resourceError(term.Atom("depth"), term.Atom("depth limit exceeded."))
+}
+
+func resourceErrorStack() *Exception {
+	return resourceError(term.Atom("stack"), term.Atom("stack limit exceeded."))
+}
+
+func resourceErrorTermSize() *Exception {
+	return resourceError(term.Atom("term_size"), term.Atom("term size limit exceeded."))
+}
+
+func resourceErrorTime() *Exception {
+	return resourceError(term.Atom("time"), term.Atom("time limit exceeded."))
+}
+
 func resourceError(resource, info term.Interface) *Exception {
 	return &Exception{
 		Term: &term.Compound{
@@ -346,3 +497,7 @@ func systemError(err error) *Exception {
 		},
 	}
 }
+
+func timeLimitExceeded() *Exception {
+	return &Exception{Term: term.Atom("time_limit_exceeded")}
+}
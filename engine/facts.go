@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+)
+
+// DynamicProcedure is a Procedure which asserta/1, assertz/1, and retract/1 can modify.
+type DynamicProcedure interface {
+	Procedure
+
+	// Assert adds a clause t. If front, t is added before the other clauses.
+	Assert(t term.Interface, front bool, env *term.Env) error
+
+	// Retract removes a clause which unifies with t. On backtracking, it removes the next one.
+	Retract(t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise
+}
+
+// PublicProcedure is a Procedure of which clauses clause/2 can access. current_predicate/1 lists it as well.
+type PublicProcedure interface {
+	Procedure
+
+	// Clause unifies head and body with a clause. On backtracking, it unifies them with the next one.
+	Clause(head, body term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise
+}
+
+// FactStore is a storage of the facts of a predicate. A fact is represented by its arguments.
+type FactStore interface {
+	// Find returns an iterator over the facts which may unify with args. The unbound arguments are variables so that
+	// the store can look up its indices by the bound ones. The facts which don't unify with args are filtered out
+	// afterwards.
+	Find(args []term.Interface) (FactIterator, error)
+}
+
+// MutableFactStore is a FactStore which asserta/1, assertz/1, and retract/1 can modify.
+type MutableFactStore interface {
+	FactStore
+
+	// Insert adds a fact. If front, the fact is added before the other facts.
+	Insert(fact []term.Interface, front bool) error
+
+	// Delete removes a fact returned by an iterator. The iterators already returned by Find must not be affected.
+	Delete(fact []term.Interface) error
+}
+
+// CloneableFactStore is a FactStore which is copied for a clone of the VM made by CloneTo. The clones share the other
+// stores.
+type CloneableFactStore interface {
+	FactStore
+
+	// Clone returns a copy of the store. The changes to either of them must not affect the other.
+	Clone() FactStore
+}
+
+// FactIterator iterates over the facts found by FactStore.
+type FactIterator interface {
+	// Next returns the next fact. It returns false if there are no more facts.
+	Next(ctx context.Context) ([]term.Interface, bool, error)
+
+	// Close releases the resources. It's called exactly once when the facts are exhausted, cut, or abandoned. Its
+	// error is ignored.
+	Close() error
+}
+
+// Facts is a procedure of which clauses are the facts in Store. It's registered by RegisterProcedure. If Store is a
+// MutableFactStore, the procedure is dynamic. If Store is a CloneableFactStore, a clone of the VM has its own copy.
+type Facts struct {
+	Store FactStore
+}
+
+// Call unifies args with the facts one by one.
+func (f *Facts) Call(_ *VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return f.each(args, func(_ []term.Interface, env *term.Env) *nondet.Promise {
+		return k(env)
+	}, env)
+}
+
+// Assert adds a fact t to Store.
+func (f *Facts) Assert(t term.Interface, front bool, env *term.Env) error {
+	s, ok := f.Store.(MutableFactStore)
+	if !ok {
+		return permissionErrorModifyStaticProcedure(f.pi(t, env).Term())
+	}
+	c := term.Rulify(t, env).(*term.Compound)
+	if env.Resolve(c.Args[1]) != term.Atom("true") {
+		return permissionErrorAssertRule(env.Simplify(t))
+	}
+	_, args, err := piArgs(c.Args[0], env)
+	if err != nil {
+		return err
+	}
+	vars := map[term.Variable]term.Variable{}
+	fact := make([]term.Interface, len(args))
+	for i, a := range args {
+		fact[i] = copyTerm(a, vars, env)
+	}
+	return s.Insert(fact, front)
+}
+
+// Retract removes a fact which unifies with t from Store.
+func (f *Facts) Retract(t term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	s, ok := f.Store.(MutableFactStore)
+	if !ok {
+		return nondet.Error(permissionErrorModifyStaticProcedure(f.pi(t, env).Term()))
+	}
+	c := term.Rulify(t, env).(*term.Compound)
+	_, args, err := piArgs(c.Args[0], env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+	return f.each(args, func(fact []term.Interface, env *term.Env) *nondet.Promise {
+		env, ok := c.Args[1].Unify(term.Atom("true"), false, env)
+		if !ok {
+			return nondet.Bool(false)
+		}
+		if err := s.Delete(fact); err != nil {
+			return nondet.Error(err)
+		}
+		return k(env)
+	}, env)
+}
+
+// Clause unifies head with a fact and body with true.
+func (f *Facts) Clause(head, body term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	_, args, err := piArgs(head, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+	return f.each(args, func(_ []term.Interface, env *term.Env) *nondet.Promise {
+		return Unify(body, term.Atom("true"), k, env)
+	}, env)
+}
+
+// each unifies args with the facts found in Store one by one and continues with k. The facts are fetched lazily on
+// backtracking.
+func (f *Facts) each(args []term.Interface, k func([]term.Interface, *term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(context.Context) *nondet.Promise {
+		pattern := make([]term.Interface, len(args))
+		for i, a := range args {
+			pattern[i] = env.Simplify(a)
+		}
+		it, err := f.Store.Find(pattern)
+		if err != nil {
+			return nondet.Error(err)
+		}
+
+		var next func(context.Context) *nondet.Promise
+		next = func(ctx context.Context) *nondet.Promise {
+			fact, ok, err := it.Next(ctx)
+			if err != nil {
+				return nondet.Error(err)
+			}
+			if !ok {
+				return nondet.Bool(false)
+			}
+			if len(fact) != len(args) {
+				return nondet.Error(systemError(fmt.Errorf("wrong number of arguments: %s", term.List(fact...))))
+			}
+			return nondet.Delay(func(context.Context) *nondet.Promise {
+				// The variables in the fact are renamed for each call.
+				vars := map[term.Variable]term.Variable{}
+				env := env
+				for i, a := range args {
+					var ok bool
+					env, ok = a.Unify(copyTerm(fact[i], vars, nil), false, env)
+					if !ok {
+						return nondet.Bool(false)
+					}
+				}
+				return k(fact, env)
+			}, next)
+		}
+		return nondet.Cleanup(func() {
+			_ = it.Close()
+		}, next)
+	})
+}
+
+// pi returns the procedure indicator of a clause t.
+func (f *Facts) pi(t term.Interface, env *term.Env) ProcedureIndicator {
+	pi, _, _ := piArgs(term.Rulify(t, env).(*term.Compound).Args[0], env)
+	return pi
+}
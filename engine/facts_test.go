@@ -0,0 +1,266 @@
+package engine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+	"github.com/stretchr/testify/assert"
+)
+
+// indexedStore is a MutableFactStore indexed by the first argument.
+type indexedStore struct {
+	facts    [][]term.Interface
+	patterns [][]term.Interface
+	closed   int
+}
+
+func (s *indexedStore) Find(args []term.Interface) (FactIterator, error) {
+	s.patterns = append(s.patterns, args)
+	var facts [][]term.Interface
+	for _, f := range s.facts {
+		if _, ok := args[0].(term.Variable); ok || f[0] == args[0] {
+			facts = append(facts, f)
+		}
+	}
+	return &sliceFactIterator{store: s, facts: facts}, nil
+}
+
+func (s *indexedStore) Insert(fact []term.Interface, front bool) error {
+	if front {
+		s.facts = append([][]term.Interface{fact}, s.facts...)
+		return nil
+	}
+	s.facts = append(s.facts, fact)
+	return nil
+}
+
+func (s *indexedStore) Delete(fact []term.Interface) error {
+	for i, f := range s.facts {
+		if &f[0] == &fact[0] {
+			s.facts = append(s.facts[:i:i], s.facts[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// cloneableStore is an indexedStore which is copied for a clone of the VM.
+type cloneableStore struct {
+	indexedStore
+}
+
+func (s *cloneableStore) Clone() FactStore {
+	return &cloneableStore{indexedStore: indexedStore{facts: s.facts[:len(s.facts):len(s.facts)]}}
+}
+
+type sliceFactIterator struct {
+	store *indexedStore
+	facts [][]term.Interface
+}
+
+func (it *sliceFactIterator) Next(context.Context) ([]term.Interface, bool, error) {
+	if len(it.facts) == 0 {
+		return nil, false, nil
+	}
+	var f []term.Interface
+	f, it.facts = it.facts[0], it.facts[1:]
+	return f, true, nil
+}
+
+func (it *sliceFactIterator) Close() error {
+	it.store.closed++
+	return nil
+}
+
+// readOnlyStore is a FactStore which can't be modified.
+type readOnlyStore struct {
+	store indexedStore
+}
+
+func (s *readOnlyStore) Find(args []term.Interface) (FactIterator, error) {
+	return s.store.Find(args)
+}
+
+func TestFacts(t *testing.T) {
+	parent := func(p, c term.Atom) []term.Interface {
+		return []term.Interface{p, c}
+	}
+	newVM := func() (*VM, *indexedStore) {
+		s := indexedStore{facts: [][]term.Interface{
+			parent("alice", "bob"),
+			parent("bob", "carol"),
+			parent("alice", "dave"),
+		}}
+		var vm VM
+		vm.Register1("asserta", vm.Asserta)
+		vm.Register1("assertz", vm.Assertz)
+		vm.Register1("retract", vm.Retract)
+		vm.Register2("clause", vm.Clause)
+		vm.Register1("current_predicate", vm.CurrentPredicate)
+		vm.RegisterProcedure(ProcedureIndicator{Name: "parent", Arity: 2}, &Facts{Store: &s})
+		return &vm, &s
+	}
+	collect := func(t *testing.T, vm *VM, goal term.Interface, v term.Variable) []term.Interface {
+		var ts []term.Interface
+		ok, err := vm.Call(goal, func(env *term.Env) *nondet.Promise {
+			ts = append(ts, env.Resolve(v))
+			return nondet.Bool(false)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		return ts
+	}
+
+	t.Run("call", func(t *testing.T) {
+		vm, s := newVM()
+		assert.Equal(t, []term.Interface{term.Atom("bob"), term.Atom("dave")}, collect(t, vm, &term.Compound{
+			Functor: "parent",
+			Args:    []term.Interface{term.Atom("alice"), term.Variable("C")},
+		}, "C"))
+		assert.Equal(t, [][]term.Interface{{term.Atom("alice"), term.Variable("C")}}, s.patterns)
+		assert.Equal(t, 1, s.closed)
+
+		assert.Equal(t, []term.Interface{term.Atom("alice")}, collect(t, vm, &term.Compound{
+			Functor: "parent",
+			Args:    []term.Interface{term.Variable("P"), term.Atom("bob")},
+		}, "P"))
+	})
+
+	t.Run("abandoned", func(t *testing.T) {
+		vm, s := newVM()
+		ok, err := vm.Call(&term.Compound{
+			Functor: "parent",
+			Args:    []term.Interface{term.Variable("P"), term.Variable("C")},
+		}, Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 1, s.closed)
+	})
+
+	t.Run("assert", func(t *testing.T) {
+		vm, s := newVM()
+		ok, err := vm.Assertz(&term.Compound{
+			Functor: "parent",
+			Args:    []term.Interface{term.Atom("carol"), term.Atom("eve")},
+		}, Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = vm.Asserta(&term.Compound{
+			Functor: "parent",
+			Args:    []term.Interface{term.Atom("zoe"), term.Atom("alice")},
+		}, Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, parent("zoe", "alice"), s.facts[0])
+		assert.Equal(t, parent("carol", "eve"), s.facts[4])
+
+		_, err = vm.Assertz(&term.Compound{
+			Functor: ":-",
+			Args: []term.Interface{
+				&term.Compound{Functor: "parent", Args: []term.Interface{term.Variable("X"), term.Variable("Y")}},
+				&term.Compound{Functor: "parent", Args: []term.Interface{term.Variable("Y"), term.Variable("X")}},
+			},
+		}, Success, nil).Force(context.Background())
+		assert.Error(t, err)
+	})
+
+	t.Run("retract", func(t *testing.T) {
+		vm, s := newVM()
+		ok, err := vm.Retract(&term.Compound{
+			Functor: "parent",
+			Args:    []term.Interface{term.Atom("alice"), term.Variable("C")},
+		}, func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Atom("bob"), env.Resolve(term.Variable("C")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, [][]term.Interface{parent("bob", "carol"), parent("alice", "dave")}, s.facts)
+	})
+
+	t.Run("clause", func(t *testing.T) {
+		vm, _ := newVM()
+		assert.Equal(t, []term.Interface{term.Atom("true")}, collect(t, vm, &term.Compound{
+			Functor: "clause",
+			Args: []term.Interface{
+				&term.Compound{Functor: "parent", Args: []term.Interface{term.Atom("bob"), term.Variable("C")}},
+				term.Variable("B"),
+			},
+		}, "B"))
+	})
+
+	t.Run("current_predicate", func(t *testing.T) {
+		vm, _ := newVM()
+		assert.Equal(t, []term.Interface{&term.Compound{
+			Functor: "/",
+			Args:    []term.Interface{term.Atom("parent"), term.Integer(2)},
+		}}, collect(t, vm, &term.Compound{
+			Functor: "current_predicate",
+			Args:    []term.Interface{term.Variable("PI")},
+		}, "PI"))
+	})
+
+	t.Run("wrong number of arguments", func(t *testing.T) {
+		vm, s := newVM()
+		s.facts = append(s.facts, []term.Interface{term.Atom("alice")})
+		_, err := vm.Call(&term.Compound{
+			Functor: "parent",
+			Args:    []term.Interface{term.Variable("P"), term.Variable("C")},
+		}, func(*term.Env) *nondet.Promise {
+			return nondet.Bool(false)
+		}, nil).Force(context.Background())
+		_, ok := err.(*Exception)
+		assert.True(t, ok)
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		assertz := func(vm *VM, c term.Atom) {
+			ok, err := vm.Assertz(&term.Compound{
+				Functor: "parent",
+				Args:    []term.Interface{term.Atom("carol"), c},
+			}, Success, nil).Force(context.Background())
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+		children := func(vm *VM) []term.Interface {
+			return collect(t, vm, &term.Compound{
+				Functor: "parent",
+				Args:    []term.Interface{term.Atom("carol"), term.Variable("C")},
+			}, "C")
+		}
+
+		t.Run("shared", func(t *testing.T) {
+			vm, _ := newVM()
+			var c VM
+			vm.CloneTo(&c)
+			assertz(&c, "eve")
+			assert.Equal(t, []term.Interface{term.Atom("eve")}, children(vm))
+		})
+
+		t.Run("cloneable", func(t *testing.T) {
+			var vm VM
+			vm.RegisterProcedure(ProcedureIndicator{Name: "parent", Arity: 2}, &Facts{Store: &cloneableStore{}})
+			var c VM
+			vm.CloneTo(&c)
+			assertz(&c, "eve")
+			assertz(&vm, "frank")
+			assert.Equal(t, []term.Interface{term.Atom("frank")}, children(&vm))
+			assert.Equal(t, []term.Interface{term.Atom("eve")}, children(&c))
+		})
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		var vm VM
+		vm.RegisterProcedure(ProcedureIndicator{Name: "parent", Arity: 2}, &Facts{Store: &readOnlyStore{}})
+		_, err := vm.Assertz(&term.Compound{
+			Functor: "parent",
+			Args:    []term.Interface{term.Atom("carol"), term.Atom("eve")},
+		}, Success, nil).Force(context.Background())
+		assert.Equal(t, permissionErrorModifyStaticProcedure(&term.Compound{
+			Functor: "/",
+			Args:    []term.Interface{term.Atom("parent"), term.Integer(2)},
+		}), err)
+	})
+}
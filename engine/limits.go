@@ -0,0 +1,336 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+)
+
+// Limits are the limits on the resources which a query consumes. Zero means no limit. Exceeding one of them raises
+// a resource error. A handler of the resource error for inferences or time is given another round of them only once.
+type Limits struct {
+	// Inferences is the maximum number of predicate calls.
+	Inferences int64
+
+	// Depth is the maximum depth of nested predicate calls.
+	Depth int
+
+	// Stack is the maximum number of promises on the stack of the trampoline. The goals run by nested trampolines,
+	// e.g. by findall/3 or catch/3, count towards the same limit.
+	Stack int
+
+	// TermSize is the maximum number of nodes of a term created at once by findall/3, bagof/3, setof/3, copy_term/2
+	// or =../2. The terms built step by step, e.g. by append/3 or length/2, are bounded by Inferences instead. The
+	// lists built by atom_chars/2, atom_codes/2 and the like are as long as the atoms and the numbers they convert.
+	TermSize int
+
+	// Time is the maximum elapsed time since the query started.
+	Time time.Duration
+}
+
+type limitsKey struct{}
+
+// WithLimits returns a context which limits the queries executed with it by l instead of VM.Limits.
+func WithLimits(ctx context.Context, l Limits) context.Context {
+	return context.WithValue(ctx, limitsKey{}, l)
+}
+
+type deadlineExceptionKey struct{}
+
+// WithDeadlineException returns a context with which the deadline of ctx raises time_limit_exceeded, an exception
+// which catch/3 can catch, instead of aborting the query. As with Limits.Time, a handler of the exception is given
+// another round of time only once.
+func WithDeadlineException(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deadlineExceptionKey{}, true)
+}
+
+// Limit returns a context to execute a query with. The query is limited by the limits given by WithLimits or, if not
+// given, by vm.Limits.
+func (vm *VM) Limit(ctx context.Context) context.Context {
+	l, ok := ctx.Value(limitsKey{}).(Limits)
+	if !ok {
+		l = vm.Limits
+	}
+	now := time.Now()
+	deadline, soft := ctx.Deadline()
+	soft = soft && ctx.Value(deadlineExceptionKey{}) != nil
+	if l == (Limits{}) && !soft {
+		return ctx
+	}
+
+	lim := limiter{limits: l}
+	if l.Time > 0 {
+		lim.deadline = now.Add(l.Time).UnixNano()
+	}
+	if soft {
+		lim.ctxDeadline, lim.ctxTime = deadline.UnixNano(), deadline.Sub(now)
+		ctx = nondet.WithSoftDeadline(ctx)
+	}
+	ctx = context.WithValue(ctx, limiterKey{}, &lim)
+	if l.Stack > 0 {
+		ctx = nondet.WithStackLimit(ctx, l.Stack, resourceErrorStack())
+	}
+	return ctx
+}
+
+type limiterKey struct{}
+
+// unlimited returns a context derived from ctx without the resource limits.
+func unlimited(ctx context.Context) context.Context {
+	return nondet.WithStackLimit(context.WithValue(ctx, limiterKey{}, (*limiter)(nil)), 0, nil)
+}
+
+// DefaultCleanupTimeout is the default of VM.CleanupTimeout.
+const DefaultCleanupTimeout = 5 * time.Second
+
+// graceful returns a context which carries the values of ctx but is canceled only d after ctx is done, so that a
+// cleanup can run even after the query is canceled or exceeds its deadline.
+func graceful(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	g, cancel := context.WithCancel(detached{Context: ctx})
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-t.C:
+				cancel()
+			case <-stop:
+			}
+		case <-stop:
+		}
+	}()
+	return g, func() {
+		close(stop)
+		cancel()
+	}
+}
+
+// detached is a context which carries the values of the parent context but not its cancellation.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detached) Done() <-chan struct{} {
+	return nil
+}
+
+func (detached) Err() error {
+	return nil
+}
+
+// depthKey is the key of the context for the depth of nested predicate calls. It's kept track of only if the depth
+// is limited.
+type depthKey struct{}
+
+// limiter keeps track of the resources consumed by a query or by a goal of call_with_inference_limit/3.
+type limiter struct {
+	parent     *limiter
+	limits     Limits
+	scoped     bool  // true if it's for call_with_inference_limit/3.
+	inferences int64 // accessed atomically.
+	deadline   int64 // in Unix nanoseconds. accessed atomically.
+	graced     int32 // accessed atomically.
+
+	// The deadline of the context if it raises time_limit_exceeded.
+	ctxDeadline int64 // in Unix nanoseconds. accessed atomically.
+	ctxTime     time.Duration
+}
+
+// grace gives a handler of the resource error another round of inferences and time so that it can recover. It's
+// only once per query so that a handler can't keep the query running forever.
+func (l *limiter) grace() {
+	if !atomic.CompareAndSwapInt32(&l.graced, 0, 1) {
+		return
+	}
+	atomic.AddInt64(&l.inferences, -l.limits.Inferences)
+	now := time.Now()
+	if l.limits.Time > 0 {
+		atomic.StoreInt64(&l.deadline, now.Add(l.limits.Time).UnixNano())
+	}
+	if l.ctxTime > 0 {
+		atomic.StoreInt64(&l.ctxDeadline, now.Add(l.ctxTime).UnixNano())
+	}
+}
+
+// inferenceLimitExceeded is raised when a goal of call_with_inference_limit/3 exceeds the limit. It's not an
+// exception so that catch/3 can't catch it.
+type inferenceLimitExceeded struct {
+	limiter *limiter
+}
+
+func (*inferenceLimitExceeded) Error() string {
+	return "inference limit exceeded"
+}
+
+// arrive accounts for a predicate call at depth d. It reports whether the depth is limited.
+func (l *limiter) arrive(d int) (bool, error) {
+	var depth bool
+	for l := l; l != nil; l = l.parent {
+		if n := atomic.AddInt64(&l.inferences, 1); l.limits.Inferences > 0 && n > l.limits.Inferences {
+			if l.scoped {
+				return false, &inferenceLimitExceeded{limiter: l}
+			}
+			l.grace()
+			return false, resourceErrorInferences()
+		}
+
+		if d := atomic.LoadInt64(&l.deadline); d != 0 && time.Now().UnixNano() > d {
+			l.grace()
+			return false, resourceErrorTime()
+		}
+
+		if d := atomic.LoadInt64(&l.ctxDeadline); d != 0 && time.Now().UnixNano() > d {
+			l.grace()
+			return false, timeLimitExceeded()
+		}
+
+		if l.limits.Depth > 0 {
+			if d >= l.limits.Depth {
+				return false, resourceErrorDepth()
+			}
+			depth = true
+		}
+	}
+	return depth, nil
+}
+
+// checkTermSize returns a resource error if t, a term just created, is larger than the limit.
+func checkTermSize(ctx context.Context, t term.Interface, env *term.Env) error {
+	if max := termSizeLimit(ctx); max > 0 && termSize(t, max, env) > max {
+		return resourceErrorTermSize()
+	}
+	return nil
+}
+
+// termSizeLimit returns the maximum number of nodes of a term. Zero means no limit.
+func termSizeLimit(ctx context.Context) int {
+	var max int
+	l, _ := ctx.Value(limiterKey{}).(*limiter)
+	for ; l != nil; l = l.parent {
+		if n := l.limits.TermSize; n > 0 && (max == 0 || n < max) {
+			max = n
+		}
+	}
+	return max
+}
+
+// termSize counts the nodes of t up to max+1.
+func termSize(t term.Interface, max int, env *term.Env) int {
+	var n int
+	ts := []term.Interface{t}
+	for len(ts) > 0 && n <= max {
+		t, ts = ts[len(ts)-1], ts[:len(ts)-1]
+		n++
+		if c, ok := env.Resolve(t).(*term.Compound); ok {
+			ts = append(ts, c.Args...)
+		}
+	}
+	return n
+}
+
+// CallWithInferenceLimit calls goal and unifies result with ! if goal succeeds without choice points, true if goal
+// succeeds with choice points, or inference_limit_exceeded if goal doesn't terminate within limit inferences.
+func (vm *VM) CallWithInferenceLimit(goal, limit, result term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	var n term.Integer
+	switch l := env.Resolve(limit).(type) {
+	case term.Variable:
+		return nondet.Error(instantiationError(limit))
+	case term.Integer:
+		if l < 0 {
+			return nondet.Error(domainErrorNotLessThanZero(limit))
+		}
+		n = l
+	default:
+		return nondet.Error(typeErrorInteger(limit))
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		parent, _ := ctx.Value(limiterKey{}).(*limiter)
+		l := limiter{parent: parent, limits: Limits{Inferences: int64(n)}, scoped: true}
+
+		var sol *term.Env
+		it := vm.nested(goal, func(env *term.Env) *nondet.Promise {
+			sol = env
+			return nondet.Bool(true)
+		}, env).Iterator()
+
+		var next func(context.Context) *nondet.Promise
+		next = func(ctx context.Context) *nondet.Promise {
+			// Each answer is searched with the context of the caller who asks for it.
+			ok, err := it.Next(context.WithValue(ctx, limiterKey{}, &l))
+			var e *inferenceLimitExceeded
+			if errors.As(err, &e) && e.limiter == &l {
+				return Unify(result, term.Atom("inference_limit_exceeded"), k, env)
+			}
+			if err != nil {
+				return nondet.Error(err)
+			}
+			if !ok {
+				return nondet.Bool(false)
+			}
+			r := term.Atom("true")
+			if it.Det() {
+				r = "!"
+			}
+			sol := sol
+			return nondet.Delay(func(context.Context) *nondet.Promise {
+				return Unify(result, r, k, sol)
+			}, next)
+		}
+		return nondet.Cleanup(it.Close, next)
+	})
+}
+
+// CallWithTimeLimit calls goal once. If goal doesn't terminate within t seconds, it raises time_limit_exceeded. t is
+// an arithmetic expression which evaluates to a non-negative number.
+func (vm *VM) CallWithTimeLimit(t, goal term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	v, err := DefaultFunctionSet.eval(t, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	var d time.Duration
+	switch v := v.(type) {
+	case term.Integer:
+		if v < 0 {
+			return nondet.Error(domainErrorNotLessThanZero(v))
+		}
+		d = time.Duration(v) * time.Second
+	case term.Float:
+		if v < 0 {
+			return nondet.Error(domainErrorNotLessThanZero(v))
+		}
+		d = time.Duration(float64(v) * float64(time.Second))
+	}
+
+	return nondet.Delay(func(parent context.Context) *nondet.Promise {
+		ctx, cancel := context.WithTimeout(parent, d)
+		defer cancel()
+
+		var sol *term.Env
+		ok, err := vm.nested(goal, func(env *term.Env) *nondet.Promise {
+			sol = env
+			return nondet.Bool(true)
+		}, env).Force(ctx)
+		if err != nil {
+			if parent.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+				return nondet.Error(timeLimitExceeded())
+			}
+			return nondet.Error(err)
+		}
+		if !ok {
+			return nondet.Bool(false)
+		}
+		return k(sol)
+	})
+}
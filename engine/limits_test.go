@@ -0,0 +1,314 @@
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVM_Limit(t *testing.T) {
+	var vm VM
+	vm.Register0("loop", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return vm.Call(term.Atom("loop"), k, env)
+	})
+	vm.Register0("choices", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return nondet.Delay(func(context.Context) *nondet.Promise {
+			return vm.Call(term.Atom("choices"), k, env)
+		}, func(context.Context) *nondet.Promise {
+			return k(env)
+		})
+	})
+	vm.Register2("copy_term", CopyTerm)
+	vm.Register3("catch", vm.Catch)
+	vm.Register0("true", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return k(env)
+	})
+	vm.Register0("retry", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return vm.Catch(term.Atom("loop"), term.Variable("_"), term.Atom("retry"), k, env)
+	})
+
+	t.Run("no limits", func(t *testing.T) {
+		ctx := context.Background()
+		assert.Equal(t, ctx, vm.Limit(ctx))
+	})
+
+	t.Run("inferences", func(t *testing.T) {
+		ctx := vm.Limit(WithLimits(context.Background(), Limits{Inferences: 100}))
+		_, err := vm.Call(term.Atom("loop"), Success, nil).Force(ctx)
+		assert.Equal(t, resourceErrorInferences(), err)
+	})
+
+	t.Run("depth", func(t *testing.T) {
+		ctx := vm.Limit(WithLimits(context.Background(), Limits{Depth: 100}))
+		_, err := vm.Call(term.Atom("loop"), Success, nil).Force(ctx)
+		assert.Equal(t, resourceErrorDepth(), err)
+	})
+
+	t.Run("stack", func(t *testing.T) {
+		ctx := vm.Limit(WithLimits(context.Background(), Limits{Stack: 100}))
+		_, err := vm.Call(term.Atom("choices"), func(*term.Env) *nondet.Promise {
+			return nondet.Bool(false)
+		}, nil).Force(ctx)
+		assert.Equal(t, resourceErrorStack(), err)
+	})
+
+	t.Run("nested stack", func(t *testing.T) {
+		var vm VM
+		vm.Register3("findall", vm.FindAll)
+		// nest(N) leaves 5 choice points and then calls findall(_, nest(N-1), _).
+		vm.Register1("nest", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			n := env.Resolve(x).(term.Integer)
+			if n == 0 {
+				return k(env)
+			}
+			var choices func(int) *nondet.Promise
+			choices = func(m int) *nondet.Promise {
+				if m == 0 {
+					return vm.Call(&term.Compound{
+						Functor: "findall",
+						Args: []term.Interface{
+							term.NewVariable(),
+							&term.Compound{Functor: "nest", Args: []term.Interface{n - 1}},
+							term.NewVariable(),
+						},
+					}, k, env)
+				}
+				return nondet.Delay(func(context.Context) *nondet.Promise {
+					return choices(m - 1)
+				}, func(context.Context) *nondet.Promise {
+					return nondet.Bool(false)
+				})
+			}
+			return choices(5)
+		})
+
+		ctx := vm.Limit(WithLimits(context.Background(), Limits{Stack: 100}))
+		ok, err := vm.Call(&term.Compound{Functor: "nest", Args: []term.Interface{term.Integer(2)}}, Success, nil).Force(ctx)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		_, err = vm.Call(&term.Compound{Functor: "nest", Args: []term.Interface{term.Integer(20)}}, Success, nil).Force(ctx)
+		assert.Equal(t, resourceErrorStack(), err)
+	})
+
+	t.Run("term size", func(t *testing.T) {
+		ctx := vm.Limit(WithLimits(context.Background(), Limits{TermSize: 5}))
+
+		ok, err := vm.Call(&term.Compound{
+			Functor: "copy_term",
+			Args:    []term.Interface{term.List(term.Atom("a")), term.Variable("X")},
+		}, Success, nil).Force(ctx)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		_, err = vm.Call(&term.Compound{
+			Functor: "copy_term",
+			Args:    []term.Interface{term.List(term.Atom("a"), term.Atom("b"), term.Atom("c")), term.Variable("X")},
+		}, Success, nil).Force(ctx)
+		assert.Equal(t, resourceErrorTermSize(), err)
+	})
+
+	t.Run("time", func(t *testing.T) {
+		ctx := vm.Limit(WithLimits(context.Background(), Limits{Time: 10 * time.Millisecond}))
+		_, err := vm.Call(term.Atom("loop"), Success, nil).Force(ctx)
+		assert.Equal(t, resourceErrorTime(), err)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		vm.Limits = Limits{Inferences: 100}
+		defer func() {
+			vm.Limits = Limits{}
+		}()
+		_, err := vm.Call(term.Atom("loop"), Success, nil).Force(vm.Limit(context.Background()))
+		assert.Equal(t, resourceErrorInferences(), err)
+	})
+
+	t.Run("catchable", func(t *testing.T) {
+		ctx := vm.Limit(WithLimits(context.Background(), Limits{Inferences: 100}))
+		ok, err := vm.Call(&term.Compound{
+			Functor: "catch",
+			Args: []term.Interface{
+				term.Atom("loop"),
+				&term.Compound{
+					Functor: "error",
+					Args: []term.Interface{
+						&term.Compound{Functor: "resource_error", Args: []term.Interface{term.Variable("R")}},
+						term.Variable("_"),
+					},
+				},
+				term.Atom("true"),
+			},
+		}, func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Atom("inferences"), env.Resolve(term.Variable("R")))
+			return nondet.Bool(true)
+		}, nil).Force(ctx)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("handler can't keep running", func(t *testing.T) {
+		ctx := vm.Limit(WithLimits(context.Background(), Limits{Inferences: 100}))
+		_, err := vm.Call(term.Atom("retry"), Success, nil).Force(ctx)
+		assert.Equal(t, resourceErrorInferences(), err)
+	})
+}
+
+func TestVM_CallWithInferenceLimit(t *testing.T) {
+	var vm VM
+	vm.Register0("true", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return k(env)
+	})
+	vm.Register0("loop", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return vm.Call(term.Atom("loop"), k, env)
+	})
+	vm.Register3("call_with_inference_limit", vm.CallWithInferenceLimit)
+	vm.Register1("foo", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return nondet.Delay(func(context.Context) *nondet.Promise {
+			return Unify(x, term.Atom("a"), k, env)
+		}, func(context.Context) *nondet.Promise {
+			return Unify(x, term.Atom("b"), k, env)
+		})
+	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		ok, err := vm.CallWithInferenceLimit(term.Atom("true"), term.Integer(10), term.Variable("R"), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Atom("!"), env.Resolve(term.Variable("R")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("nondeterministic", func(t *testing.T) {
+		var rs []term.Interface
+		ok, err := vm.CallWithInferenceLimit(&term.Compound{Functor: "foo", Args: []term.Interface{term.Variable("X")}}, term.Integer(10), term.Variable("R"), func(env *term.Env) *nondet.Promise {
+			rs = append(rs, &term.Compound{Functor: "-", Args: []term.Interface{env.Resolve(term.Variable("X")), env.Resolve(term.Variable("R"))}})
+			return nondet.Bool(false)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, []term.Interface{
+			&term.Compound{Functor: "-", Args: []term.Interface{term.Atom("a"), term.Atom("true")}},
+			&term.Compound{Functor: "-", Args: []term.Interface{term.Atom("b"), term.Atom("!")}},
+		}, rs)
+	})
+
+	t.Run("exceeded", func(t *testing.T) {
+		ok, err := vm.CallWithInferenceLimit(term.Atom("loop"), term.Integer(100), term.Variable("R"), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Atom("inference_limit_exceeded"), env.Resolve(term.Variable("R")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		// The outer limit is exceeded first.
+		ok, err := vm.CallWithInferenceLimit(&term.Compound{
+			Functor: "call_with_inference_limit",
+			Args:    []term.Interface{term.Atom("loop"), term.Integer(1000), term.Variable("Inner")},
+		}, term.Integer(100), term.Variable("Outer"), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Variable("Inner"), env.Resolve(term.Variable("Inner")))
+			assert.Equal(t, term.Atom("inference_limit_exceeded"), env.Resolve(term.Variable("Outer")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("backtrack with another context", func(t *testing.T) {
+		type key struct{}
+		var vm VM
+		vm.Register1("bar", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return nondet.Delay(func(context.Context) *nondet.Promise {
+				return Unify(x, term.Atom("a"), k, env)
+			}, func(ctx context.Context) *nondet.Promise {
+				return Unify(x, ctx.Value(key{}).(term.Atom), k, env)
+			})
+		})
+
+		var x term.Interface
+		it := vm.CallWithInferenceLimit(&term.Compound{Functor: "bar", Args: []term.Interface{term.Variable("X")}}, term.Integer(10), term.Variable("R"), func(env *term.Env) *nondet.Promise {
+			x = env.Resolve(term.Variable("X"))
+			return nondet.Bool(true)
+		}, nil).Iterator()
+		defer it.Close()
+
+		ok, err := it.Next(context.WithValue(context.Background(), key{}, term.Atom("b")))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, term.Atom("a"), x)
+
+		ok, err = it.Next(context.WithValue(context.Background(), key{}, term.Atom("c")))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, term.Atom("c"), x)
+	})
+
+	t.Run("limit is a variable", func(t *testing.T) {
+		_, err := vm.CallWithInferenceLimit(term.Atom("true"), term.Variable("L"), term.Variable("R"), Success, nil).Force(context.Background())
+		assert.Equal(t, instantiationError(term.Variable("L")), err)
+	})
+
+	t.Run("limit is not an integer", func(t *testing.T) {
+		_, err := vm.CallWithInferenceLimit(term.Atom("true"), term.Atom("foo"), term.Variable("R"), Success, nil).Force(context.Background())
+		assert.Equal(t, typeErrorInteger(term.Atom("foo")), err)
+	})
+
+	t.Run("limit is negative", func(t *testing.T) {
+		_, err := vm.CallWithInferenceLimit(term.Atom("true"), term.Integer(-1), term.Variable("R"), Success, nil).Force(context.Background())
+		assert.Equal(t, domainErrorNotLessThanZero(term.Integer(-1)), err)
+	})
+}
+
+func TestVM_CallWithTimeLimit(t *testing.T) {
+	var vm VM
+	vm.Register0("true", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return k(env)
+	})
+	vm.Register0("block", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+			<-ctx.Done()
+			return nondet.Error(&nondet.CanceledError{Err: ctx.Err()})
+		})
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		ok, err := vm.CallWithTimeLimit(term.Integer(1), term.Atom("true"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("exceeded", func(t *testing.T) {
+		_, err := vm.CallWithTimeLimit(term.Float(0.01), term.Atom("block"), Success, nil).Force(context.Background())
+		assert.Equal(t, timeLimitExceeded(), err)
+	})
+
+	t.Run("time is a variable", func(t *testing.T) {
+		_, err := vm.CallWithTimeLimit(term.Variable("T"), term.Atom("true"), Success, nil).Force(context.Background())
+		assert.Equal(t, instantiationError(term.Variable("T")), err)
+	})
+
+	t.Run("time is an expression", func(t *testing.T) {
+		ok, err := vm.CallWithTimeLimit(&term.Compound{Functor: "/", Args: []term.Interface{term.Integer(1), term.Integer(2)}}, term.Atom("true"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("time is not a number", func(t *testing.T) {
+		_, err := vm.CallWithTimeLimit(term.Atom("foo"), term.Atom("true"), Success, nil).Force(context.Background())
+		assert.Equal(t, typeErrorEvaluable(&term.Compound{Functor: "/", Args: []term.Interface{term.Atom("foo"), term.Integer(0)}}), err)
+	})
+
+	t.Run("time is negative", func(t *testing.T) {
+		_, err := vm.CallWithTimeLimit(term.Integer(-1), term.Atom("true"), Success, nil).Force(context.Background())
+		assert.Equal(t, domainErrorNotLessThanZero(term.Integer(-1)), err)
+
+		_, err = vm.CallWithTimeLimit(term.Float(-0.5), term.Atom("true"), Success, nil).Force(context.Background())
+		assert.Equal(t, domainErrorNotLessThanZero(term.Float(-0.5)), err)
+	})
+}
@@ -0,0 +1,288 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+)
+
+// FileSystem is the file system in which open/3 and open/4 open files.
+type FileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+}
+
+// File is a file opened by FileSystem.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// OSFileSystem is the file system of the OS.
+type OSFileSystem struct{}
+
+// OpenFile opens the named file with os.OpenFile.
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+// NoFileSystem is a file system in which no files can be opened.
+type NoFileSystem struct{}
+
+// OpenFile always fails with a permission error.
+func (NoFileSystem) OpenFile(name string, _ int, _ os.FileMode) (File, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
+
+// ReadOnlyFileSystem is a file system in which the files in FS can be opened for reading.
+type ReadOnlyFileSystem struct {
+	FS fs.FS
+}
+
+// OpenFile opens the named file in FS. It fails with a permission error unless flag is os.O_RDONLY.
+func (r ReadOnlyFileSystem) OpenFile(name string, flag int, _ os.FileMode) (File, error) {
+	if flag != os.O_RDONLY || !fs.ValidPath(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	f, err := r.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyFile{File: f}, nil
+}
+
+type readOnlyFile struct {
+	fs.File
+}
+
+func (f readOnlyFile) Write([]byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (vm *VM) fileSystem() FileSystem {
+	if vm.FS == nil {
+		return OSFileSystem{}
+	}
+	return vm.FS
+}
+
+// HaltSandboxed is halt/1 for a sandbox. Instead of stopping the query with *HaltError, it raises a permission error
+// which the rules can catch.
+func HaltSandboxed(n term.Interface, _ func(*term.Env) *nondet.Promise, _ *term.Env) *nondet.Promise {
+	return nondet.Error(permissionErrorSandboxed(&term.Compound{
+		Functor: "halt",
+		Args:    []term.Interface{n},
+	}))
+}
+
+// systemClauses are the clauses of a sealed procedure. Unlike clauses, they can't be modified.
+type systemClauses clauses
+
+func (cs systemClauses) Call(vm *VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return clauses(cs).Call(vm, args, k, env)
+}
+
+// Seal makes the procedures defined so far system procedures so that asserta/1, assertz/1, retract/1, abolish/1, and
+// dynamic/1 can't modify them.
+func (vm *VM) Seal() {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	for pi, p := range vm.procedures {
+		if cs, ok := p.(clauses); ok {
+			vm.procedures[pi] = systemClauses(cs[:len(cs):len(cs)])
+		}
+	}
+}
+
+// DeclareSafe declares the predicates registered by Register0-5, RegisterN, and RegisterProcedure safe to be called by
+// untrusted rules. safe_goal/1 rejects the other ones.
+func (vm *VM) DeclareSafe(pis ...ProcedureIndicator) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.safe == nil {
+		vm.safe = map[ProcedureIndicator]struct{}{}
+	}
+	for _, pi := range pis {
+		vm.safe[pi] = struct{}{}
+	}
+}
+
+// metaArgs are the positions of the arguments which the builtin predicates call as goals.
+var metaArgs = map[ProcedureIndicator][]int{
+	{Name: `\+`, Arity: 1}:                        {0},
+	{Name: "call", Arity: 1}:                      {0},
+	{Name: "findall", Arity: 3}:                   {1},
+	{Name: "bagof", Arity: 3}:                     {1},
+	{Name: "setof", Arity: 3}:                     {1},
+	{Name: "catch", Arity: 3}:                     {0, 2},
+	{Name: "setup_call_cleanup", Arity: 3}:        {0, 1, 2},
+	{Name: "call_with_inference_limit", Arity: 3}: {0},
+	{Name: "call_with_time_limit", Arity: 2}:      {1},
+	{Name: "reset", Arity: 3}:                     {0},
+}
+
+// maxSafeGoalDepth is the depth of calls after which safe_goal/1 stops following the arguments of the calls.
+const maxSafeGoalDepth = 64
+
+// SafeGoal succeeds if goal calls only the predicates which are safe for untrusted rules. It follows the clauses of
+// the user-defined predicates and the goals passed to the control constructs and the meta predicates. If it can't
+// tell which predicate is called, e.g. call(G) with G unbound, it raises an instantiation error. If goal may call an
+// unsafe predicate, it raises a permission error.
+func (vm *VM) SafeGoal(goal term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	c := safetyChecker{vm: vm, visited: map[string]struct{}{}}
+	if err := c.check(goal, 0, env); err != nil {
+		return nondet.Error(err)
+	}
+	return k(env)
+}
+
+type safetyChecker struct {
+	vm      *VM
+	visited map[string]struct{}
+}
+
+func (c *safetyChecker) check(goal term.Interface, depth int, env *term.Env) error {
+	pi, args, err := piArgs(goal, env)
+	if err != nil {
+		return err
+	}
+
+	switch pi {
+	case ProcedureIndicator{Name: ",", Arity: 2}, ProcedureIndicator{Name: ";", Arity: 2}, ProcedureIndicator{Name: "->", Arity: 2}, ProcedureIndicator{Name: "*->", Arity: 2}:
+		for _, a := range args {
+			if err := c.check(a, depth, env); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ProcedureIndicator{Name: "!", Arity: 0}:
+		return nil
+	case ProcedureIndicator{Name: "asserta", Arity: 1}, ProcedureIndicator{Name: "assertz", Arity: 1}:
+		// The asserted clause is going to be called without being checked.
+		switch t := env.Resolve(args[0]).(type) {
+		case term.Variable:
+			return instantiationError(args[0])
+		case *term.Compound:
+			// A directive is called right away.
+			if t.Functor == ":-" && len(t.Args) == 1 {
+				if err := c.check(t.Args[0], depth, env); err != nil {
+					return err
+				}
+				break
+			}
+			if err := c.check(term.Rulify(t, env).(*term.Compound).Args[1], depth, env); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.vm.mu.RLock()
+	p := c.vm.procedures[pi]
+	_, safe := c.vm.safe[pi]
+	c.vm.mu.RUnlock()
+
+	var cs clauses
+	switch p := p.(type) {
+	case nil:
+		// It raises an existence error or fails.
+		return nil
+	case clauses:
+		cs = p
+	case systemClauses:
+		cs = clauses(p)
+	default:
+		if !safe {
+			return permissionErrorSandboxed(env.Simplify(goal))
+		}
+		for _, i := range metaArgs[pi] {
+			g := args[i]
+			if pi.Name == "bagof" || pi.Name == "setof" {
+				g = stripExistentials(g, env)
+			}
+			if err := c.check(g, depth, env); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Beyond the depth, we don't follow the arguments so that the recursion terminates.
+	if depth >= maxSafeGoalDepth {
+		goal = generalize(pi)
+	}
+	key := variantKey(goal, env)
+	if _, ok := c.visited[key]; ok {
+		return nil
+	}
+	c.visited[key] = struct{}{}
+
+	for _, cl := range cs {
+		r := term.Rulify(copyTerm(cl.raw, nil, env), env).(*term.Compound)
+		env, ok := r.Args[0].Unify(goal, false, env)
+		if !ok {
+			continue
+		}
+		if err := c.check(r.Args[1], depth+1, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripExistentials returns the goal of V^Goal.
+func stripExistentials(goal term.Interface, env *term.Env) term.Interface {
+	for {
+		c, ok := env.Resolve(goal).(*term.Compound)
+		if !ok || c.Functor != "^" || len(c.Args) != 2 {
+			return goal
+		}
+		goal = c.Args[1]
+	}
+}
+
+// generalize returns the most general goal for pi.
+func generalize(pi ProcedureIndicator) term.Interface {
+	if pi.Arity == 0 {
+		return pi.Name
+	}
+	args := make([]term.Interface, pi.Arity)
+	for i := range args {
+		args[i] = term.NewVariable()
+	}
+	return &term.Compound{Functor: pi.Name, Args: args}
+}
+
+// variantKey returns a string which is the same for the terms which are variants of each other.
+func variantKey(t term.Interface, env *term.Env) string {
+	var sb strings.Builder
+	vars := map[term.Variable]int{}
+	ts := []term.Interface{t}
+	for len(ts) > 0 {
+		var t term.Interface
+		t, ts = ts[len(ts)-1], ts[:len(ts)-1]
+		switch t := env.Resolve(t).(type) {
+		case term.Variable:
+			n, ok := vars[t]
+			if !ok {
+				n = len(vars)
+				vars[t] = n
+			}
+			fmt.Fprintf(&sb, "_%d ", n)
+		case term.Atom:
+			fmt.Fprintf(&sb, "%q ", string(t))
+		case *term.Compound:
+			fmt.Fprintf(&sb, "%q/%d ", string(t.Functor), len(t.Args))
+			for i := len(t.Args) - 1; i >= 0; i-- {
+				ts = append(ts, t.Args[i])
+			}
+		default:
+			fmt.Fprintf(&sb, "%T(%v) ", t, t)
+		}
+	}
+	return sb.String()
+}
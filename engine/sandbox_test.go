@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoFileSystem(t *testing.T) {
+	vm := VM{FS: NoFileSystem{}}
+	_, err := vm.Open(term.Atom("/etc/passwd"), term.Atom("read"), term.Variable("S"), term.List(), Success, nil).Force(context.Background())
+	assert.Equal(t, permissionError(term.Atom("open"), term.Atom("source_sink"), term.Atom("/etc/passwd"), term.Atom("'/etc/passwd' cannot be opened.")), err)
+}
+
+func TestReadOnlyFileSystem(t *testing.T) {
+	vm := VM{FS: ReadOnlyFileSystem{FS: fstest.MapFS{
+		"foo.pl": &fstest.MapFile{Data: []byte("foo.\n")},
+	}}}
+
+	t.Run("read", func(t *testing.T) {
+		ok, err := vm.Open(term.Atom("foo.pl"), term.Atom("read"), term.Variable("S"), term.List(), func(env *term.Env) *nondet.Promise {
+			s, ok := env.Resolve(term.Variable("S")).(*term.Stream)
+			assert.True(t, ok)
+			b, err := ioutil.ReadAll(s.Source)
+			assert.NoError(t, err)
+			assert.Equal(t, "foo.\n", string(b))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("write", func(t *testing.T) {
+		_, err := vm.Open(term.Atom("foo.pl"), term.Atom("write"), term.Variable("S"), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, permissionError(term.Atom("open"), term.Atom("source_sink"), term.Atom("foo.pl"), term.Atom("'foo.pl' cannot be opened.")), err)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := vm.Open(term.Atom("bar.pl"), term.Atom("read"), term.Variable("S"), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorSourceSink(term.Atom("bar.pl")), err)
+	})
+
+	t.Run("outside", func(t *testing.T) {
+		_, err := vm.Open(term.Atom("../foo.pl"), term.Atom("read"), term.Variable("S"), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, permissionError(term.Atom("open"), term.Atom("source_sink"), term.Atom("../foo.pl"), term.Atom("'../foo.pl' cannot be opened.")), err)
+	})
+}
+
+func TestHaltSandboxed(t *testing.T) {
+	_, err := HaltSandboxed(term.Integer(0), Success, nil).Force(context.Background())
+	assert.Equal(t, permissionErrorSandboxed(&term.Compound{Functor: "halt", Args: []term.Interface{term.Integer(0)}}), err)
+}
+
+func TestVM_Seal(t *testing.T) {
+	var vm VM
+	vm.Register1("assertz", vm.Assertz)
+	vm.Register1("retract", vm.Retract)
+	_, err := vm.Assertz(term.Atom("foo"), Success, nil).Force(context.Background())
+	assert.NoError(t, err)
+
+	vm.Seal()
+
+	t.Run("call", func(t *testing.T) {
+		ok, err := vm.Call(term.Atom("foo"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("assertz", func(t *testing.T) {
+		_, err := vm.Assertz(term.Atom("foo"), Success, nil).Force(context.Background())
+		assert.Equal(t, permissionErrorModifyStaticProcedure(&term.Compound{
+			Functor: "/",
+			Args:    []term.Interface{term.Atom("foo"), term.Integer(0)},
+		}), err)
+	})
+
+	t.Run("retract", func(t *testing.T) {
+		_, err := vm.Retract(term.Atom("foo"), Success, nil).Force(context.Background())
+		assert.Equal(t, permissionErrorModifyStaticProcedure(&term.Compound{
+			Functor: "/",
+			Args:    []term.Interface{term.Atom("foo"), term.Integer(0)},
+		}), err)
+	})
+
+	t.Run("new procedure", func(t *testing.T) {
+		_, err := vm.Assertz(term.Atom("bar"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+	})
+}
+
+func TestVM_SafeGoal(t *testing.T) {
+	var vm VM
+	vm.Register1("call", vm.Call)
+	vm.Register3("findall", vm.FindAll)
+	vm.Register1("assertz", vm.Assertz)
+	vm.Register1("halt", Halt)
+	vm.Register0("true", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		return k(env)
+	})
+	vm.DeclareSafe(
+		ProcedureIndicator{Name: "call", Arity: 1},
+		ProcedureIndicator{Name: "findall", Arity: 3},
+		ProcedureIndicator{Name: "assertz", Arity: 1},
+		ProcedureIndicator{Name: "true", Arity: 0},
+	)
+	for _, c := range []term.Interface{
+		// once(G) :- G, !.
+		&term.Compound{Functor: ":-", Args: []term.Interface{
+			&term.Compound{Functor: "once", Args: []term.Interface{term.Variable("G")}},
+			&term.Compound{Functor: ",", Args: []term.Interface{term.Variable("G"), term.Atom("!")}},
+		}},
+		// loop :- loop.
+		&term.Compound{Functor: ":-", Args: []term.Interface{term.Atom("loop"), term.Atom("loop")}},
+		// nat(s(N)) :- nat(N).
+		&term.Compound{Functor: ":-", Args: []term.Interface{
+			&term.Compound{Functor: "nat", Args: []term.Interface{&term.Compound{Functor: "s", Args: []term.Interface{term.Variable("N")}}}},
+			&term.Compound{Functor: "nat", Args: []term.Interface{term.Variable("N")}},
+		}},
+		// bye :- halt(0).
+		&term.Compound{Functor: ":-", Args: []term.Interface{
+			term.Atom("bye"),
+			&term.Compound{Functor: "halt", Args: []term.Interface{term.Integer(0)}},
+		}},
+	} {
+		_, err := vm.Assertz(c, Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+	}
+
+	t.Run("safe", func(t *testing.T) {
+		for _, g := range []term.Interface{
+			term.Atom("true"),
+			term.Atom("loop"),
+			term.Atom("undefined"),
+			&term.Compound{Functor: "once", Args: []term.Interface{term.Atom("true")}},
+			&term.Compound{Functor: "nat", Args: []term.Interface{term.Variable("X")}},
+			&term.Compound{Functor: "findall", Args: []term.Interface{term.Variable("X"), &term.Compound{Functor: "call", Args: []term.Interface{term.Atom("loop")}}, term.Variable("L")}},
+			&term.Compound{Functor: "assertz", Args: []term.Interface{&term.Compound{Functor: ":-", Args: []term.Interface{term.Atom("foo"), term.Atom("true")}}}},
+		} {
+			ok, err := vm.SafeGoal(g, Success, nil).Force(context.Background())
+			assert.NoError(t, err, g)
+			assert.True(t, ok)
+		}
+	})
+
+	t.Run("unsafe", func(t *testing.T) {
+		halt := &term.Compound{Functor: "halt", Args: []term.Interface{term.Integer(0)}}
+		for _, g := range []term.Interface{
+			halt,
+			term.Atom("bye"),
+			&term.Compound{Functor: "once", Args: []term.Interface{term.Atom("bye")}},
+			&term.Compound{Functor: ";", Args: []term.Interface{term.Atom("true"), halt}},
+			&term.Compound{Functor: "findall", Args: []term.Interface{term.Variable("X"), halt, term.Variable("L")}},
+			&term.Compound{Functor: "assertz", Args: []term.Interface{&term.Compound{Functor: ":-", Args: []term.Interface{term.Atom("foo"), halt}}}},
+		} {
+			_, err := vm.SafeGoal(g, Success, nil).Force(context.Background())
+			assert.Equal(t, permissionErrorSandboxed(halt), err, g)
+		}
+	})
+
+	t.Run("unknown clause", func(t *testing.T) {
+		_, err := vm.SafeGoal(&term.Compound{Functor: "assertz", Args: []term.Interface{term.Variable("C")}}, Success, nil).Force(context.Background())
+		assert.Equal(t, instantiationError(term.Variable("C")), err)
+
+		_, err = vm.SafeGoal(&term.Compound{Functor: "assertz", Args: []term.Interface{&term.Compound{Functor: ":-", Args: []term.Interface{term.Atom("foo"), term.Variable("B")}}}}, Success, nil).Force(context.Background())
+		assert.Equal(t, instantiationError(term.Variable("B")), err)
+	})
+
+	t.Run("unknown goal", func(t *testing.T) {
+		_, err := vm.SafeGoal(&term.Compound{Functor: "once", Args: []term.Interface{term.Variable("G")}}, Success, nil).Force(context.Background())
+		assert.Error(t, err)
+	})
+}
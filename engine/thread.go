@@ -0,0 +1,582 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+)
+
+// Thread is a Prolog thread which runs a goal on its own goroutine.
+type Thread struct {
+	Alias term.Atom
+
+	queue  Queue
+	cancel context.CancelFunc
+	done   chan struct{}
+	status term.Interface
+	joined bool
+
+	mu      sync.Mutex
+	engines map[*Engine]struct{} // the engines created in the thread which are not destroyed yet.
+}
+
+func (t *Thread) String() string {
+	var buf bytes.Buffer
+	_ = t.WriteTerm(&buf, term.DefaultWriteTermOptions, nil)
+	return buf.String()
+}
+
+// WriteTerm writes the thread into w.
+func (t *Thread) WriteTerm(w io.Writer, _ term.WriteTermOptions, _ *term.Env) error {
+	if t.Alias != "" {
+		_, err := fmt.Fprintf(w, "<thread>(%s)", t.Alias)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "<thread>(%p)", t)
+	return err
+}
+
+// Unify unifies the thread with x.
+func (t *Thread) Unify(x term.Interface, occursCheck bool, env *term.Env) (*term.Env, bool) {
+	switch x := env.Resolve(x).(type) {
+	case *Thread:
+		return env, t == x
+	case term.Variable:
+		return x.Unify(t, occursCheck, env)
+	default:
+		return env, false
+	}
+}
+
+// id returns the alias of the thread if any. Otherwise, the thread itself.
+func (t *Thread) id() term.Interface {
+	if t.Alias != "" {
+		return t.Alias
+	}
+	return t
+}
+
+// Queue is a message queue.
+type Queue struct {
+	mu       sync.Mutex
+	messages []term.Interface
+	changed  chan struct{} // closed when a message is added.
+}
+
+func (q *Queue) String() string {
+	var buf bytes.Buffer
+	_ = q.WriteTerm(&buf, term.DefaultWriteTermOptions, nil)
+	return buf.String()
+}
+
+// WriteTerm writes the message queue into w.
+func (q *Queue) WriteTerm(w io.Writer, _ term.WriteTermOptions, _ *term.Env) error {
+	_, err := fmt.Fprintf(w, "<message_queue>(%p)", q)
+	return err
+}
+
+// Unify unifies the message queue with x.
+func (q *Queue) Unify(x term.Interface, occursCheck bool, env *term.Env) (*term.Env, bool) {
+	switch x := env.Resolve(x).(type) {
+	case *Queue:
+		return env, q == x
+	case term.Variable:
+		return x.Unify(q, occursCheck, env)
+	default:
+		return env, false
+	}
+}
+
+func (q *Queue) send(msg term.Interface) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = append(q.messages, msg)
+	if q.changed != nil {
+		close(q.changed)
+		q.changed = nil
+	}
+}
+
+// receive removes the first message which unifies with pattern. It blocks until such a message arrives.
+func (q *Queue) receive(ctx context.Context, pattern term.Interface, env *term.Env) (*term.Env, error) {
+	for {
+		q.mu.Lock()
+		for i, m := range q.messages {
+			if env, ok := pattern.Unify(m, false, env); ok {
+				q.messages = append(q.messages[:i], q.messages[i+1:]...)
+				q.mu.Unlock()
+				return env, nil
+			}
+		}
+		if q.changed == nil {
+			q.changed = make(chan struct{})
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, &nondet.CanceledError{Err: ctx.Err()}
+		}
+	}
+}
+
+// Mutex is a recursive mutex owned by a thread.
+type Mutex struct {
+	Alias term.Atom
+
+	mu       sync.Mutex
+	owner    *Thread
+	count    int
+	unlocked chan struct{} // closed when the mutex is released.
+}
+
+func (m *Mutex) String() string {
+	var buf bytes.Buffer
+	_ = m.WriteTerm(&buf, term.DefaultWriteTermOptions, nil)
+	return buf.String()
+}
+
+// WriteTerm writes the mutex into w.
+func (m *Mutex) WriteTerm(w io.Writer, _ term.WriteTermOptions, _ *term.Env) error {
+	if m.Alias != "" {
+		_, err := fmt.Fprintf(w, "<mutex>(%s)", m.Alias)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "<mutex>(%p)", m)
+	return err
+}
+
+// Unify unifies the mutex with x.
+func (m *Mutex) Unify(x term.Interface, occursCheck bool, env *term.Env) (*term.Env, bool) {
+	switch x := env.Resolve(x).(type) {
+	case *Mutex:
+		return env, m == x
+	case term.Variable:
+		return x.Unify(m, occursCheck, env)
+	default:
+		return env, false
+	}
+}
+
+func (m *Mutex) lock(ctx context.Context, t *Thread) error {
+	for {
+		m.mu.Lock()
+		if m.owner == nil || m.owner == t {
+			m.owner = t
+			m.count++
+			m.mu.Unlock()
+			return nil
+		}
+		if m.unlocked == nil {
+			m.unlocked = make(chan struct{})
+		}
+		unlocked := m.unlocked
+		m.mu.Unlock()
+
+		select {
+		case <-unlocked:
+		case <-ctx.Done():
+			return &nondet.CanceledError{Err: ctx.Err()}
+		}
+	}
+}
+
+func (m *Mutex) unlock(t *Thread) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.owner != t {
+		return false
+	}
+	m.count--
+	if m.count > 0 {
+		return true
+	}
+	m.owner = nil
+	if m.unlocked != nil {
+		close(m.unlocked)
+		m.unlocked = nil
+	}
+	return true
+}
+
+type threadKey struct{}
+
+// WithThread returns a context in which goals run as a thread of their own and a function which ends the thread. The
+// thread can't be joined. The top-level queries of an interpreter run this way so that they don't share the mutexes
+// and the message queue. Ending the thread destroys the engines created in it.
+func WithThread(ctx context.Context) (context.Context, func()) {
+	var t Thread
+	return context.WithValue(ctx, threadKey{}, &t), t.exit
+}
+
+// own makes the engine be destroyed when the thread ends.
+func (t *Thread) own(e *Engine) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.engines == nil {
+		t.engines = map[*Engine]struct{}{}
+	}
+	t.engines[e] = struct{}{}
+	e.owner = t
+}
+
+// exit ends the thread and destroys the engines created in it.
+func (t *Thread) exit() {
+	t.mu.Lock()
+	es := make([]*Engine, 0, len(t.engines))
+	for e := range t.engines {
+		es = append(es, e)
+	}
+	t.mu.Unlock()
+
+	for _, e := range es {
+		e.destroy()
+	}
+}
+
+// self returns the thread running the goal. Outside of threads created by thread_create/3 or WithThread, it's the
+// main thread.
+func (vm *VM) self(ctx context.Context) *Thread {
+	if t, ok := ctx.Value(threadKey{}).(*Thread); ok {
+		return t
+	}
+	return vm.mainThread()
+}
+
+func (vm *VM) mainThread() *Thread {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.main == nil {
+		vm.main = &Thread{Alias: "main"}
+	}
+	return vm.main
+}
+
+// ThreadCreate runs goal on a new thread and unifies id with the thread. The thread runs with the context of the
+// caller so that it's canceled along with the caller. It's limited by the limits of the caller's query afresh, not by
+// what's left of them.
+func (vm *VM) ThreadCreate(goal, id, options term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	if _, _, err := piArgs(goal, env); err != nil {
+		return nondet.Error(err)
+	}
+
+	if _, ok := env.Resolve(id).(term.Variable); !ok {
+		return nondet.Error(typeErrorVariable(id))
+	}
+
+	t := Thread{done: make(chan struct{})}
+	if err := Each(env.Resolve(options), func(option term.Interface) error {
+		switch o := env.Resolve(option).(type) {
+		case term.Variable:
+			return instantiationError(option)
+		case *term.Compound:
+			if o.Functor != "alias" || len(o.Args) != 1 {
+				return domainErrorThreadOption(option)
+			}
+			switch a := env.Resolve(o.Args[0]).(type) {
+			case term.Variable:
+				return instantiationError(o.Args[0])
+			case term.Atom:
+				t.Alias = a
+				return nil
+			default:
+				return typeErrorAtom(a)
+			}
+		default:
+			return domainErrorThreadOption(option)
+		}
+	}, env); err != nil {
+		return nondet.Error(err)
+	}
+
+	if t.Alias != "" {
+		vm.mu.Lock()
+		if _, ok := vm.threads[t.Alias]; ok || t.Alias == "main" {
+			vm.mu.Unlock()
+			return nondet.Error(permissionErrorCreateThread(t.Alias))
+		}
+		if vm.threads == nil {
+			vm.threads = map[term.Atom]*Thread{}
+		}
+		vm.threads[t.Alias] = &t
+		vm.mu.Unlock()
+	}
+
+	goal = copyTerm(goal, nil, env)
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		ctx, t.cancel = context.WithCancel(vm.Limit(unlimited(afresh(ctx))))
+		ctx = context.WithValue(ctx, threadKey{}, &t)
+
+		vm.mu.Lock()
+		if vm.running == nil {
+			vm.running = map[*Thread]struct{}{}
+		}
+		vm.running[&t] = struct{}{}
+		vm.mu.Unlock()
+
+		go func() {
+			defer close(t.done)
+			defer t.exit()
+			defer func() {
+				vm.mu.Lock()
+				delete(vm.running, &t)
+				vm.mu.Unlock()
+				t.cancel()
+			}()
+			ok, err := vm.Call(goal, Success, nil).Force(ctx)
+			var h *HaltError
+			switch {
+			case errors.As(err, &h):
+				// halt/1 ends the thread, not the process nor the query which created the thread.
+				t.status = &term.Compound{Functor: "exited", Args: []term.Interface{
+					&term.Compound{Functor: "halt", Args: []term.Interface{term.Integer(h.Code)}},
+				}}
+			case err != nil:
+				ex, ok := err.(*Exception)
+				if !ok {
+					ex = systemError(err)
+				}
+				t.status = &term.Compound{Functor: "exception", Args: []term.Interface{ex.Term}}
+			case ok:
+				t.status = term.Atom("true")
+			default:
+				t.status = term.Atom("false")
+			}
+		}()
+
+		return Unify(id, t.id(), k, env)
+	})
+}
+
+// CancelThreads cancels the threads created by thread_create/3 which are still running. Their status becomes
+// exception(E) where E is a system error.
+func (vm *VM) CancelThreads() {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	for t := range vm.running {
+		t.cancel()
+	}
+}
+
+// ThreadJoin waits for the thread to terminate and unifies status with its result, true, false, exception(E), or
+// exited(halt(N)) if the thread called halt/1.
+func (vm *VM) ThreadJoin(id, status term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	t, err := vm.thread(id, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		// Only the threads created by thread_create/3 can be joined.
+		if t == vm.self(ctx) || t.done == nil {
+			return nondet.Error(permissionErrorJoinThread(id))
+		}
+
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			return nondet.Error(&nondet.CanceledError{Err: ctx.Err()})
+		}
+
+		vm.mu.Lock()
+		if t.joined {
+			vm.mu.Unlock()
+			return nondet.Error(existenceErrorThread(id))
+		}
+		t.joined = true
+		if t.Alias != "" {
+			delete(vm.threads, t.Alias)
+		}
+		vm.mu.Unlock()
+
+		return Unify(status, t.status, k, env)
+	})
+}
+
+// ThreadSelf unifies id with the thread running the goal.
+func (vm *VM) ThreadSelf(id term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		return Unify(id, vm.self(ctx).id(), k, env)
+	})
+}
+
+// ThreadSendMessage puts a copy of msg into the message queue of a thread or a message queue.
+func (vm *VM) ThreadSendMessage(queueOrThread, msg term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	q, err := vm.queue(queueOrThread, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	q.send(copyTerm(msg, nil, env))
+	return k(env)
+}
+
+// ThreadGetMessage removes the first message which unifies with msg from the message queue of a thread or a message
+// queue. If there's no such message, it waits for one.
+func (vm *VM) ThreadGetMessage(queueOrThread, msg term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	q, err := vm.queue(queueOrThread, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		env, err := q.receive(ctx, msg, env)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		return k(env)
+	})
+}
+
+// MessageQueueCreate creates a new message queue and unifies queue with it.
+func (vm *VM) MessageQueueCreate(queue term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	if _, ok := env.Resolve(queue).(term.Variable); !ok {
+		return nondet.Error(typeErrorVariable(queue))
+	}
+	return Unify(queue, &Queue{}, k, env)
+}
+
+// MutexCreate creates a new mutex and unifies mutex with it.
+func (vm *VM) MutexCreate(mutex term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	if _, ok := env.Resolve(mutex).(term.Variable); !ok {
+		return nondet.Error(typeErrorVariable(mutex))
+	}
+	return Unify(mutex, &Mutex{}, k, env)
+}
+
+// MutexLock locks the mutex. If the mutex is locked by another thread, it waits for the mutex to be unlocked.
+func (vm *VM) MutexLock(mutex term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	m, err := vm.mutex(mutex, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		if err := m.lock(ctx, vm.self(ctx)); err != nil {
+			return nondet.Error(err)
+		}
+		return k(env)
+	})
+}
+
+// MutexUnlock unlocks the mutex locked by the current thread.
+func (vm *VM) MutexUnlock(mutex term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	m, err := vm.mutex(mutex, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		if !m.unlock(vm.self(ctx)) {
+			return nondet.Error(permissionErrorUnlockMutex(mutex))
+		}
+		return k(env)
+	})
+}
+
+// WithMutex runs goal once while holding the mutex.
+func (vm *VM) WithMutex(mutex, goal term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	m, err := vm.mutex(mutex, env)
+	if err != nil {
+		return nondet.Error(err)
+	}
+
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		t := vm.self(ctx)
+		if err := m.lock(ctx, t); err != nil {
+			return nondet.Error(err)
+		}
+
+		var solution *term.Env
+		ok, err := vm.nested(goal, func(env *term.Env) *nondet.Promise {
+			solution = env
+			return nondet.Bool(true)
+		}, env).Force(ctx)
+		m.unlock(t)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		if !ok {
+			return nondet.Bool(false)
+		}
+		return k(solution)
+	})
+}
+
+func (vm *VM) thread(threadOrAlias term.Interface, env *term.Env) (*Thread, error) {
+	switch t := env.Resolve(threadOrAlias).(type) {
+	case term.Variable:
+		return nil, instantiationError(threadOrAlias)
+	case term.Atom:
+		if t == "main" {
+			return vm.mainThread(), nil
+		}
+		vm.mu.RLock()
+		v, ok := vm.threads[t]
+		vm.mu.RUnlock()
+		if !ok {
+			return nil, existenceErrorThread(threadOrAlias)
+		}
+		return v, nil
+	case *Thread:
+		return t, nil
+	default:
+		return nil, domainErrorThreadOrAlias(threadOrAlias)
+	}
+}
+
+func (vm *VM) queue(queueOrAlias term.Interface, env *term.Env) (*Queue, error) {
+	switch q := env.Resolve(queueOrAlias).(type) {
+	case term.Variable:
+		return nil, instantiationError(queueOrAlias)
+	case term.Atom:
+		if q == "main" {
+			return &vm.mainThread().queue, nil
+		}
+		vm.mu.RLock()
+		t, ok := vm.threads[q]
+		vm.mu.RUnlock()
+		if !ok {
+			return nil, existenceErrorQueue(queueOrAlias)
+		}
+		return &t.queue, nil
+	case *Thread:
+		return &q.queue, nil
+	case *Queue:
+		return q, nil
+	default:
+		return nil, domainErrorQueueOrAlias(queueOrAlias)
+	}
+}
+
+func (vm *VM) mutex(mutexOrAlias term.Interface, env *term.Env) (*Mutex, error) {
+	switch m := env.Resolve(mutexOrAlias).(type) {
+	case term.Variable:
+		return nil, instantiationError(mutexOrAlias)
+	case term.Atom:
+		// Mutexes with aliases are created on demand.
+		vm.mu.Lock()
+		defer vm.mu.Unlock()
+		if vm.mutexes == nil {
+			vm.mutexes = map[term.Atom]*Mutex{}
+		}
+		v, ok := vm.mutexes[m]
+		if !ok {
+			v = &Mutex{Alias: m}
+			vm.mutexes[m] = v
+		}
+		return v, nil
+	case *Mutex:
+		return m, nil
+	default:
+		return nil, domainErrorMutexOrAlias(mutexOrAlias)
+	}
+}
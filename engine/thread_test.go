@@ -0,0 +1,396 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVM_ThreadCreate(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		var vm VM
+		vm.Register1("foo", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return Unify(x, term.Atom("a"), k, env)
+		})
+
+		var id term.Interface
+		ok, err := vm.ThreadCreate(&term.Compound{Functor: "foo", Args: []term.Interface{term.Variable("X")}}, term.Variable("ID"), term.List(), func(env *term.Env) *nondet.Promise {
+			id = env.Resolve(term.Variable("ID"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.IsType(t, &Thread{}, id)
+
+		ok, err = vm.ThreadJoin(id, term.Atom("true"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("halt", func(t *testing.T) {
+		var vm VM
+		vm.Register1("halt", Halt)
+
+		var id term.Interface
+		_, err := vm.ThreadCreate(&term.Compound{Functor: "halt", Args: []term.Interface{term.Integer(2)}}, term.Variable("ID"), term.List(), func(env *term.Env) *nondet.Promise {
+			id = env.Resolve(term.Variable("ID"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+
+		ok, err := vm.ThreadJoin(id, &term.Compound{Functor: "exited", Args: []term.Interface{
+			&term.Compound{Functor: "halt", Args: []term.Interface{term.Integer(2)}},
+		}}, Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("alias", func(t *testing.T) {
+		var vm VM
+		vm.Register0("foo", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return nondet.Bool(false)
+		})
+
+		ok, err := vm.ThreadCreate(term.Atom("foo"), term.Variable("ID"), term.List(&term.Compound{
+			Functor: "alias",
+			Args:    []term.Interface{term.Atom("bar")},
+		}), func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Atom("bar"), env.Resolve(term.Variable("ID")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		t.Run("already in use", func(t *testing.T) {
+			_, err := vm.ThreadCreate(term.Atom("foo"), term.Variable("ID"), term.List(&term.Compound{
+				Functor: "alias",
+				Args:    []term.Interface{term.Atom("bar")},
+			}), Success, nil).Force(context.Background())
+			assert.Equal(t, permissionErrorCreateThread(term.Atom("bar")), err)
+		})
+
+		ok, err = vm.ThreadJoin(term.Atom("bar"), term.Atom("false"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		t.Run("joined", func(t *testing.T) {
+			_, err := vm.ThreadJoin(term.Atom("bar"), term.Variable("Status"), Success, nil).Force(context.Background())
+			assert.Equal(t, existenceErrorThread(term.Atom("bar")), err)
+		})
+	})
+
+	t.Run("exception", func(t *testing.T) {
+		var vm VM
+		vm.Register0("foo", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return nondet.Error(&Exception{Term: term.Atom("oops")})
+		})
+
+		var id term.Interface
+		_, err := vm.ThreadCreate(term.Atom("foo"), term.Variable("ID"), term.List(), func(env *term.Env) *nondet.Promise {
+			id = env.Resolve(term.Variable("ID"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+
+		ok, err := vm.ThreadJoin(id, &term.Compound{Functor: "exception", Args: []term.Interface{term.Atom("oops")}}, Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		var vm VM
+		vm.Register0("loop", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return nondet.Repeat(func(context.Context) *nondet.Promise {
+				return nondet.Bool(false)
+			})
+		})
+		create := func(ctx context.Context) term.Interface {
+			var id term.Interface
+			_, err := vm.ThreadCreate(term.Atom("loop"), term.Variable("ID"), term.List(), func(env *term.Env) *nondet.Promise {
+				id = env.Resolve(term.Variable("ID"))
+				return nondet.Bool(true)
+			}, nil).Force(ctx)
+			assert.NoError(t, err)
+			return id
+		}
+		status := func(id term.Interface) term.Interface {
+			var s term.Interface
+			_, err := vm.ThreadJoin(id, term.Variable("Status"), func(env *term.Env) *nondet.Promise {
+				s = env.Resolve(term.Variable("Status"))
+				return nondet.Bool(true)
+			}, nil).Force(context.Background())
+			assert.NoError(t, err)
+			return s
+		}
+
+		t.Run("by the caller", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			id := create(ctx)
+			cancel()
+			assert.Equal(t, term.Atom("exception"), status(id).(*term.Compound).Functor)
+		})
+
+		t.Run("by CancelThreads", func(t *testing.T) {
+			id := create(context.Background())
+			vm.CancelThreads()
+			assert.Equal(t, term.Atom("exception"), status(id).(*term.Compound).Functor)
+		})
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		vm := VM{Limits: Limits{Inferences: 100}}
+		vm.Register0("loop", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return vm.Call(term.Atom("loop"), k, env)
+		})
+
+		ok, err := vm.ThreadCreate(term.Atom("loop"), term.Variable("ID"), term.List(), func(env *term.Env) *nondet.Promise {
+			return vm.ThreadJoin(env.Resolve(term.Variable("ID")), &term.Compound{
+				Functor: "exception",
+				Args:    []term.Interface{resourceErrorInferences().Term},
+			}, Success, env)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("goal is a variable", func(t *testing.T) {
+		var vm VM
+		_, err := vm.ThreadCreate(term.Variable("G"), term.Variable("ID"), term.List(), Success, nil).Force(context.Background())
+		assert.Equal(t, instantiationError(term.Variable("G")), err)
+	})
+
+	t.Run("unknown option", func(t *testing.T) {
+		var vm VM
+		_, err := vm.ThreadCreate(term.Atom("true"), term.Variable("ID"), term.List(term.Atom("foo")), Success, nil).Force(context.Background())
+		assert.Equal(t, domainErrorThreadOption(term.Atom("foo")), err)
+	})
+}
+
+func TestVM_ThreadJoin(t *testing.T) {
+	t.Run("self", func(t *testing.T) {
+		var vm VM
+		_, err := vm.ThreadJoin(term.Atom("main"), term.Variable("Status"), Success, nil).Force(context.Background())
+		assert.Equal(t, permissionErrorJoinThread(term.Atom("main")), err)
+	})
+
+	t.Run("unknown thread", func(t *testing.T) {
+		var vm VM
+		_, err := vm.ThreadJoin(term.Atom("foo"), term.Variable("Status"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorThread(term.Atom("foo")), err)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		var vm VM
+		block := make(chan struct{})
+		defer close(block)
+		vm.Register0("block", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			<-block
+			return k(env)
+		})
+
+		var id term.Interface
+		_, err := vm.ThreadCreate(term.Atom("block"), term.Variable("ID"), term.List(), func(env *term.Env) *nondet.Promise {
+			id = env.Resolve(term.Variable("ID"))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = vm.ThreadJoin(id, term.Variable("Status"), Success, nil).Force(ctx)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+}
+
+func TestVM_ThreadSelf(t *testing.T) {
+	var vm VM
+	ok, err := vm.ThreadSelf(term.Atom("main"), Success, nil).Force(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	t.Run("with thread", func(t *testing.T) {
+		ctx, exit := WithThread(context.Background())
+		defer exit()
+		ok, err := vm.ThreadSelf(term.Atom("main"), Success, nil).Force(ctx)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		var self term.Interface
+		ok, err = vm.ThreadSelf(term.Variable("Self"), func(env *term.Env) *nondet.Promise {
+			self = env.Resolve(term.Variable("Self"))
+			return nondet.Bool(true)
+		}, nil).Force(ctx)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, ctx.Value(threadKey{}), self)
+
+		other, exitOther := WithThread(context.Background())
+		defer exitOther()
+		_, err = vm.ThreadJoin(self, term.Variable("Status"), Success, nil).Force(other)
+		assert.Equal(t, permissionErrorJoinThread(self), err)
+	})
+}
+
+func TestVM_ThreadSendMessage(t *testing.T) {
+	t.Run("queue", func(t *testing.T) {
+		var vm VM
+		q := &Queue{}
+		env := term.NewEnv().Bind("X", term.Atom("a"))
+
+		ok, err := vm.ThreadSendMessage(q, &term.Compound{Functor: "foo", Args: []term.Interface{term.Variable("X"), term.Variable("Y")}}, Success, env).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		assert.Len(t, q.messages, 1)
+		m, ok := q.messages[0].(*term.Compound)
+		assert.True(t, ok)
+		assert.Equal(t, term.Atom("a"), m.Args[0])
+		assert.NotEqual(t, term.Variable("Y"), m.Args[1])
+	})
+
+	t.Run("unknown queue", func(t *testing.T) {
+		var vm VM
+		_, err := vm.ThreadSendMessage(term.Atom("foo"), term.Atom("a"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorQueue(term.Atom("foo")), err)
+	})
+
+	t.Run("not a queue", func(t *testing.T) {
+		var vm VM
+		_, err := vm.ThreadSendMessage(term.Integer(1), term.Atom("a"), Success, nil).Force(context.Background())
+		assert.Equal(t, domainErrorQueueOrAlias(term.Integer(1)), err)
+	})
+}
+
+func TestVM_ThreadGetMessage(t *testing.T) {
+	t.Run("first unifiable message", func(t *testing.T) {
+		var vm VM
+		q := &Queue{messages: []term.Interface{
+			&term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("a")}},
+			&term.Compound{Functor: "bar", Args: []term.Interface{term.Atom("b")}},
+			&term.Compound{Functor: "bar", Args: []term.Interface{term.Atom("c")}},
+		}}
+
+		ok, err := vm.ThreadGetMessage(q, &term.Compound{Functor: "bar", Args: []term.Interface{term.Variable("X")}}, func(env *term.Env) *nondet.Promise {
+			assert.Equal(t, term.Atom("b"), env.Resolve(term.Variable("X")))
+			return nondet.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, []term.Interface{
+			&term.Compound{Functor: "foo", Args: []term.Interface{term.Atom("a")}},
+			&term.Compound{Functor: "bar", Args: []term.Interface{term.Atom("c")}},
+		}, q.messages)
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		var vm VM
+		q := &Queue{}
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			q.send(term.Atom("a"))
+		}()
+
+		ok, err := vm.ThreadGetMessage(q, term.Atom("a"), Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		var vm VM
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := vm.ThreadGetMessage(&Queue{}, term.Atom("a"), Success, nil).Force(ctx)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+}
+
+func TestVM_MessageQueueCreate(t *testing.T) {
+	var vm VM
+	ok, err := vm.MessageQueueCreate(term.Variable("Q"), func(env *term.Env) *nondet.Promise {
+		assert.IsType(t, &Queue{}, env.Resolve(term.Variable("Q")))
+		return nondet.Bool(true)
+	}, nil).Force(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = vm.MessageQueueCreate(term.Atom("foo"), Success, nil).Force(context.Background())
+	assert.Equal(t, typeErrorVariable(term.Atom("foo")), err)
+}
+
+func TestVM_MutexLock(t *testing.T) {
+	t.Run("recursive", func(t *testing.T) {
+		var vm VM
+		ok, err := vm.MutexLock(term.Atom("foo"), func(env *term.Env) *nondet.Promise {
+			return vm.MutexLock(term.Atom("foo"), func(env *term.Env) *nondet.Promise {
+				return vm.MutexUnlock(term.Atom("foo"), func(env *term.Env) *nondet.Promise {
+					return vm.MutexUnlock(term.Atom("foo"), Success, env)
+				}, env)
+			}, env)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("locked by another thread", func(t *testing.T) {
+		var vm VM
+		m, err := vm.mutex(term.Atom("foo"), nil)
+		assert.NoError(t, err)
+		assert.NoError(t, m.lock(context.Background(), &Thread{}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = vm.MutexLock(term.Atom("foo"), Success, nil).Force(ctx)
+		assert.Error(t, err)
+	})
+}
+
+func TestVM_MutexUnlock(t *testing.T) {
+	var vm VM
+	_, err := vm.MutexUnlock(term.Atom("foo"), Success, nil).Force(context.Background())
+	assert.Equal(t, permissionErrorUnlockMutex(term.Atom("foo")), err)
+}
+
+func TestVM_WithMutex(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		var vm VM
+		vm.Register1("foo", func(x term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return nondet.Delay(func(context.Context) *nondet.Promise {
+				return Unify(x, term.Atom("a"), k, env)
+			}, func(context.Context) *nondet.Promise {
+				return Unify(x, term.Atom("b"), k, env)
+			})
+		})
+
+		var xs []term.Interface
+		ok, err := vm.WithMutex(term.Atom("m"), &term.Compound{Functor: "foo", Args: []term.Interface{term.Variable("X")}}, func(env *term.Env) *nondet.Promise {
+			xs = append(xs, env.Resolve(term.Variable("X")))
+			return nondet.Bool(false)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, []term.Interface{term.Atom("a")}, xs)
+
+		m, err := vm.mutex(term.Atom("m"), nil)
+		assert.NoError(t, err)
+		assert.Nil(t, m.owner)
+	})
+
+	t.Run("exception", func(t *testing.T) {
+		var vm VM
+		_, err := vm.WithMutex(term.Atom("m"), term.Atom("foo"), Success, nil).Force(context.Background())
+		assert.Equal(t, existenceErrorProcedure(&term.Compound{
+			Functor: "/",
+			Args:    []term.Interface{term.Atom("foo"), term.Integer(0)},
+		}), err)
+
+		m, err := vm.mutex(term.Atom("m"), nil)
+		assert.NoError(t, err)
+		assert.Nil(t, m.owner)
+	})
+}
@@ -7,6 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/ichiban/prolog/nondet"
 	"github.com/ichiban/prolog/term"
@@ -16,7 +18,7 @@ type bytecode []instruction
 
 type instruction struct {
 	opcode  opcode
-	operand byte
+	operand int
 }
 
 type opcode byte
@@ -32,6 +34,14 @@ const (
 	opPop
 
 	opCut
+	opFail
+	opJump
+	opDisj
+	opIf
+	opSoftIf
+	opThen
+	opBarrier
+	opLeave
 
 	_opLen
 )
@@ -47,10 +57,19 @@ func (o opcode) String() string {
 		opFunctor: "functor",
 		opPop:     "pop",
 		opCut:     "cut",
+		opFail:    "fail",
+		opJump:    "jump",
+		opDisj:    "disj",
+		opIf:      "if",
+		opSoftIf:  "soft_if",
+		opThen:    "then",
+		opBarrier: "barrier",
+		opLeave:   "leave",
 	}[o]
 }
 
 // VM is the core of a Prolog interpreter. The zero value for VM is a valid VM without any builtin predicates.
+// VM is safe for concurrent queries once the callbacks below are set and the builtin predicates are registered.
 type VM struct {
 	// OnCall is a callback that is triggered when the VM reaches to the predicate.
 	OnCall func(pi ProcedureIndicator, args []term.Interface, env *term.Env)
@@ -67,9 +86,24 @@ type VM struct {
 	// OnUnknown is a callback that is triggered when the VM reaches to an unknown predicate and also current_prolog_flag(unknown, warning).
 	OnUnknown func(pi ProcedureIndicator, args []term.Interface, env *term.Env)
 
+	// Limits are the default limits on the resources which a query consumes.
+	Limits Limits
+
+	// FS is the file system in which open/3 and open/4 open files. If nil, it's the file system of the OS.
+	FS FileSystem
+
+	// CleanupTimeout is how long a cleanup of setup_call_cleanup/3 may keep running after the query is canceled or
+	// exceeds its deadline. If zero, it's DefaultCleanupTimeout.
+	CleanupTimeout time.Duration
+
+	// mu protects the fields below. Clauses and operators are copy-on-write so that running queries see a snapshot
+	// of them (logical update view).
+	mu sync.RWMutex
+
 	// Core
-	procedures map[ProcedureIndicator]procedure
+	procedures map[ProcedureIndicator]Procedure
 	unknown    unknownAction
+	safe       map[ProcedureIndicator]struct{}
 
 	// Internal/external expression
 	operators       term.Operators
@@ -81,6 +115,14 @@ type VM struct {
 	streams       map[term.Interface]*term.Stream
 	input, output *term.Stream
 
+	// Threads
+	main    *Thread
+	threads map[term.Atom]*Thread
+	running map[*Thread]struct{}
+	mutexes map[term.Atom]*Mutex
+	engines map[term.Atom]*Engine
+	alive   map[*Engine]struct{}
+
 	// Misc
 	debug bool
 }
@@ -90,9 +132,12 @@ func (vm *VM) Parser(r io.Reader, vars *[]term.ParsedVariable) *term.Parser {
 	if !ok {
 		br = bufio.NewReader(r)
 	}
-	return term.NewParser(br, vm.charConversions,
-		term.WithOperators(&vm.operators),
-		term.WithDoubleQuotes(vm.doubleQuotes),
+	vm.mu.RLock()
+	ops, conv, dq := vm.operators, vm.charConversions, vm.doubleQuotes
+	vm.mu.RUnlock()
+	return term.NewParser(br, conv,
+		term.WithOperators(&ops),
+		term.WithDoubleQuotes(dq),
 		term.WithParsedVars(vars),
 	)
 }
@@ -107,6 +152,8 @@ func (vm *VM) SetUserInput(r io.Reader) {
 		Alias:  userInput,
 	}
 
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
 	if vm.streams == nil {
 		vm.streams = map[term.Interface]*term.Stream{}
 	}
@@ -125,6 +172,8 @@ func (vm *VM) SetUserOutput(w io.Writer) {
 		Alias: userOutput,
 	}
 
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
 	if vm.streams == nil {
 		vm.streams = map[term.Interface]*term.Stream{}
 	}
@@ -137,58 +186,131 @@ func (vm *VM) DescribeTerm(t term.Interface, env *term.Env) string {
 	var buf bytes.Buffer
 	_ = t.WriteTerm(&buf, term.WriteTermOptions{
 		Quoted:      true,
-		Ops:         vm.operators,
+		Ops:         vm.ops(),
 		Descriptive: true,
 	}, env)
 	return buf.String()
 }
 
+// ops returns a snapshot of the operators.
+func (vm *VM) ops() term.Operators {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	return vm.operators
+}
+
 // Register0 registers a predicate of arity 0.
 func (vm *VM) Register0(name string, p func(func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise) {
-	if vm.procedures == nil {
-		vm.procedures = map[ProcedureIndicator]procedure{}
-	}
-	vm.procedures[ProcedureIndicator{Name: term.Atom(name), Arity: 0}] = predicate0(p)
+	vm.register(ProcedureIndicator{Name: term.Atom(name), Arity: 0}, predicate0(p))
 }
 
 // Register1 registers a predicate of arity 1.
 func (vm *VM) Register1(name string, p func(term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise) {
-	if vm.procedures == nil {
-		vm.procedures = map[ProcedureIndicator]procedure{}
-	}
-	vm.procedures[ProcedureIndicator{Name: term.Atom(name), Arity: 1}] = predicate1(p)
+	vm.register(ProcedureIndicator{Name: term.Atom(name), Arity: 1}, predicate1(p))
 }
 
 // Register2 registers a predicate of arity 2.
 func (vm *VM) Register2(name string, p func(term.Interface, term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise) {
-	if vm.procedures == nil {
-		vm.procedures = map[ProcedureIndicator]procedure{}
-	}
-	vm.procedures[ProcedureIndicator{Name: term.Atom(name), Arity: 2}] = predicate2(p)
+	vm.register(ProcedureIndicator{Name: term.Atom(name), Arity: 2}, predicate2(p))
 }
 
 // Register3 registers a predicate of arity 3.
 func (vm *VM) Register3(name string, p func(term.Interface, term.Interface, term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise) {
-	if vm.procedures == nil {
-		vm.procedures = map[ProcedureIndicator]procedure{}
-	}
-	vm.procedures[ProcedureIndicator{Name: term.Atom(name), Arity: 3}] = predicate3(p)
+	vm.register(ProcedureIndicator{Name: term.Atom(name), Arity: 3}, predicate3(p))
 }
 
 // Register4 registers a predicate of arity 4.
 func (vm *VM) Register4(name string, p func(term.Interface, term.Interface, term.Interface, term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise) {
-	if vm.procedures == nil {
-		vm.procedures = map[ProcedureIndicator]procedure{}
-	}
-	vm.procedures[ProcedureIndicator{Name: term.Atom(name), Arity: 4}] = predicate4(p)
+	vm.register(ProcedureIndicator{Name: term.Atom(name), Arity: 4}, predicate4(p))
 }
 
 // Register5 registers a predicate of arity 5.
 func (vm *VM) Register5(name string, p func(term.Interface, term.Interface, term.Interface, term.Interface, term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise) {
+	vm.register(ProcedureIndicator{Name: term.Atom(name), Arity: 5}, predicate5(p))
+}
+
+// RegisterN registers a predicate of arity n which receives the arguments as a slice. It can register a predicate of
+// any arity. Registering the same function for several arities makes a family of variadic predicates.
+// It panics if n is negative.
+func (vm *VM) RegisterN(name string, n int, p func([]term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise) {
+	if n < 0 {
+		panic(fmt.Sprintf("negative arity: %d", n))
+	}
+	vm.register(ProcedureIndicator{Name: term.Atom(name), Arity: term.Integer(n)}, predicateN(p))
+}
+
+// RegisterProcedure registers p as the procedure indicated by pi.
+func (vm *VM) RegisterProcedure(pi ProcedureIndicator, p Procedure) {
+	vm.register(pi, p)
+}
+
+func (vm *VM) register(pi ProcedureIndicator, p Procedure) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
 	if vm.procedures == nil {
-		vm.procedures = map[ProcedureIndicator]procedure{}
+		vm.procedures = map[ProcedureIndicator]Procedure{}
+	}
+	vm.procedures[pi] = p
+}
+
+// procedure returns the procedure indicated by pi.
+func (vm *VM) procedure(pi ProcedureIndicator) (Procedure, bool) {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	p, ok := vm.procedures[pi]
+	return p, ok
+}
+
+// CloneTo makes dst a copy of vm. Clauses are shared between them copy-on-write so that assert/retract on one of
+// them doesn't affect the other. Predicates registered by Register0-5, RegisterN, and RegisterProcedure are copied as
+// they are. So the stores of Facts are shared unless they're CloneableFactStore.
+func (vm *VM) CloneTo(dst *VM) {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	dst.OnCall = vm.OnCall
+	dst.OnExit = vm.OnExit
+	dst.OnFail = vm.OnFail
+	dst.OnRedo = vm.OnRedo
+	dst.OnUnknown = vm.OnUnknown
+	dst.Limits = vm.Limits
+	dst.FS = vm.FS
+	dst.CleanupTimeout = vm.CleanupTimeout
+
+	dst.procedures = make(map[ProcedureIndicator]Procedure, len(vm.procedures))
+	for pi, p := range vm.procedures {
+		switch q := p.(type) {
+		case clauses:
+			// Limit the capacity so that assertz on dst doesn't write to the array shared with vm.
+			p = q[:len(q):len(q)]
+		case *Facts:
+			if s, ok := q.Store.(CloneableFactStore); ok {
+				p = &Facts{Store: s.Clone()}
+			}
+		}
+		dst.procedures[pi] = p
+	}
+	dst.unknown = vm.unknown
+	dst.safe = make(map[ProcedureIndicator]struct{}, len(vm.safe))
+	for pi := range vm.safe {
+		dst.safe[pi] = struct{}{}
+	}
+
+	dst.operators = vm.operators
+	dst.charConversions = vm.charConversions
+	dst.charConvEnabled = vm.charConvEnabled
+	dst.doubleQuotes = vm.doubleQuotes
+
+	dst.streams = make(map[term.Interface]*term.Stream, len(vm.streams))
+	for k, s := range vm.streams {
+		dst.streams[k] = s
 	}
-	vm.procedures[ProcedureIndicator{Name: term.Atom(name), Arity: 5}] = predicate5(p)
+	dst.input, dst.output = vm.input, vm.output
+
+	dst.debug = vm.debug
 }
 
 type unknownAction int
@@ -212,33 +334,87 @@ func (u unknownAction) String() string {
 	}
 }
 
-type procedure interface {
+// Procedure is the implementation of a predicate. Call calls the predicate with the arguments and continues with k for
+// each solution.
+type Procedure interface {
 	Call(*VM, []term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise
 }
 
 func (vm *VM) arrive(pi ProcedureIndicator, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
-	if vm.OnUnknown == nil {
-		vm.OnUnknown = func(ProcedureIndicator, []term.Interface, *term.Env) {}
-	}
-
-	p := vm.procedures[pi]
+	vm.mu.RLock()
+	p, unknown := vm.procedures[pi], vm.unknown
+	vm.mu.RUnlock()
 	if p == nil {
-		switch vm.unknown {
+		switch unknown {
 		case unknownError:
 			return nondet.Error(existenceErrorProcedure(pi.Term()))
 		case unknownWarning:
-			vm.OnUnknown(pi, args, env)
+			if vm.OnUnknown != nil {
+				vm.OnUnknown(pi, args, env)
+			}
 			fallthrough
 		case unknownFail:
 			return nondet.Bool(false)
 		default:
-			return nondet.Error(systemError(fmt.Errorf("unknown unknown: %s", vm.unknown)))
+			return nondet.Error(systemError(fmt.Errorf("unknown unknown: %s", unknown)))
 		}
 	}
 
-	return nondet.Delay(func(context.Context) *nondet.Promise {
-		env := env
-		return p.Call(vm, args, k, env)
+	return vm.enter(p, args, k, env)
+}
+
+// enter calls p under the resource limits of the context.
+func (vm *VM) enter(p Procedure, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		l, ok := ctx.Value(limiterKey{}).(*limiter)
+		if !ok {
+			return p.Call(vm, args, k, env)
+		}
+		d, _ := ctx.Value(depthKey{}).(int)
+		depth, err := l.arrive(d)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		if !depth {
+			return p.Call(vm, args, k, env)
+		}
+
+		// The call is one level deeper than the caller while the continuation is back at the depth of the caller.
+		return nondet.WithValue(depthKey{}, d+1, func(context.Context) *nondet.Promise {
+			return p.Call(vm, args, func(env *term.Env) *nondet.Promise {
+				return nondet.WithValue(depthKey{}, d, func(context.Context) *nondet.Promise {
+					return k(env)
+				})
+			}, env)
+		})
+	})
+}
+
+// afresh returns a context for a goal which runs on its own, e.g. in another thread, so that it's neither within the
+// delimiters of reset/3 nor as deep as the caller. Nor can it yield to the engine of the caller.
+func afresh(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, depthKey{}, 0)
+	if r, ok := ctx.Value(engineKey{}).(*engineRun); ok {
+		ctx = context.WithValue(ctx, engineKey{}, &engineRun{engine: r.engine, parent: r, nested: true})
+	}
+	return context.WithValue(ctx, delimitationKey{}, delimitation{})
+}
+
+// nested calls goal for a search of its own, e.g. by Force or Iterator in a delayed execution. Since the answers of
+// the search don't return to the enclosing one, neither shift/1 nor engine_yield/1 in goal can reach beyond it.
+func (vm *VM) nested(goal term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		d := currentDelimitation(ctx)
+		d.innermost = &delimiter{nested: true, outer: d.innermost, barrier: d.barrier}
+		return delimit(d, func(ctx context.Context) *nondet.Promise {
+			r, ok := ctx.Value(engineKey{}).(*engineRun)
+			if !ok {
+				return vm.Call(goal, k, env)
+			}
+			return nondet.WithValue(engineKey{}, &engineRun{engine: r.engine, parent: r, nested: true}, func(context.Context) *nondet.Promise {
+				return vm.Call(goal, k, env)
+			})
+		})
 	})
 }
 
@@ -252,6 +428,15 @@ type registers struct {
 	pi        []ProcedureIndicator
 	env       *term.Env
 	cutParent *nondet.Promise
+	frames    *frame
+}
+
+// frame is a control construct which has its own cut barrier e.g. the condition of if-then-else or call/1.
+type frame struct {
+	choice    *nondet.Promise // alternatives of if-then-else to be cut by opThen.
+	cutParent *nondet.Promise // cut parent outside of the control construct.
+	soft      *bool           // set by opLeave if the control construct is a soft-cut.
+	next      *frame
 }
 
 func (vm *VM) exec(r registers) *nondet.Promise {
@@ -265,6 +450,14 @@ func (vm *VM) exec(r registers) *nondet.Promise {
 		opCall:    vm.execCall,
 		opExit:    vm.execExit,
 		opCut:     vm.execCut,
+		opFail:    vm.execFail,
+		opJump:    vm.execJump,
+		opDisj:    vm.execDisj,
+		opIf:      vm.execIf,
+		opSoftIf:  vm.execSoftIf,
+		opThen:    vm.execThen,
+		opBarrier: vm.execBarrier,
+		opLeave:   vm.execLeave,
 	}
 	for len(r.pc) != 0 {
 		op := jumpTable[r.pc[0].opcode]
@@ -424,6 +617,7 @@ func (vm *VM) execCall(r *registers) *nondet.Promise {
 				pi:        r.pi,
 				env:       env,
 				cutParent: r.cutParent,
+				frames:    r.frames,
 			})
 		}, env)
 	})
@@ -435,18 +629,21 @@ func (*VM) execExit(r *registers) *nondet.Promise {
 
 func (vm *VM) execCut(r *registers) *nondet.Promise {
 	r.pc = r.pc[1:]
-	return nondet.Cut(r.cutParent, func(context.Context) *nondet.Promise {
-		env := r.env
-		return vm.exec(registers{
-			pc:        r.pc,
-			xr:        r.xr,
-			vars:      r.vars,
-			cont:      r.cont,
-			args:      r.args,
-			astack:    r.astack,
-			pi:        r.pi,
-			env:       env,
-			cutParent: r.cutParent,
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		return nondet.CutWithin(r.cutParent, currentCutBarrier(ctx), func(context.Context) *nondet.Promise {
+			env := r.env
+			return vm.exec(registers{
+				pc:        r.pc,
+				xr:        r.xr,
+				vars:      r.vars,
+				cont:      r.cont,
+				args:      r.args,
+				astack:    r.astack,
+				pi:        r.pi,
+				env:       env,
+				cutParent: r.cutParent,
+				frames:    r.frames,
+			})
 		})
 	})
 }
@@ -465,10 +662,103 @@ func (vm *VM) execRepeat(r *registers) *nondet.Promise {
 			pi:        r.pi,
 			env:       env,
 			cutParent: r.cutParent,
+			frames:    r.frames,
 		})
 	})
 }
 
+func (*VM) execFail(*registers) *nondet.Promise {
+	return nondet.Bool(false)
+}
+
+func (*VM) execJump(r *registers) *nondet.Promise {
+	r.pc = r.pc[r.pc[0].operand:]
+	return nil
+}
+
+// execDisj tries the following instructions first and then the instructions at the jump offset. A cut in either
+// branch cuts the clause.
+func (vm *VM) execDisj(r *registers) *nondet.Promise {
+	left, right := *r, *r
+	left.pc, right.pc = r.pc[1:], r.pc[r.pc[0].operand:]
+	return nondet.Delay(func(context.Context) *nondet.Promise {
+		return vm.exec(left)
+	}, func(context.Context) *nondet.Promise {
+		return vm.exec(right)
+	})
+}
+
+func (vm *VM) execIf(r *registers) *nondet.Promise {
+	return vm.branch(r, nil)
+}
+
+func (vm *VM) execSoftIf(r *registers) *nondet.Promise {
+	var soft bool
+	return vm.branch(r, &soft)
+}
+
+// branch tries the condition which follows and then the else branch at the jump offset. A cut in the condition is
+// local to the condition while a cut in the then/else branches cuts the clause.
+func (vm *VM) branch(r *registers, soft *bool) *nondet.Promise {
+	cond, els := *r, *r
+	cond.pc, els.pc = r.pc[1:], r.pc[r.pc[0].operand:]
+	var p *nondet.Promise
+	p = nondet.Delay(func(context.Context) *nondet.Promise {
+		return vm.barrier(cond, p, soft)
+	}, func(context.Context) *nondet.Promise {
+		if soft != nil && *soft {
+			return nondet.Bool(false)
+		}
+		return vm.exec(els)
+	})
+	return p
+}
+
+func (vm *VM) execBarrier(r *registers) *nondet.Promise {
+	next := *r
+	next.pc = r.pc[1:]
+	return vm.barrier(next, nil, nil)
+}
+
+// barrier executes r with a new cut parent so that a cut inside doesn't affect outside until opThen or opLeave.
+func (vm *VM) barrier(r registers, choice *nondet.Promise, soft *bool) *nondet.Promise {
+	r.frames = &frame{
+		choice:    choice,
+		cutParent: r.cutParent,
+		soft:      soft,
+		next:      r.frames,
+	}
+	var q *nondet.Promise
+	q = nondet.Delay(func(context.Context) *nondet.Promise {
+		r := r
+		r.cutParent = q
+		return vm.exec(r)
+	})
+	return q
+}
+
+// execThen commits to the then branch by cutting the condition and the else branch.
+func (vm *VM) execThen(r *registers) *nondet.Promise {
+	f := r.frames
+	next := *r
+	next.pc, next.cutParent, next.frames = r.pc[1:], f.cutParent, f.next
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		return nondet.CutWithin(f.choice, currentCutBarrier(ctx), func(context.Context) *nondet.Promise {
+			return vm.exec(next)
+		})
+	})
+}
+
+// execLeave exits the control construct without cutting its choice points.
+func (*VM) execLeave(r *registers) *nondet.Promise {
+	f := r.frames
+	if f.soft != nil {
+		*f.soft = true
+	}
+	r.pc, r.cutParent, r.frames = r.pc[1:], f.cutParent, f.next
+	return nil
+}
+
 type predicate0 func(func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise
 
 func (p predicate0) Call(_ *VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
@@ -529,6 +819,12 @@ func (p predicate5) Call(_ *VM, args []term.Interface, k func(*term.Env) *nondet
 	return p(args[0], args[1], args[2], args[3], args[4], k, env)
 }
 
+type predicateN func([]term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise
+
+func (p predicateN) Call(_ *VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return p(args, k, env)
+}
+
 func Success(_ *term.Env) *nondet.Promise {
 	return nondet.Bool(true)
 }
@@ -0,0 +1,300 @@
+package prolog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/ichiban/prolog/engine"
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RegisterFunc registers a Go function f as a predicate name/N. The arguments of the predicate are the parameters of f
+// followed by the results of f. If the first parameter is context.Context, f receives the context of the query
+// instead. If the last result is error, a non-nil error raises an exception instead.
+//
+// The input arguments are converted into the parameter types in the same way as (*Solutions).Scan. If they can't be,
+// the predicate raises an instantiation error or a type error. The results are converted into terms by TermOf and
+// unified with the output arguments.
+func (i *Interpreter) RegisterFunc(name string, f interface{}) error {
+	fn, err := newGoFunc(f)
+	if err != nil {
+		return err
+	}
+	i.RegisterN(name, len(fn.in)+len(fn.out), fn.call)
+	return nil
+}
+
+// Iterator produces the solutions of a nondeterministic predicate registered by RegisterNondet one by one.
+type Iterator interface {
+	// Next returns the values of the output arguments of the next solution. It returns false if there are no more
+	// solutions.
+	Next(ctx context.Context) ([]interface{}, bool, error)
+
+	// Close releases the resources. It's called exactly once when the solutions are exhausted, cut, or abandoned,
+	// e.g. by (*Solutions).Close. Its error is ignored.
+	Close() error
+}
+
+// IteratorFunc is an Iterator which calls the function for the next solution and has nothing to close.
+type IteratorFunc func(ctx context.Context) ([]interface{}, bool, error)
+
+// Next calls f.
+func (f IteratorFunc) Next(ctx context.Context) ([]interface{}, bool, error) {
+	return f(ctx)
+}
+
+// Close does nothing.
+func (f IteratorFunc) Close() error {
+	return nil
+}
+
+var iteratorType = reflect.TypeOf((*Iterator)(nil)).Elem()
+
+// RegisterNondet registers a Go function f as a nondeterministic predicate name/N. The arguments of the predicate are
+// the parameters of f followed by outputs output arguments. f takes the input arguments in the same way as
+// RegisterFunc and returns an Iterator, optionally followed by error. The Iterator is asked for the next solution
+// only on backtracking so that it can lazily fetch the solutions from, for example, a paginated API.
+func (i *Interpreter) RegisterNondet(name string, outputs int, f interface{}) error {
+	fn, err := newGoFunc(f)
+	if err != nil {
+		return err
+	}
+	if len(fn.out) != 1 || !fn.out[0].Implements(iteratorType) {
+		return fmt.Errorf("not a function returning Iterator: %s", fn.fn.Type())
+	}
+	if outputs < 0 {
+		return fmt.Errorf("negative number of outputs: %d", outputs)
+	}
+	i.RegisterN(name, len(fn.in)+outputs, fn.iterate)
+	return nil
+}
+
+// goFunc is a Go function called as a predicate.
+type goFunc struct {
+	fn  reflect.Value
+	ctx bool           // whether the first parameter is context.Context.
+	in  []reflect.Type // the parameters except context.Context.
+	out []reflect.Type // the results except error.
+	err bool           // whether the last result is error.
+}
+
+func newGoFunc(f interface{}) (*goFunc, error) {
+	fn := reflect.ValueOf(f)
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return nil, fmt.Errorf("not a function: %v", f)
+	}
+	typ := fn.Type()
+	if typ.IsVariadic() {
+		return nil, fmt.Errorf("variadic function: %s", typ)
+	}
+
+	g := goFunc{fn: fn}
+	for j := 0; j < typ.NumIn(); j++ {
+		in := typ.In(j)
+		if j == 0 && in == contextType {
+			g.ctx = true
+			continue
+		}
+		g.in = append(g.in, in)
+	}
+	for j := 0; j < typ.NumOut(); j++ {
+		out := typ.Out(j)
+		if j == typ.NumOut()-1 && out == errorType {
+			g.err = true
+			continue
+		}
+		g.out = append(g.out, out)
+	}
+	return &g, nil
+}
+
+func (g *goFunc) call(args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		outs, err := g.invoke(ctx, args, env)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		vals := make([]interface{}, len(outs))
+		for j, o := range outs {
+			vals[j] = o.Interface()
+		}
+		env, ok, err := unifyValues(args[len(g.in):], vals, env)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		if !ok {
+			return nondet.Bool(false)
+		}
+		return k(env)
+	})
+}
+
+func (g *goFunc) iterate(args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	return nondet.Delay(func(ctx context.Context) *nondet.Promise {
+		outs, err := g.invoke(ctx, args, env)
+		if err != nil {
+			return nondet.Error(err)
+		}
+		it, _ := outs[0].Interface().(Iterator)
+		if it == nil {
+			return nondet.Bool(false)
+		}
+
+		var next func(context.Context) *nondet.Promise
+		next = func(ctx context.Context) *nondet.Promise {
+			vals, ok, err := it.Next(ctx)
+			if err != nil {
+				return nondet.Error(funcError(err))
+			}
+			if !ok {
+				return nondet.Bool(false)
+			}
+			return nondet.Delay(func(context.Context) *nondet.Promise {
+				env, ok, err := unifyValues(args[len(g.in):], vals, env)
+				if err != nil {
+					return nondet.Error(err)
+				}
+				if !ok {
+					return nondet.Bool(false)
+				}
+				return k(env)
+			}, next)
+		}
+		return nondet.Cleanup(func() {
+			_ = it.Close()
+		}, next)
+	})
+}
+
+// invoke calls the function with the input arguments and returns the results except error.
+func (g *goFunc) invoke(ctx context.Context, args []term.Interface, env *term.Env) ([]reflect.Value, error) {
+	ins := make([]reflect.Value, 0, len(g.in)+1)
+	if g.ctx {
+		ins = append(ins, reflect.ValueOf(&ctx).Elem())
+	}
+	for j, typ := range g.in {
+		v, err := convert(env.Simplify(args[j]), typ, env)
+		if err != nil {
+			return nil, argumentError(err)
+		}
+		ins = append(ins, v)
+	}
+
+	outs := g.fn.Call(ins)
+	if g.err {
+		if err, _ := outs[len(outs)-1].Interface().(error); err != nil {
+			return nil, funcError(err)
+		}
+		outs = outs[:len(outs)-1]
+	}
+	return outs, nil
+}
+
+// unifyValues converts the values into terms by TermOf and unifies them with the output arguments.
+func unifyValues(args []term.Interface, vals []interface{}, env *term.Env) (*term.Env, bool, error) {
+	if len(vals) != len(args) {
+		return nil, false, engine.SystemError(fmt.Errorf("expected %d values, got %d", len(args), len(vals)))
+	}
+	for j, v := range vals {
+		t, err := term.TermOf(v)
+		if err != nil {
+			return nil, false, funcError(err)
+		}
+		var ok bool
+		env, ok = args[j].Unify(t, false, env)
+		if !ok {
+			return nil, false, nil
+		}
+	}
+	return env, true, nil
+}
+
+// argumentError converts an error from convert into an instantiation error, a representation error, or a type error.
+func argumentError(err error) error {
+	var e *ScanError
+	if !errors.As(err, &e) {
+		return funcError(err)
+	}
+
+	if v, ok := e.Term.(term.Variable); ok {
+		return engine.InstantiationError(v)
+	}
+
+	typ, desc := validType(e.Type)
+
+	// A partial list is not instantiated enough rather than of a wrong type.
+	if v, ok := partialList(e.Term); ok && typ == "list" {
+		return engine.InstantiationError(v)
+	}
+
+	if errors.Is(e.Err, errOutOfRange) {
+		limit := term.Atom("max_integer")
+		if i, ok := e.Term.(term.Integer); ok && i < 0 {
+			limit = "min_integer"
+		}
+		return engine.RepresentationError(limit, term.Atom(fmt.Sprintf("%s is out of range of %s.", e.Term, e.Type)))
+	}
+
+	return engine.TypeError(typ, e.Term, term.Atom(fmt.Sprintf("%s is not %s.", e.Term, desc)))
+}
+
+// partialList returns the tail of t if t is a list of which tail is a variable.
+func partialList(t term.Interface) (term.Variable, bool) {
+	for {
+		switch l := t.(type) {
+		case term.Variable:
+			return l, true
+		case *term.Compound:
+			if l.Functor != "." || len(l.Args) != 2 {
+				return "", false
+			}
+			t = l.Args[1]
+		default:
+			return "", false
+		}
+	}
+}
+
+// validType returns the type in type_error/2 for a Go type and its description.
+func validType(typ reflect.Type) (term.Atom, string) {
+	if typ == timeType {
+		return "atom", "an atom"
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return "boolean", "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer", "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "number", "a number"
+	case reflect.String:
+		return "atom", "an atom"
+	case reflect.Slice, reflect.Map:
+		return "list", "a list"
+	case reflect.Struct:
+		return "compound", "a compound"
+	case reflect.Ptr:
+		return validType(typ.Elem())
+	default:
+		return term.Atom(typ.String()), fmt.Sprintf("a %s", typ)
+	}
+}
+
+// funcError converts an error returned by a Go function into an exception. An *engine.Exception is raised as it is
+// and the others are system errors.
+func funcError(err error) error {
+	var e *engine.Exception
+	if errors.As(err, &e) {
+		return e
+	}
+	return engine.SystemError(err)
+}
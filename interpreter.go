@@ -1,12 +1,20 @@
 package prolog
 
 import (
+	"bufio"
 	"context"
 	_ "embed"
+	"errors"
+	"fmt"
 	"io"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/syntax"
 	"github.com/ichiban/prolog/term"
 
 	"github.com/ichiban/prolog/engine"
@@ -18,21 +26,64 @@ var bootstrap string
 // Interpreter is a Prolog interpreter. The zero value is a valid interpreter without any predicates/operators defined.
 type Interpreter struct {
 	engine.VM
+
+	// sandboxed is true if the interpreter is for untrusted rules.
+	sandboxed bool
 }
 
+var (
+	bootstrapped     Interpreter
+	bootstrappedOnce sync.Once
+)
+
 // New creates a new Prolog interpreter with predefined predicates/operators.
 func New(in io.Reader, out io.Writer) *Interpreter {
-	var i Interpreter
+	// We compile bootstrap.pl only once per process and clone the resulting interpreter.
+	bootstrappedOnce.Do(func() {
+		bootstrapped.registerBuiltin()
+		if err := bootstrapped.Exec(bootstrap); err != nil {
+			panic(err)
+		}
+	})
+
+	i := bootstrapped.Clone()
 	i.SetUserInput(in)
 	i.SetUserOutput(out)
-	i.Register0("repeat", i.Repeat)
-	i.Register1(`\+`, i.Negation)
-	i.Register1("call", i.Call)
-	i.Register1("current_predicate", i.CurrentPredicate)
-	i.Register1("assertz", i.Assertz)
-	i.Register1("asserta", i.Asserta)
-	i.Register1("retract", i.Retract)
-	i.Register1("abolish", i.Abolish)
+	return i
+}
+
+// NewSandboxed creates a new Prolog interpreter for untrusted rules. It can't open files unless FS is set, halt, or
+// modify the predefined predicates. Directives and queries are rejected before execution unless
+// safe_goal/1 accepts them.
+func NewSandboxed(in io.Reader, out io.Writer) *Interpreter {
+	i := New(in, out)
+	i.sandboxed = true
+	i.FS = engine.NoFileSystem{}
+	i.Register1("halt", engine.HaltSandboxed)
+	i.Seal()
+	return i
+}
+
+// Clone returns a copy of the interpreter. The copy shares the clauses with the original copy-on-write so that
+// the changes to the database of either of them don't affect the other. The registered predicates, including the
+// overridden predefined ones, are copied as they are. So are the procedures registered by RegisterProcedure whose
+// fact stores are shared by the copies unless they're engine.CloneableFactStore.
+func (i *Interpreter) Clone() *Interpreter {
+	var c Interpreter
+	i.CloneTo(&c.VM)
+	c.sandboxed = i.sandboxed
+	return &c
+}
+
+func (i *Interpreter) registerBuiltin() {
+	i.registerMethod0("repeat", (*engine.VM).Repeat)
+	i.registerMethod1(`\+`, (*engine.VM).Negation)
+	i.registerMethod1("call", (*engine.VM).Call)
+	i.registerMethod1("current_predicate", (*engine.VM).CurrentPredicate)
+	i.registerMethod1("assertz", (*engine.VM).Assertz)
+	i.registerMethod1("asserta", (*engine.VM).Asserta)
+	i.registerMethod1("retract", (*engine.VM).Retract)
+	i.registerMethod1("abolish", (*engine.VM).Abolish)
 	i.Register1("var", engine.TypeVar)
 	i.Register1("float", engine.TypeFloat)
 	i.Register1("integer", engine.TypeInteger)
@@ -44,32 +95,36 @@ func New(in io.Reader, out io.Writer) *Interpreter {
 	i.Register2("=..", engine.Univ)
 	i.Register2("copy_term", engine.CopyTerm)
 	i.Register3("arg", engine.Arg)
-	i.Register3("bagof", i.BagOf)
-	i.Register3("setof", i.SetOf)
-	i.Register3("findall", i.FindAll)
-	i.Register3("catch", i.Catch)
+	i.registerMethod3("bagof", (*engine.VM).BagOf)
+	i.registerMethod3("setof", (*engine.VM).SetOf)
+	i.registerMethod3("findall", (*engine.VM).FindAll)
+	i.registerMethod3("catch", (*engine.VM).Catch)
+	i.registerMethod3("setup_call_cleanup", (*engine.VM).SetupCallCleanup)
 	i.Register3("functor", engine.Functor)
-	i.Register3("op", i.Op)
+	i.registerMethod3("op", (*engine.VM).Op)
 	i.Register3("compare", engine.Compare)
-	i.Register3("current_op", i.CurrentOp)
-	i.Register1("current_input", i.CurrentInput)
-	i.Register1("current_output", i.CurrentOutput)
-	i.Register1("set_input", i.SetInput)
-	i.Register1("set_output", i.SetOutput)
-	i.Register4("open", i.Open)
-	i.Register2("close", i.Close)
-	i.Register1("flush_output", i.FlushOutput)
-	i.Register3("write_term", i.WriteTerm)
+	i.registerMethod3("current_op", (*engine.VM).CurrentOp)
+	i.registerMethod1("current_input", (*engine.VM).CurrentInput)
+	i.registerMethod1("current_output", (*engine.VM).CurrentOutput)
+	i.registerMethod1("set_input", (*engine.VM).SetInput)
+	i.registerMethod1("set_output", (*engine.VM).SetOutput)
+	i.registerMethod4("open", (*engine.VM).Open)
+	i.registerMethod2("close", (*engine.VM).Close)
+	i.registerMethod1("flush_output", (*engine.VM).FlushOutput)
+	i.registerMethod3("write_term", (*engine.VM).WriteTerm)
 	i.Register2("char_code", engine.CharCode)
-	i.Register2("put_byte", i.PutByte)
-	i.Register2("put_code", i.PutCode)
-	i.Register3("read_term", i.ReadTerm)
-	i.Register2("get_byte", i.GetByte)
-	i.Register2("get_char", i.GetChar)
-	i.Register2("peek_byte", i.PeekByte)
-	i.Register2("peek_char", i.PeekChar)
+	i.registerMethod2("put_byte", (*engine.VM).PutByte)
+	i.registerMethod2("put_code", (*engine.VM).PutCode)
+	i.registerMethod3("read_term", (*engine.VM).ReadTerm)
+	i.registerMethod3("csv_read_file", (*engine.VM).CSVReadFile)
+	i.registerMethod2("csv_load_file", (*engine.VM).CSVLoadFile)
+	i.registerMethod3("csv_read_row", (*engine.VM).CSVReadRow)
+	i.registerMethod2("get_byte", (*engine.VM).GetByte)
+	i.registerMethod2("get_char", (*engine.VM).GetChar)
+	i.registerMethod2("peek_byte", (*engine.VM).PeekByte)
+	i.registerMethod2("peek_char", (*engine.VM).PeekChar)
 	i.Register1("halt", engine.Halt)
-	i.Register2("clause", i.Clause)
+	i.registerMethod2("clause", (*engine.VM).Clause)
 	i.Register2("atom_length", engine.AtomLength)
 	i.Register3("atom_concat", engine.AtomConcat)
 	i.Register5("sub_atom", engine.SubAtom)
@@ -84,17 +139,188 @@ func New(in io.Reader, out io.Writer) *Interpreter {
 	i.Register2(">", engine.DefaultFunctionSet.GreaterThan)
 	i.Register2("=<", engine.DefaultFunctionSet.LessThanOrEqual)
 	i.Register2(">=", engine.DefaultFunctionSet.GreaterThanOrEqual)
-	i.Register2("stream_property", i.StreamProperty)
-	i.Register2("set_stream_position", i.SetStreamPosition)
-	i.Register2("char_conversion", i.CharConversion)
-	i.Register2("current_char_conversion", i.CurrentCharConversion)
-	i.Register2("set_prolog_flag", i.SetPrologFlag)
-	i.Register2("current_prolog_flag", i.CurrentPrologFlag)
-	i.Register1("dynamic", i.Dynamic)
-	if err := i.Exec(bootstrap); err != nil {
-		panic(err)
+	i.registerMethod2("stream_property", (*engine.VM).StreamProperty)
+	i.registerMethod2("set_stream_position", (*engine.VM).SetStreamPosition)
+	i.registerMethod2("char_conversion", (*engine.VM).CharConversion)
+	i.registerMethod2("current_char_conversion", (*engine.VM).CurrentCharConversion)
+	i.registerMethod2("set_prolog_flag", (*engine.VM).SetPrologFlag)
+	i.registerMethod2("current_prolog_flag", (*engine.VM).CurrentPrologFlag)
+	i.registerMethod1("dynamic", (*engine.VM).Dynamic)
+	i.registerMethod3("thread_create", (*engine.VM).ThreadCreate)
+	i.registerMethod2("thread_join", (*engine.VM).ThreadJoin)
+	i.registerMethod1("thread_self", (*engine.VM).ThreadSelf)
+	i.registerMethod2("thread_send_message", (*engine.VM).ThreadSendMessage)
+	i.registerMethod2("thread_get_message", (*engine.VM).ThreadGetMessage)
+	i.registerMethod1("message_queue_create", (*engine.VM).MessageQueueCreate)
+	i.registerMethod1("mutex_create", (*engine.VM).MutexCreate)
+	i.registerMethod1("mutex_lock", (*engine.VM).MutexLock)
+	i.registerMethod1("mutex_unlock", (*engine.VM).MutexUnlock)
+	i.registerMethod2("with_mutex", (*engine.VM).WithMutex)
+	i.registerMethod3("concurrent", (*engine.VM).Concurrent)
+	i.registerMethod2("concurrent_forall", (*engine.VM).ConcurrentForAll)
+	i.registerMethod3("first_solution", (*engine.VM).FirstSolution)
+	i.registerMethod4("engine_create", (*engine.VM).EngineCreate)
+	i.registerMethod2("engine_next", (*engine.VM).EngineNext)
+	i.registerMethod2("engine_post", (*engine.VM).EnginePost)
+	i.registerMethod1("engine_fetch", (*engine.VM).EngineFetch)
+	i.registerMethod1("engine_yield", (*engine.VM).EngineYield)
+	i.registerMethod1("engine_self", (*engine.VM).EngineSelf)
+	i.registerMethod1("engine_destroy", (*engine.VM).EngineDestroy)
+	i.registerMethod3("reset", (*engine.VM).Reset)
+	i.registerMethod1("shift", (*engine.VM).Shift)
+	i.registerMethod1("shift_for_copy", (*engine.VM).ShiftForCopy)
+	i.registerMethod1("call_continuation", (*engine.VM).CallContinuation)
+	i.registerMethod3("call_with_inference_limit", (*engine.VM).CallWithInferenceLimit)
+	i.registerMethod2("call_with_time_limit", (*engine.VM).CallWithTimeLimit)
+	i.registerMethod1("safe_goal", (*engine.VM).SafeGoal)
+	i.DeclareSafe(safeBuiltins...)
+}
+
+// The predefined predicates implemented by the methods of engine.VM are called on the VM running the query rather
+// than bound to a VM. Thus, the clones of an interpreter share them.
+
+type method0 func(*engine.VM, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise
+
+func (m method0) Call(vm *engine.VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	if len(args) != 0 {
+		return nondet.Error(fmt.Errorf("wrong number of arguments: %s", args))
 	}
-	return &i
+
+	return m(vm, k, env)
+}
+
+func (i *Interpreter) registerMethod0(name string, m method0) {
+	i.RegisterProcedure(engine.ProcedureIndicator{Name: term.Atom(name), Arity: 0}, m)
+}
+
+type method1 func(*engine.VM, term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise
+
+func (m method1) Call(vm *engine.VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	if len(args) != 1 {
+		return nondet.Error(fmt.Errorf("wrong number of arguments: %s", args))
+	}
+
+	return m(vm, args[0], k, env)
+}
+
+func (i *Interpreter) registerMethod1(name string, m method1) {
+	i.RegisterProcedure(engine.ProcedureIndicator{Name: term.Atom(name), Arity: 1}, m)
+}
+
+type method2 func(*engine.VM, term.Interface, term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise
+
+func (m method2) Call(vm *engine.VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	if len(args) != 2 {
+		return nondet.Error(fmt.Errorf("wrong number of arguments: %s", args))
+	}
+
+	return m(vm, args[0], args[1], k, env)
+}
+
+func (i *Interpreter) registerMethod2(name string, m method2) {
+	i.RegisterProcedure(engine.ProcedureIndicator{Name: term.Atom(name), Arity: 2}, m)
+}
+
+type method3 func(*engine.VM, term.Interface, term.Interface, term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise
+
+func (m method3) Call(vm *engine.VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	if len(args) != 3 {
+		return nondet.Error(fmt.Errorf("wrong number of arguments: %s", args))
+	}
+
+	return m(vm, args[0], args[1], args[2], k, env)
+}
+
+func (i *Interpreter) registerMethod3(name string, m method3) {
+	i.RegisterProcedure(engine.ProcedureIndicator{Name: term.Atom(name), Arity: 3}, m)
+}
+
+type method4 func(*engine.VM, term.Interface, term.Interface, term.Interface, term.Interface, func(*term.Env) *nondet.Promise, *term.Env) *nondet.Promise
+
+func (m method4) Call(vm *engine.VM, args []term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+	if len(args) != 4 {
+		return nondet.Error(fmt.Errorf("wrong number of arguments: %s", args))
+	}
+
+	return m(vm, args[0], args[1], args[2], args[3], k, env)
+}
+
+func (i *Interpreter) registerMethod4(name string, m method4) {
+	i.RegisterProcedure(engine.ProcedureIndicator{Name: term.Atom(name), Arity: 4}, m)
+}
+
+// safeBuiltins are the predefined predicates which untrusted rules can call. They don't affect the host process or
+// the other queries except for the database and the standard streams.
+var safeBuiltins = []engine.ProcedureIndicator{
+	{Name: "repeat", Arity: 0},
+	{Name: `\+`, Arity: 1},
+	{Name: "call", Arity: 1},
+	{Name: "current_predicate", Arity: 1},
+	{Name: "assertz", Arity: 1},
+	{Name: "asserta", Arity: 1},
+	{Name: "retract", Arity: 1},
+	{Name: "abolish", Arity: 1},
+	{Name: "var", Arity: 1},
+	{Name: "float", Arity: 1},
+	{Name: "integer", Arity: 1},
+	{Name: "atom", Arity: 1},
+	{Name: "compound", Arity: 1},
+	{Name: "throw", Arity: 1},
+	{Name: "=", Arity: 2},
+	{Name: "unify_with_occurs_check", Arity: 2},
+	{Name: "=..", Arity: 2},
+	{Name: "copy_term", Arity: 2},
+	{Name: "arg", Arity: 3},
+	{Name: "bagof", Arity: 3},
+	{Name: "setof", Arity: 3},
+	{Name: "findall", Arity: 3},
+	{Name: "catch", Arity: 3},
+	{Name: "setup_call_cleanup", Arity: 3},
+	{Name: "functor", Arity: 3},
+	{Name: "compare", Arity: 3},
+	{Name: "current_op", Arity: 3},
+	{Name: "current_input", Arity: 1},
+	{Name: "current_output", Arity: 1},
+	{Name: "open", Arity: 4}, // The file system is restricted by FS.
+	{Name: "close", Arity: 2},
+	{Name: "flush_output", Arity: 1},
+	{Name: "write_term", Arity: 3},
+	{Name: "char_code", Arity: 2},
+	{Name: "put_byte", Arity: 2},
+	{Name: "put_code", Arity: 2},
+	{Name: "read_term", Arity: 3},
+	{Name: "csv_read_file", Arity: 3}, // The file system is restricted by FS.
+	{Name: "csv_read_row", Arity: 3},
+	{Name: "get_byte", Arity: 2},
+	{Name: "get_char", Arity: 2},
+	{Name: "peek_byte", Arity: 2},
+	{Name: "peek_char", Arity: 2},
+	{Name: "clause", Arity: 2},
+	{Name: "atom_length", Arity: 2},
+	{Name: "atom_concat", Arity: 3},
+	{Name: "sub_atom", Arity: 5},
+	{Name: "atom_chars", Arity: 2},
+	{Name: "atom_codes", Arity: 2},
+	{Name: "number_chars", Arity: 2},
+	{Name: "number_codes", Arity: 2},
+	{Name: "is", Arity: 2},
+	{Name: "=:=", Arity: 2},
+	{Name: `=\=`, Arity: 2},
+	{Name: "<", Arity: 2},
+	{Name: ">", Arity: 2},
+	{Name: "=<", Arity: 2},
+	{Name: ">=", Arity: 2},
+	{Name: "stream_property", Arity: 2},
+	{Name: "current_char_conversion", Arity: 2},
+	{Name: "current_prolog_flag", Arity: 2},
+	{Name: "dynamic", Arity: 1},
+	{Name: "reset", Arity: 3},
+	{Name: "shift", Arity: 1},
+	{Name: "shift_for_copy", Arity: 1},
+	{Name: "call_continuation", Arity: 1},
+	{Name: "call_with_inference_limit", Arity: 3},
+	{Name: "call_with_time_limit", Arity: 2},
+	{Name: "safe_goal", Arity: 1},
 }
 
 // Exec executes a prolog program.
@@ -102,23 +328,266 @@ func (i *Interpreter) Exec(query string, args ...interface{}) error {
 	return i.ExecContext(context.Background(), query, args...)
 }
 
-// ExecContext executes a prolog program with context.
+// ExecContext executes a prolog program with context. The arguments are for the placeholders throughout the program.
+// If they don't match the placeholders, it returns an error before executing anything.
 func (i *Interpreter) ExecContext(ctx context.Context, query string, args ...interface{}) error {
-	p := i.Parser(strings.NewReader(query), nil)
-	if err := p.Replace("?", args...); err != nil {
+	if err := checkPlaceholders(query, args); err != nil {
 		return err
 	}
-	for p.More() {
+
+	// The engines created by the program outlive it so that the later queries can use them. DestroyEngines destroys
+	// them.
+	ctx, _ = engine.WithThread(i.Limit(ctx))
+	r := bufio.NewReader(strings.NewReader(query))
+	p := i.Parser(r, nil)
+	if err := replace(p, args); err != nil {
+		return err
+	}
+	p.Partial()
+	for {
 		t, err := p.Term()
+		switch err {
+		case nil:
+			break
+		case io.EOF:
+			return p.Unused()
+		default:
+			return err
+		}
+
+		if err := i.assert(ctx, t); err != nil {
+			return err
+		}
+
+		// We make a parser for each clause so that it reflects the changes to operators etc. made by directives.
+		next := i.Parser(r, nil)
+		next.Continue(p)
+		p = next
+	}
+}
+
+// checkPlaceholders returns an error if the placeholders in query don't match args. ExecContext checks it before
+// executing anything so that a mismatch doesn't leave the database partly modified. Unlike the parser, it doesn't
+// know operators so that ? and :name are placeholders wherever they're not followed by (.
+func checkPlaceholders(query string, args []interface{}) error {
+	var tokens []syntax.Token
+	l := syntax.NewLexer(bufio.NewReader(strings.NewReader(query)), nil)
+	for {
+		t, err := l.Next()
 		if err != nil {
+			// The parser will report it.
+			return nil
+		}
+		if t.Kind == syntax.TokenEOS {
+			break
+		}
+		tokens = append(tokens, t)
+	}
+
+	var named Named
+	if len(args) == 1 {
+		named, _ = args[0].(Named)
+	}
+	unused := make(map[string]struct{}, len(named))
+	for n := range named {
+		unused[n] = struct{}{}
+	}
+
+	var positional int
+	for j, t := range tokens {
+		if t.Kind != syntax.TokenAtom || (j+1 < len(tokens) && tokens[j+1].Kind == syntax.TokenParenL) {
+			continue
+		}
+		switch {
+		case named == nil && t.Val == "?":
+			positional++
+		case named != nil && t.Val == ":" && j+1 < len(tokens) && tokens[j+1].Kind == syntax.TokenAtom:
+			n := tokens[j+1].Val
+			if _, ok := named[n]; !ok {
+				return fmt.Errorf("no argument for placeholder: :%s", n)
+			}
+			delete(unused, n)
+		}
+	}
+
+	switch {
+	case named != nil:
+		if len(unused) == 0 {
+			return nil
+		}
+		ns := make([]string, 0, len(unused))
+		for n := range unused {
+			ns = append(ns, ":"+n)
+		}
+		sort.Strings(ns)
+		return fmt.Errorf("no placeholders for arguments: %s", strings.Join(ns, ", "))
+	case positional < len(args):
+		return fmt.Errorf("too many arguments for placeholders: %d placeholders for %d arguments", positional, len(args))
+	case positional > len(args):
+		return errors.New("not enough arguments for placeholders")
+	default:
+		return nil
+	}
+}
+
+// assert adds a clause t to the database. If t is a directive, it's executed after checkSafe accepts it.
+func (i *Interpreter) assert(ctx context.Context, t term.Interface) error {
+	if d, ok := t.(*term.Compound); ok && d.Functor == ":-" && len(d.Args) == 1 {
+		if err := i.checkSafe(ctx, d.Args[0], nil); err != nil {
 			return err
 		}
+	}
+	_, err := i.Assertz(t, engine.Success, nil).Force(ctx)
+	return err
+}
+
+// checkSafe returns an error unless safe_goal/1 accepts goal if the interpreter is sandboxed.
+func (i *Interpreter) checkSafe(ctx context.Context, goal term.Interface, env *term.Env) error {
+	if !i.sandboxed {
+		return nil
+	}
+	_, err := i.SafeGoal(goal, engine.Success, env).Force(ctx)
+	return err
+}
+
+// TermOf converts a Go value into a term. See term.TermOf for the details of the conversion.
+func TermOf(v interface{}) (term.Interface, error) {
+	return term.TermOf(v)
+}
+
+// Assert converts a Go value into a term by TermOf and adds it to the database as a clause.
+func (i *Interpreter) Assert(v interface{}) error {
+	return i.AssertContext(context.Background(), v)
+}
+
+// AssertContext converts a Go value into a term by TermOf and adds it to the database as a clause with context.
+func (i *Interpreter) AssertContext(ctx context.Context, v interface{}) error {
+	t, err := TermOf(v)
+	if err != nil {
+		return err
+	}
+	return i.assert(i.Limit(ctx), t)
+}
+
+// AssertTerm adds a clause t to the database.
+func (i *Interpreter) AssertTerm(t term.Interface) error {
+	return i.AssertTermContext(context.Background(), t)
+}
+
+// AssertTermContext adds a clause t to the database with context.
+func (i *Interpreter) AssertTermContext(ctx context.Context, t term.Interface) error {
+	return i.assert(i.Limit(ctx), t)
+}
+
+// RetractTerm removes the first clause in the database which unifies with t. It reports whether such a clause existed.
+func (i *Interpreter) RetractTerm(t term.Interface) (bool, error) {
+	return i.RetractTermContext(context.Background(), t)
+}
+
+// RetractTermContext removes the first clause in the database which unifies with t with context. It reports whether
+// such a clause existed.
+func (i *Interpreter) RetractTermContext(ctx context.Context, t term.Interface) (bool, error) {
+	return i.Retract(t, engine.Success, nil).Force(i.Limit(ctx))
+}
+
+// AssertFacts adds the facts of pi, e.g. "person/2", at once. Each row is the arguments of a fact which are converted
+// into terms by TermOf. It's much faster than Exec since it doesn't parse anything.
+func (i *Interpreter) AssertFacts(pi string, rows [][]interface{}) error {
+	n := strings.LastIndex(pi, "/")
+	if n < 0 {
+		return fmt.Errorf("invalid procedure indicator: %s", pi)
+	}
+	arity, err := strconv.Atoi(pi[n+1:])
+	if err != nil || arity < 0 {
+		return fmt.Errorf("invalid procedure indicator: %s", pi)
+	}
+
+	facts := make([][]term.Interface, len(rows))
+	for j, row := range rows {
+		facts[j] = make([]term.Interface, len(row))
+		for k, v := range row {
+			facts[j][k], err = TermOf(v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return i.AppendFacts(engine.ProcedureIndicator{Name: term.Atom(pi[:n]), Arity: term.Integer(arity)}, facts)
+}
 
-		if _, err := i.Assertz(t, engine.Success, nil).Force(ctx); err != nil {
+// AssertStructs adds the elements of a slice of structs as facts at once. The facts are converted by TermOf except
+// that the functor is name unless it's empty. The facts must be of the same procedure.
+func (i *Interpreter) AssertStructs(name string, structs interface{}) error {
+	o := reflect.ValueOf(structs)
+	if o.Kind() != reflect.Slice && o.Kind() != reflect.Array {
+		return fmt.Errorf("not a slice: %T", structs)
+	}
+
+	var (
+		pi    engine.ProcedureIndicator
+		facts = make([][]term.Interface, o.Len())
+	)
+	for j := range facts {
+		e := o.Index(j)
+		if e.Kind() == reflect.Interface {
+			e = e.Elem()
+		}
+		if reflect.Indirect(e).Kind() != reflect.Struct {
+			return fmt.Errorf("not a struct: %s", e.Type())
+		}
+		t, err := TermOf(e.Interface())
+		if err != nil {
 			return err
 		}
+		var p engine.ProcedureIndicator
+		switch t := t.(type) {
+		case term.Atom:
+			p = engine.ProcedureIndicator{Name: t}
+		case *term.Compound:
+			p = engine.ProcedureIndicator{Name: t.Functor, Arity: term.Integer(len(t.Args))}
+			facts[j] = t.Args
+		}
+		if name != "" {
+			p.Name = term.Atom(name)
+		}
+		if j > 0 && p != pi {
+			return fmt.Errorf("mixed procedures: %s and %s", pi, p)
+		}
+		pi = p
+	}
+	if len(facts) == 0 {
+		return nil
+	}
+	return i.AppendFacts(pi, facts)
+}
+
+// Named is a set of arguments for named placeholders. If it's the only argument of Query or Exec, every occurrence
+// of :name in the query is replaced by the argument of the name. An argument can be a term.Variable so that the
+// placeholder becomes a variable of the query.
+type Named map[string]interface{}
+
+// NamedFields returns the arguments for named placeholders from the exported fields of a struct. The names are the
+// field names or the `prolog:"name"` tags. It returns nil if v is neither a struct nor a pointer to a struct.
+func NamedFields(v interface{}) Named {
+	o := reflect.Indirect(reflect.ValueOf(v))
+	if o.Kind() != reflect.Struct {
+		return nil
+	}
+	n := Named{}
+	for _, f := range structFields(o.Type()) {
+		n[f.name] = o.FieldByIndex(f.index).Interface()
+	}
+	return n
+}
+
+// replace registers the arguments for either the named placeholders or ?.
+func replace(p *term.Parser, args []interface{}) error {
+	if len(args) == 1 {
+		if n, ok := args[0].(Named); ok {
+			return p.ReplaceNamed(n)
+		}
 	}
-	return nil
+	return p.Replace("?", args...)
 }
 
 // Query executes a prolog query and returns *Solutions.
@@ -129,7 +598,7 @@ func (i *Interpreter) Query(query string, args ...interface{}) (*Solutions, erro
 // QueryContext executes a prolog query and returns *Solutions with context.
 func (i *Interpreter) QueryContext(ctx context.Context, query string, args ...interface{}) (*Solutions, error) {
 	p := i.Parser(strings.NewReader(query), nil)
-	if err := p.Replace("?", args...); err != nil {
+	if err := replace(p, args); err != nil {
 		return nil, err
 	}
 	t, err := p.Term()
@@ -139,26 +608,81 @@ func (i *Interpreter) QueryContext(ctx context.Context, query string, args ...in
 
 	var env *term.Env
 
-	more := make(chan bool, 1)
-	next := make(chan *term.Env)
-	sols := Solutions{
-		vars: env.FreeVariables(t),
-		more: more,
-		next: next,
+	if err := i.checkSafe(ctx, t, env); err != nil {
+		return nil, err
+	}
+
+	return newSolutions(i.Limit(ctx), env.FreeVariables(t), func(k func(*term.Env) *nondet.Promise) *nondet.Promise {
+		return i.Call(t, k, env)
+	}), nil
+}
+
+// QueryTerm executes a goal constructed in Go and returns *Solutions. The variables of the solutions are the free
+// variables of goal. Unlike Query, it doesn't parse anything so that the arguments are never mistaken for operators
+// or placeholders.
+func (i *Interpreter) QueryTerm(goal term.Interface) (*Solutions, error) {
+	return i.QueryTermContext(context.Background(), goal)
+}
+
+// QueryTermContext executes a goal constructed in Go and returns *Solutions with context.
+func (i *Interpreter) QueryTermContext(ctx context.Context, goal term.Interface) (*Solutions, error) {
+	var env *term.Env
+
+	if err := i.checkSafe(ctx, goal, env); err != nil {
+		return nil, err
+	}
+
+	return newSolutions(i.Limit(ctx), env.FreeVariables(goal), func(k func(*term.Env) *nondet.Promise) *nondet.Promise {
+		return i.Call(goal, k, env)
+	}), nil
+}
+
+// QuerySolution executes a prolog query for the first solution.
+func (i *Interpreter) QuerySolution(query string, args ...interface{}) *Solution {
+	return i.QuerySolutionContext(context.Background(), query, args...)
+}
+
+// QuerySolutionContext executes a prolog query for the first solution with context.
+func (i *Interpreter) QuerySolutionContext(ctx context.Context, query string, args ...interface{}) *Solution {
+	return i.querySolution(ctx, false, query, args...)
+}
+
+// QueryOne executes a prolog query which is expected to have exactly one solution.
+func (i *Interpreter) QueryOne(query string, args ...interface{}) *Solution {
+	return i.QueryOneContext(context.Background(), query, args...)
+}
+
+// QueryOneContext executes a prolog query which is expected to have exactly one solution with context.
+// If the query has more than one solution, the returned *Solution reports ErrMultipleSolutions.
+func (i *Interpreter) QueryOneContext(ctx context.Context, query string, args ...interface{}) *Solution {
+	return i.querySolution(ctx, true, query, args...)
+}
+
+func (i *Interpreter) querySolution(ctx context.Context, one bool, query string, args ...interface{}) *Solution {
+	sols, err := i.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &Solution{err: err}
 	}
+	defer func() {
+		_ = sols.Close()
+	}()
 
-	go func() {
-		defer close(next)
-		if !<-more {
-			return
+	if !sols.Next() {
+		if err := sols.Err(); err != nil {
+			return &Solution{err: err}
 		}
-		if _, err := i.Call(t, func(env *term.Env) *nondet.Promise {
-			next <- env
-			return nondet.Bool(!<-more)
-		}, env).Force(ctx); err != nil {
-			sols.err = err
+		return &Solution{err: ErrNoSolutions}
+	}
+
+	// We ask for another solution only if there might be one.
+	if one && !sols.Deterministic() {
+		if sols.Next() {
+			return &Solution{err: ErrMultipleSolutions}
 		}
-	}()
+		if err := sols.Err(); err != nil {
+			return &Solution{err: err}
+		}
+	}
 
-	return &sols, nil
+	return &Solution{sols: sols}
 }
@@ -1,8 +1,20 @@
 package prolog
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ichiban/prolog/engine"
+	"github.com/ichiban/prolog/nondet"
 	"github.com/ichiban/prolog/term"
 
 	"github.com/stretchr/testify/assert"
@@ -11,6 +23,16 @@ import (
 func TestNew(t *testing.T) {
 	i := New(nil, nil)
 	assert.NotNil(t, i)
+
+	t.Run("independent", func(t *testing.T) {
+		i := New(nil, nil)
+		assert.NoError(t, i.QuerySolution(`assertz(foo(a)).`).Err())
+		assert.NoError(t, i.QuerySolution(`foo(a).`).Err())
+
+		j := New(nil, nil)
+		assert.Error(t, j.QuerySolution(`foo(a).`).Err())
+		assert.NoError(t, j.QuerySolution(`append(X, Y, [a]).`).Err())
+	})
 }
 
 func TestInterpreter_Exec(t *testing.T) {
@@ -30,6 +52,109 @@ func TestInterpreter_Exec(t *testing.T) {
 		var i Interpreter
 		assert.NoError(t, i.Exec("foo(?, ?, ?, ?).", "a", 1, 2.0, []string{"abc", "def"}))
 	})
+
+	t.Run("directive affects following clauses", func(t *testing.T) {
+		i := New(nil, nil)
+		assert.NoError(t, i.Exec(`
+:- op(700, xfx, ===>).
+a ===> b.
+`))
+
+		sols, err := i.Query(`X ===> Y.`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.True(t, sols.Next())
+		var s struct {
+			X, Y string
+		}
+		assert.NoError(t, sols.Scan(&s))
+		assert.Equal(t, "a", s.X)
+		assert.Equal(t, "b", s.Y)
+	})
+}
+
+func TestInterpreter_concurrency(t *testing.T) {
+	i := New(nil, nil)
+	assert.NoError(t, i.Exec(`
+:- dynamic(counter/1).
+counter(0).
+`))
+
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(2)
+		go func(n int) {
+			defer wg.Done()
+			for m := 0; m < 20; m++ {
+				assert.NoError(t, i.Exec(`:- assertz(counter(?)).`, n*20+m+1))
+				assert.NoError(t, i.Exec(`:- retract(counter(?)).`, n*20+m+1))
+			}
+		}(n)
+		go func() {
+			defer wg.Done()
+			for m := 0; m < 20; m++ {
+				sols, err := i.Query(`counter(X), X == 0.`)
+				assert.NoError(t, err)
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Close())
+			}
+		}()
+	}
+	wg.Wait()
+
+	sols, err := i.Query(`findall(X, counter(X), L).`)
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, sols.Close())
+	}()
+	assert.True(t, sols.Next())
+	var s struct {
+		L []int
+	}
+	assert.NoError(t, sols.Scan(&s))
+	assert.Equal(t, []int{0}, s.L)
+}
+
+func TestInterpreter_concurrentRetract(t *testing.T) {
+	i := New(nil, nil)
+	assert.NoError(t, i.Exec(`
+:- dynamic(counter/1).
+counter(0).
+incr :- retract(counter(N)), N1 is N + 1, assertz(counter(N1)).
+`))
+
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := 0; m < 50; {
+				// It fails if another query has retracted the clause first. Then, we try again.
+				ok, err := func() (bool, error) {
+					sols, err := i.Query(`incr.`)
+					if err != nil {
+						return false, err
+					}
+					defer sols.Close()
+					return sols.Next(), sols.Err()
+				}()
+				assert.NoError(t, err)
+				if ok {
+					m++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var s struct {
+		L []int
+	}
+	assert.NoError(t, i.QuerySolution(`findall(X, counter(X), L).`).Scan(&s))
+	assert.Equal(t, []int{400}, s.L)
 }
 
 func TestInterpreter_Query(t *testing.T) {
@@ -101,6 +226,20 @@ func TestInterpreter_Query(t *testing.T) {
 		assert.Equal(t, map[string]interface{}{}, m)
 	})
 
+	t.Run("close", func(t *testing.T) {
+		var i Interpreter
+		i.Register0("repeat", i.Repeat)
+
+		sols, err := i.Query(`repeat.`)
+		assert.NoError(t, err)
+
+		assert.True(t, sols.Next())
+		assert.True(t, sols.Next())
+		assert.NoError(t, sols.Close())
+		assert.False(t, sols.Next())
+		assert.NoError(t, sols.Err())
+	})
+
 	t.Run("scan to struct", func(t *testing.T) {
 		var i Interpreter
 		assert.NoError(t, i.Exec("foo(a, 1, 2.0, [abc, def])."))
@@ -128,219 +267,2038 @@ func TestInterpreter_Query(t *testing.T) {
 	})
 }
 
-func TestMisc(t *testing.T) {
-	t.Run("negation", func(t *testing.T) {
-		i := New(nil, nil)
-		sols, err := i.Query(`\+true.`)
-		assert.NoError(t, err)
+func TestInterpreter_QuerySolution(t *testing.T) {
+	i := New(nil, nil)
+	assert.NoError(t, i.Exec(`
+foo(a).
+foo(b).
+`))
 
-		assert.False(t, sols.Next())
+	t.Run("ok", func(t *testing.T) {
+		sol := i.QuerySolution(`foo(X).`)
+		assert.NoError(t, sol.Err())
+		var s struct {
+			X string
+		}
+		assert.NoError(t, sol.Scan(&s))
+		assert.Equal(t, "a", s.X)
+		assert.Equal(t, []string{"X"}, sol.Vars())
 	})
 
-	t.Run("cut", func(t *testing.T) {
-		// https://www.cs.uleth.ca/~gaur/post/prolog-cut-negation/
-		t.Run("p", func(t *testing.T) {
-			i := New(nil, nil)
-			assert.NoError(t, i.Exec(`
-p(a).
-p(b):-!.
-p(c).
-`))
+	t.Run("no solutions", func(t *testing.T) {
+		sol := i.QuerySolution(`foo(c).`)
+		assert.Equal(t, ErrNoSolutions, sol.Err())
+		assert.Equal(t, ErrNoSolutions, sol.Scan(&struct{}{}))
+	})
 
-			t.Run("single", func(t *testing.T) {
-				sols, err := i.Query(`p(X).`)
-				assert.NoError(t, err)
-				defer sols.Close()
+	t.Run("error", func(t *testing.T) {
+		sol := i.QuerySolution(`throw(oops).`)
+		assert.Error(t, sol.Err())
+	})
 
-				var s struct {
-					X string
-				}
+	t.Run("syntax error", func(t *testing.T) {
+		sol := i.QuerySolution(`foo(`)
+		assert.Error(t, sol.Err())
+	})
+}
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, "a", s.X)
+func TestInterpreter_QueryOne(t *testing.T) {
+	i := New(nil, nil)
+	assert.NoError(t, i.Exec(`
+foo(a).
+foo(b).
+`))
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, "b", s.X)
+	t.Run("deterministic", func(t *testing.T) {
+		sol := i.QueryOne(`X = a.`)
+		assert.NoError(t, sol.Err())
+		var s struct {
+			X string
+		}
+		assert.NoError(t, sol.Scan(&s))
+		assert.Equal(t, "a", s.X)
+	})
 
-				assert.False(t, sols.Next())
-			})
+	t.Run("one solution with choice points", func(t *testing.T) {
+		sol := i.QueryOne(`foo(a).`)
+		assert.NoError(t, sol.Err())
+	})
 
-			t.Run("double", func(t *testing.T) {
-				sols, err := i.Query(`p(X), p(Y).`)
-				assert.NoError(t, err)
-				defer sols.Close()
+	t.Run("multiple solutions", func(t *testing.T) {
+		sol := i.QueryOne(`foo(X).`)
+		assert.Equal(t, ErrMultipleSolutions, sol.Err())
+	})
 
-				var s struct {
-					X string
-					Y string
-				}
+	t.Run("multiple solutions in catch", func(t *testing.T) {
+		sol := i.QueryOne(`catch(foo(X), _, true).`)
+		assert.Equal(t, ErrMultipleSolutions, sol.Err())
+	})
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, "a", s.X)
-				assert.Equal(t, "a", s.Y)
+	t.Run("no solutions", func(t *testing.T) {
+		sol := i.QueryOne(`foo(c).`)
+		assert.Equal(t, ErrNoSolutions, sol.Err())
+	})
+}
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, "a", s.X)
-				assert.Equal(t, "b", s.Y)
+func TestSolutions_Deterministic(t *testing.T) {
+	i := New(nil, nil)
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, "b", s.X)
-				assert.Equal(t, "a", s.Y)
+	t.Run("deterministic", func(t *testing.T) {
+		sols, err := i.Query(`X = a.`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, "b", s.X)
-				assert.Equal(t, "b", s.Y)
+		assert.True(t, sols.Next())
+		assert.True(t, sols.Deterministic())
+	})
 
-				assert.False(t, sols.Next())
-			})
-		})
+	t.Run("nondeterministic", func(t *testing.T) {
+		sols, err := i.Query(`X = a; X = b.`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
 
-		// http://www.cse.unsw.edu.au/~billw/dictionaries/prolog/cut.html
-		t.Run("teaches", func(t *testing.T) {
-			i := New(nil, nil)
-			assert.NoError(t, i.Exec(`
-teaches(dr_fred, history).
-teaches(dr_fred, english).
-teaches(dr_fred, drama).
-teaches(dr_fiona, physics).
-studies(alice, english).
-studies(angus, english).
-studies(amelia, drama).
-studies(alex, physics).
-`))
+		assert.True(t, sols.Next())
+		assert.False(t, sols.Deterministic())
+		assert.True(t, sols.Next())
+		assert.True(t, sols.Deterministic())
+	})
 
-			t.Run("without cut", func(t *testing.T) {
-				sols, err := i.Query(`teaches(dr_fred, Course), studies(Student, Course).`)
-				assert.NoError(t, err)
-				defer func() {
-					assert.NoError(t, sols.Close())
-				}()
+	t.Run("catch", func(t *testing.T) {
+		sols, err := i.Query(`catch((X = a; X = b; X = c), _, true).`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
 
-				type cs struct {
-					Course  string
-					Student string
-				}
-				var s cs
+		assert.True(t, sols.Next())
+		assert.False(t, sols.Deterministic())
+		assert.True(t, sols.Next())
+		assert.False(t, sols.Deterministic())
+		assert.True(t, sols.Next())
+		assert.True(t, sols.Deterministic())
+		assert.False(t, sols.Next())
+	})
+}
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, cs{
-					Course:  "english",
-					Student: "alice",
-				}, s)
+func TestSolutions_Collect(t *testing.T) {
+	i := New(nil, nil)
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, cs{
-					Course:  "english",
-					Student: "angus",
-				}, s)
+	t.Run("limit", func(t *testing.T) {
+		sols, err := i.Query(`X = a; X = b; X = c.`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, cs{
-					Course:  "drama",
-					Student: "amelia",
-				}, s)
+		ms, err := sols.Collect(2)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]term.Interface{
+			{"X": term.Atom("a")},
+			{"X": term.Atom("b")},
+		}, ms)
+		assert.False(t, sols.Deterministic())
+	})
 
-				assert.False(t, sols.Next())
-			})
+	t.Run("all", func(t *testing.T) {
+		sols, err := i.Query(`X = a; X = b; X = c.`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
 
-			t.Run("with cut in the middle", func(t *testing.T) {
-				sols, err := i.Query(`teaches(dr_fred, Course), !, studies(Student, Course).`)
-				assert.NoError(t, err)
-				defer func() {
-					assert.NoError(t, sols.Close())
-				}()
+		ms, err := sols.Collect(-1)
+		assert.NoError(t, err)
+		assert.Len(t, ms, 3)
+		assert.True(t, sols.Deterministic())
+	})
 
-				assert.False(t, sols.Next())
-			})
+	t.Run("error", func(t *testing.T) {
+		sols, err := i.Query(`X = a; throw(oops).`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
 
-			t.Run("with cut at the end", func(t *testing.T) {
-				sols, err := i.Query(`teaches(dr_fred, Course), studies(Student, Course), !.`)
-				assert.NoError(t, err)
-				defer func() {
-					assert.NoError(t, sols.Close())
-				}()
+		ms, err := sols.Collect(-1)
+		assert.Error(t, err)
+		assert.Equal(t, []map[string]term.Interface{
+			{"X": term.Atom("a")},
+		}, ms)
+	})
+}
 
-				type cs struct {
-					Course  string
-					Student string
-				}
-				var s cs
+type color int
+
+func (c *color) UnmarshalProlog(t term.Interface) error {
+	switch t {
+	case term.Atom("red"):
+		*c = 1
+	case term.Atom("green"):
+		*c = 2
+	default:
+		return errors.New("unknown color")
+	}
+	return nil
+}
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, cs{
-					Course:  "english",
-					Student: "alice",
-				}, s)
+func TestSolutions_Scan(t *testing.T) {
+	i := New(nil, nil)
 
-				assert.False(t, sols.Next())
-			})
+	type person struct {
+		Name string
+		Age  int
+	}
 
-			t.Run("with cut at the beginning", func(t *testing.T) {
-				sols, err := i.Query(`!, teaches(dr_fred, Course), studies(Student, Course).`)
-				assert.NoError(t, err)
-				defer func() {
-					assert.NoError(t, sols.Close())
-				}()
+	t.Run("struct by position", func(t *testing.T) {
+		var s struct {
+			P person
+		}
+		assert.NoError(t, i.QuerySolution(`P = person(alice, 30).`).Scan(&s))
+		assert.Equal(t, person{Name: "alice", Age: 30}, s.P)
+	})
 
-				type cs struct {
-					Course  string
-					Student string
-				}
-				var s cs
+	t.Run("struct by name", func(t *testing.T) {
+		var s struct {
+			P struct {
+				Name    string `prolog:"name"`
+				Age     int    `prolog:"age"`
+				Ignored string `prolog:"-"`
+			}
+		}
+		assert.NoError(t, i.QuerySolution(`P = [age-30, name-alice].`).Scan(&s))
+		assert.Equal(t, "alice", s.P.Name)
+		assert.Equal(t, 30, s.P.Age)
+	})
 
-				assert.True(t, sols.Next())
-				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, cs{
-					Course:  "english",
-					Student: "alice",
-				}, s)
+	t.Run("map", func(t *testing.T) {
+		var s struct {
+			M map[string]int
+		}
+		assert.NoError(t, i.QuerySolution(`M = [a-1, b-2].`).Scan(&s))
+		assert.Equal(t, map[string]int{"a": 1, "b": 2}, s.M)
+	})
+
+	t.Run("bool, uint, float, pointer", func(t *testing.T) {
+		var s struct {
+			B bool
+			U uint8
+			F float64
+			P *person
+			N *int
+		}
+		assert.NoError(t, i.QuerySolution(`B = true, U = 255, F = 1, P = person(bob, 40).`).Scan(&s))
+		assert.True(t, s.B)
+		assert.Equal(t, uint8(255), s.U)
+		assert.Equal(t, 1.0, s.F)
+		assert.Equal(t, &person{Name: "bob", Age: 40}, s.P)
+		assert.Nil(t, s.N)
+	})
+
+	t.Run("time", func(t *testing.T) {
+		var s struct {
+			T, U time.Time
+		}
+		assert.NoError(t, i.QuerySolution(`T = 1600000000, U = '2020-09-13T12:26:40Z'.`).Scan(&s))
+		assert.True(t, s.T.Equal(s.U))
+	})
+
+	t.Run("unmarshaler", func(t *testing.T) {
+		var s struct {
+			C  color
+			Cs []color
+		}
+		assert.NoError(t, i.QuerySolution(`C = red, Cs = [green, red].`).Scan(&s))
+		assert.Equal(t, color(1), s.C)
+		assert.Equal(t, []color{2, 1}, s.Cs)
+
+		err := i.QuerySolution(`C = blue.`).Scan(&s)
+		var e *ScanError
+		assert.True(t, errors.As(err, &e))
+		assert.Equal(t, "C", e.Var)
+		assert.Equal(t, "unknown color", e.Err.Error())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var s struct {
+			P person
+		}
+		var b struct {
+			I int8
+		}
+		assert.Error(t, i.QuerySolution(`I = 300.`).Scan(&b))
+
+		err := i.QuerySolution(`P = person(alice, old).`).Scan(&s)
+		var e *ScanError
+		assert.True(t, errors.As(err, &e))
+		assert.Equal(t, "P", e.Var)
+		assert.Equal(t, term.Atom("old"), e.Term)
+		assert.Equal(t, reflect.TypeOf(0), e.Type)
+		assert.Equal(t, "failed to convert old of P into int", err.Error())
+
+		var u struct {
+			U uint
+		}
+		assert.Error(t, i.QuerySolution(`U = -1.`).Scan(&u))
+	})
+}
+
+func TestInterpreter_Assert(t *testing.T) {
+	type person struct {
+		Name  string
+		Age   int
+		Admin bool
+	}
+
+	i := New(nil, nil)
+	assert.NoError(t, i.Assert(person{Name: "alice", Age: 30, Admin: true}))
+	assert.NoError(t, i.Assert(&person{Name: "bob", Age: 40}))
+	assert.Error(t, i.Assert(make(chan int)))
+
+	sols, err := i.Query(`P = person(_, _, _), P, P = person(_, ?, _).`, 40)
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, sols.Close())
+	}()
+
+	assert.True(t, sols.Next())
+	var s struct {
+		P person
+	}
+	assert.NoError(t, sols.Scan(&s))
+	assert.Equal(t, person{Name: "bob", Age: 40}, s.P)
+	assert.False(t, sols.Next())
+}
+
+func TestInterpreter_QueryTerm(t *testing.T) {
+	i := New(nil, nil)
+
+	// The atoms are never parsed so that they can't inject goals.
+	for _, name := range []string{"alice", "bob', halt, '", "a, b"} {
+		assert.NoError(t, i.AssertTerm(term.NewCompound("user", term.Atom(name))))
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		x := term.Vars("X")
+		sols, err := i.QueryTerm(term.NewCompound("user", x[0]))
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.Equal(t, []string{"X"}, sols.Vars())
+		var names []string
+		for sols.Next() {
+			var s struct {
+				X string
+			}
+			assert.NoError(t, sols.Scan(&s))
+			names = append(names, s.X)
+		}
+		assert.NoError(t, sols.Err())
+		assert.Equal(t, []string{"alice", "bob', halt, '", "a, b"}, names)
+	})
+
+	t.Run("retract", func(t *testing.T) {
+		ok, err := i.RetractTerm(term.NewCompound("user", term.Atom("a, b")))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = i.RetractTermContext(context.Background(), term.NewCompound("user", term.Atom("a, b")))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		sols, err := i.QueryTermContext(context.Background(), term.NewCompound("user", term.Atom("a, b")))
+		assert.NoError(t, err)
+		assert.False(t, sols.Next())
+		assert.NoError(t, sols.Close())
+	})
+
+	t.Run("sandboxed", func(t *testing.T) {
+		i := NewSandboxed(nil, nil)
+		_, err := i.QueryTerm(term.NewCompound("halt", term.Integer(0)))
+		assert.Error(t, err)
+	})
+}
+
+func TestInterpreter_RegisterFunc(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+
+	i := New(nil, nil)
+	assert.NoError(t, i.RegisterFunc("add", func(a, b int) int {
+		return a + b
+	}))
+	assert.NoError(t, i.RegisterFunc("sum", func(xs []float64) float64 {
+		var s float64
+		for _, x := range xs {
+			s += x
+		}
+		return s
+	}))
+	assert.NoError(t, i.RegisterFunc("swap", func(p point) (point, error) {
+		return point{X: p.Y, Y: p.X}, nil
+	}))
+	assert.NoError(t, i.RegisterFunc("greet", func(ctx context.Context, name string) (string, error) {
+		if ctx == nil {
+			return "", errors.New("no context")
+		}
+		if name == "" {
+			return "", errors.New("empty name")
+		}
+		return "hello, " + name, nil
+	}))
+	assert.NoError(t, i.RegisterFunc("nop", func() {}))
+	assert.NoError(t, i.RegisterFunc("byte", func(b uint8) int {
+		return int(b)
+	}))
+	assert.NoError(t, i.RegisterFunc("chan", func() chan int {
+		return make(chan int)
+	}))
+
+	assert.Error(t, i.RegisterFunc("foo", nil))
+	assert.Error(t, i.RegisterFunc("foo", 1))
+	assert.Error(t, i.RegisterFunc("foo", fmt.Sprintf))
+	assert.NoError(t, i.RegisterFunc("sum6", func(a, b, c, d, e, f int) int {
+		return a + b + c + d + e + f
+	}))
+
+	tests := []struct {
+		query string
+		ok    bool
+		err   error
+		vars  map[string]interface{}
+	}{
+		{query: `add(1, 2, X).`, ok: true, vars: map[string]interface{}{"X": 3}},
+		{query: `add(1, 2, 3).`, ok: true},
+		{query: `add(1, 2, 4).`, ok: false},
+		{query: `sum([1, 2.5], X).`, ok: true, vars: map[string]interface{}{"X": 3.5}},
+		{query: `swap(point(1, 2), P).`, ok: true, vars: map[string]interface{}{"P": point{X: 2, Y: 1}}},
+		{query: `greet(alice, X).`, ok: true, vars: map[string]interface{}{"X": "hello, alice"}},
+		{query: `nop.`, ok: true},
+		{query: `sum6(1, 2, 3, 4, 5, 6, X).`, ok: true, vars: map[string]interface{}{"X": 21}},
+		{query: `add(X, 2, Y).`, err: &engine.Exception{Term: &term.Compound{
+			Functor: "error",
+			Args:    []term.Interface{term.Atom("instantiation_error"), term.Atom("X is not instantiated.")},
+		}}},
+		{query: `add(a, 2, Y).`, err: &engine.Exception{Term: &term.Compound{
+			Functor: "error",
+			Args: []term.Interface{
+				&term.Compound{Functor: "type_error", Args: []term.Interface{term.Atom("integer"), term.Atom("a")}},
+				term.Atom("a is not an integer."),
+			},
+		}}},
+		{query: `sum([1, a], X).`, err: &engine.Exception{Term: &term.Compound{
+			Functor: "error",
+			Args: []term.Interface{
+				&term.Compound{Functor: "type_error", Args: []term.Interface{term.Atom("number"), term.Atom("a")}},
+				term.Atom("a is not a number."),
+			},
+		}}},
+		{query: `sum([1|T], X).`, err: &engine.Exception{Term: &term.Compound{
+			Functor: "error",
+			Args:    []term.Interface{term.Atom("instantiation_error"), term.Atom("T is not instantiated.")},
+		}}},
+		{query: `greet('', X).`, err: &engine.Exception{Term: &term.Compound{
+			Functor: "error",
+			Args:    []term.Interface{term.Atom("system_error"), term.Atom("empty name")},
+		}}},
+		{query: `catch(greet('', _), error(system_error, _), true).`, ok: true},
+		{query: `byte(300, X).`, err: &engine.Exception{Term: &term.Compound{
+			Functor: "error",
+			Args: []term.Interface{
+				&term.Compound{Functor: "representation_error", Args: []term.Interface{term.Atom("max_integer")}},
+				term.Atom("300 is out of range of uint8."),
+			},
+		}}},
+		{query: `catch(byte(-1, _), error(representation_error(min_integer), _), true).`, ok: true},
+		{query: `catch(chan(_), error(system_error, _), true).`, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			sols, err := i.Query(tt.query)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.Equal(t, tt.ok, sols.Next())
+			assert.Equal(t, tt.err, sols.Err())
+			for n, v := range tt.vars {
+				p := reflect.New(reflect.TypeOf(v))
+				m := map[string]interface{}{}
+				assert.NoError(t, sols.Scan(m))
+				val, err := convert(m[n].(term.Interface), p.Elem().Type(), nil)
+				assert.NoError(t, err)
+				assert.Equal(t, v, val.Interface())
+			}
+		})
+	}
+}
+
+// pages is an Iterator over the numbers from 1 to n fetched page by page.
+type pages struct {
+	n, size int
+	buf     []int
+	fetched int
+	closed  int
+}
+
+func (p *pages) Next(context.Context) ([]interface{}, bool, error) {
+	if len(p.buf) == 0 {
+		for j := 0; j < p.size && p.fetched < p.n; j++ {
+			p.fetched++
+			p.buf = append(p.buf, p.fetched)
+		}
+	}
+	if len(p.buf) == 0 {
+		return nil, false, nil
+	}
+	var x int
+	x, p.buf = p.buf[0], p.buf[1:]
+	return []interface{}{x, x * x}, true, nil
+}
+
+func (p *pages) Close() error {
+	p.closed++
+	return nil
+}
+
+func TestInterpreter_RegisterNondet(t *testing.T) {
+	var p *pages
+	i := New(nil, nil)
+	assert.NoError(t, i.RegisterNondet("square", 2, func(n int) *pages {
+		p = &pages{n: n, size: 2}
+		return p
+	}))
+	assert.NoError(t, i.RegisterNondet("fail", 1, func(ctx context.Context) (Iterator, error) {
+		return IteratorFunc(func(context.Context) ([]interface{}, bool, error) {
+			return nil, false, errors.New("failed")
+		}), nil
+	}))
+	assert.NoError(t, i.RegisterNondet("short", 2, func() Iterator {
+		return IteratorFunc(func(context.Context) ([]interface{}, bool, error) {
+			return []interface{}{1}, true, nil
+		})
+	}))
+	assert.NoError(t, i.RegisterNondet("empty", 1, func() Iterator {
+		return nil
+	}))
+	assert.Error(t, i.RegisterNondet("foo", 1, func() int { return 0 }))
+	assert.EqualError(t, i.RegisterNondet("foo", -1, func() Iterator { return nil }), "negative number of outputs: -1")
+
+	t.Run("exhausted", func(t *testing.T) {
+		sols, err := i.Query(`square(5, X, Y).`)
+		assert.NoError(t, err)
+
+		var xs, ys []int
+		for sols.Next() {
+			var s struct {
+				X, Y int
+			}
+			assert.NoError(t, sols.Scan(&s))
+			xs = append(xs, s.X)
+			ys = append(ys, s.Y)
+		}
+		assert.NoError(t, sols.Err())
+		assert.Equal(t, []int{1, 2, 3, 4, 5}, xs)
+		assert.Equal(t, []int{1, 4, 9, 16, 25}, ys)
+		assert.Equal(t, 1, p.closed)
+		assert.NoError(t, sols.Close())
+		assert.Equal(t, 1, p.closed)
+	})
+
+	t.Run("lazy", func(t *testing.T) {
+		sols, err := i.Query(`square(100, X, Y).`)
+		assert.NoError(t, err)
+
+		assert.True(t, sols.Next())
+		assert.Equal(t, 2, p.fetched)
+		assert.Equal(t, 0, p.closed)
+
+		assert.NoError(t, sols.Close())
+		assert.Equal(t, 1, p.closed)
+	})
+
+	t.Run("cut", func(t *testing.T) {
+		sols, err := i.Query(`square(100, X, Y), Y > 10, !.`)
+		assert.NoError(t, err)
+
+		assert.True(t, sols.Next())
+		var s struct {
+			X int
+		}
+		assert.NoError(t, sols.Scan(&s))
+		assert.Equal(t, 4, s.X)
+		assert.Equal(t, 4, p.fetched)
+		assert.Equal(t, 1, p.closed)
+		assert.False(t, sols.Next())
+		assert.NoError(t, sols.Close())
+		assert.Equal(t, 1, p.closed)
+	})
+
+	t.Run("unify", func(t *testing.T) {
+		sols, err := i.Query(`square(5, X, 9).`)
+		assert.NoError(t, err)
+		var xs []int
+		for sols.Next() {
+			var s struct {
+				X int
+			}
+			assert.NoError(t, sols.Scan(&s))
+			xs = append(xs, s.X)
+		}
+		assert.NoError(t, sols.Err())
+		assert.Equal(t, []int{3}, xs)
+		assert.NoError(t, sols.Close())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		sols, err := i.Query(`fail(X).`)
+		assert.NoError(t, err)
+		assert.False(t, sols.Next())
+		assert.Equal(t, &engine.Exception{Term: &term.Compound{
+			Functor: "error",
+			Args:    []term.Interface{term.Atom("system_error"), term.Atom("failed")},
+		}}, sols.Err())
+		assert.NoError(t, sols.Close())
+	})
+
+	t.Run("wrong number of values", func(t *testing.T) {
+		sols, err := i.Query(`short(X, Y).`)
+		assert.NoError(t, err)
+		assert.False(t, sols.Next())
+		assert.Equal(t, &engine.Exception{Term: &term.Compound{
+			Functor: "error",
+			Args:    []term.Interface{term.Atom("system_error"), term.Atom("expected 2 values, got 1")},
+		}}, sols.Err())
+		assert.NoError(t, sols.Close())
+
+		assert.NoError(t, i.QuerySolution(`catch(short(_, _), error(system_error, _), true).`).Err())
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		sols, err := i.Query(`empty(X).`)
+		assert.NoError(t, err)
+		assert.False(t, sols.Next())
+		assert.NoError(t, sols.Err())
+		assert.NoError(t, sols.Close())
+	})
+}
+
+func TestInterpreter_AssertFacts(t *testing.T) {
+	type user struct {
+		_     struct{} `prolog:"member"`
+		Name  string
+		Email string `prolog:"-"`
+		Age   int
+	}
+
+	i := New(nil, nil)
+	assert.NoError(t, i.AssertFacts("age/2", [][]interface{}{
+		{"alice", 30},
+		{"bob", 40},
+	}))
+	assert.NoError(t, i.AssertStructs("", []user{{Name: "alice", Age: 30}}))
+	assert.NoError(t, i.AssertStructs("person", []*user{{Name: "bob", Age: 40}}))
+	assert.NoError(t, i.AssertStructs("person", []user{}))
+
+	assert.Error(t, i.AssertFacts("age", nil))
+	assert.Error(t, i.AssertFacts("age/two", nil))
+	assert.Error(t, i.AssertFacts("age/2", [][]interface{}{{"carol"}}))
+	assert.Error(t, i.AssertFacts("age/1", [][]interface{}{{make(chan int)}}))
+	assert.Error(t, i.AssertStructs("person", user{}))
+	assert.Error(t, i.AssertStructs("person", []int{1}))
+	assert.Error(t, i.AssertStructs("", []interface{}{user{Name: "carol", Age: 50}, struct{ Name string }{Name: "dave"}}))
+	assert.Error(t, i.AssertStructs("person", []interface{}{user{Name: "carol", Age: 50}, struct{ Name string }{Name: "dave"}}))
+	assert.NoError(t, i.AssertStructs("", []interface{}{user{Name: "erin", Age: 60}, &user{Name: "frank", Age: 70}}))
+
+	for _, q := range []string{
+		`age(alice, 30), age(bob, 40).`,
+		`member(alice, 30).`,
+		`person(bob, 40).`,
+		`member(erin, 60), member(frank, 70).`,
+		`\+person(carol, 50).`,
+	} {
+		sol := i.QuerySolution(q)
+		assert.NoError(t, sol.Err(), q)
+	}
+}
+
+func TestInterpreter_csv(t *testing.T) {
+	f, err := ioutil.TempFile("", "*.csv")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.Remove(f.Name()))
+	}()
+	_, err = f.WriteString("alice,30\nbob,40\n")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	i := New(nil, nil)
+	assert.NoError(t, i.Exec(`
+load(File) :- csv_read_file(File, Rows, [functor(age)]), assert_all(Rows).
+assert_all([]).
+assert_all([R|Rs]) :- assertz(R), assert_all(Rs).
+`))
+	assert.NoError(t, i.QuerySolution(`load(?).`, f.Name()).Err())
+
+	var s struct {
+		A int
+	}
+	assert.NoError(t, i.QuerySolution(`age(bob, A).`).Scan(&s))
+	assert.Equal(t, 40, s.A)
+
+	assert.NoError(t, i.QuerySolution(`csv_load_file(?, [functor(user)]).`, f.Name()).Err())
+	assert.NoError(t, i.QuerySolution(`user(alice, A).`).Scan(&s))
+	assert.Equal(t, 30, s.A)
+}
+
+func TestInterpreter_Query_named(t *testing.T) {
+	i := New(nil, nil)
+	assert.NoError(t, i.Exec(`user(:id, :name).`, Named{"id": 1, "name": "alice"}))
+	assert.NoError(t, i.Exec(`user(2, bob).`))
+
+	t.Run("named", func(t *testing.T) {
+		var s struct {
+			Name string
+		}
+		assert.NoError(t, i.QuerySolution(`user(:id, Name).`, Named{"id": 2}).Scan(&s))
+		assert.Equal(t, "bob", s.Name)
+	})
+
+	t.Run("fields", func(t *testing.T) {
+		var s struct {
+			Name string
+		}
+		assert.NoError(t, i.QuerySolution(`user(:id, Name).`, NamedFields(struct {
+			ID int `prolog:"id"`
+		}{ID: 1})).Scan(&s))
+		assert.Equal(t, "alice", s.Name)
+	})
+
+	t.Run("variable", func(t *testing.T) {
+		var s struct {
+			ID   int
+			Name string
+		}
+		assert.NoError(t, i.QuerySolution(`user(:id, :name).`, Named{"id": term.Variable("ID"), "name": "bob"}).Scan(&s))
+		assert.Equal(t, 2, s.ID)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := i.Query(`user(:id, Name).`, Named{})
+		assert.Error(t, err)
+	})
+
+	t.Run("unused", func(t *testing.T) {
+		_, err := i.Query(`user(:id, Name).`, Named{"id": 1, "name": "alice"})
+		assert.Error(t, err)
+	})
+
+	t.Run("later clauses", func(t *testing.T) {
+		i := New(nil, nil)
+		assert.NoError(t, i.Exec(`
+user(:id, :name).
+admin(:id).
+`, Named{"id": 1, "name": "alice"}))
+		assert.NoError(t, i.Exec(`
+user(?, ?).
+admin(?).
+`, 2, "bob", 2))
+
+		var s struct {
+			Name string
+		}
+		assert.NoError(t, i.QuerySolution(`admin(1), user(1, Name).`).Scan(&s))
+		assert.Equal(t, "alice", s.Name)
+		assert.NoError(t, i.QuerySolution(`admin(2), user(2, Name).`).Scan(&s))
+		assert.Equal(t, "bob", s.Name)
+
+		assert.EqualError(t, i.Exec(`
+user(:id, alice).
+admin(:id).
+`, Named{"id": 3, "name": "carol"}), "no placeholders for arguments: :name")
+		assert.Error(t, i.Exec(`
+user(?, ?).
+admin(?).
+`, 4, "dave", 4, 5))
+		assert.Error(t, i.Exec(`
+user(?, ?).
+admin(?).
+`, 4, "dave"))
+
+		// None of the clauses are added if the placeholders don't match.
+		for _, id := range []int{3, 4} {
+			assert.Equal(t, ErrNoSolutions, i.QuerySolution(`user(?, _).`, id).Err())
+		}
+	})
+}
+
+func TestInterpreter_Prepare(t *testing.T) {
+	i := New(nil, nil)
+	assert.NoError(t, i.Exec(`
+user(1, alice).
+user(2, bob).
+`))
+
+	t.Run("positional", func(t *testing.T) {
+		stmt, err := i.Prepare(`user(?, Name).`)
+		assert.NoError(t, err)
+
+		for id, name := range map[int]string{1: "alice", 2: "bob"} {
+			sols, err := stmt.Query(context.Background(), id)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"Name"}, sols.Vars())
+
+			assert.True(t, sols.Next())
+			var s struct {
+				Name string
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, name, s.Name)
+			assert.False(t, sols.Next())
+			assert.NoError(t, sols.Close())
+		}
+
+		_, err = stmt.Query(context.Background())
+		assert.Error(t, err)
+	})
+
+	t.Run("named", func(t *testing.T) {
+		stmt, err := i.Prepare(`user(:id, Name), user(:id, Name).`)
+		assert.NoError(t, err)
+
+		sols, err := stmt.Query(context.Background(), Named{"id": 2})
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.True(t, sols.Next())
+		var s struct {
+			Name string
+		}
+		assert.NoError(t, sols.Scan(&s))
+		assert.Equal(t, "bob", s.Name)
+
+		_, err = stmt.Query(context.Background(), Named{})
+		assert.Error(t, err)
+		_, err = stmt.Query(context.Background(), Named{"id": 1, "name": "alice"})
+		assert.Error(t, err)
+		_, err = stmt.Query(context.Background(), 1)
+		assert.Error(t, err)
+	})
+
+	t.Run("variable", func(t *testing.T) {
+		stmt, err := i.Prepare(`user(?, ?).`)
+		assert.NoError(t, err)
+
+		sols, err := stmt.Query(context.Background(), term.Variable("ID"), "alice")
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.True(t, sols.Next())
+		var s struct {
+			ID int
+		}
+		assert.NoError(t, sols.Scan(&s))
+		assert.Equal(t, 1, s.ID)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		stmt, err := i.Prepare(`user(?, Name).`)
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for n := 0; n < 10; n++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				sols, err := stmt.Query(context.Background(), id)
+				assert.NoError(t, err)
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Close())
+			}(n%2 + 1)
+		}
+		wg.Wait()
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		_, err := i.Prepare(`user(?, Name`)
+		assert.Error(t, err)
+	})
+
+	t.Run("sandboxed", func(t *testing.T) {
+		i := NewSandboxed(nil, nil)
+		_, err := i.Prepare(`assertz(?).`)
+		assert.Error(t, err)
+
+		t.Run("clauses added after prepare", func(t *testing.T) {
+			i := NewSandboxed(nil, nil)
+			stmt, err := i.Prepare(`p.`)
+			assert.NoError(t, err)
+			assert.NoError(t, i.Exec(`p :- halt.`))
+
+			_, err = stmt.Query(context.Background())
+			assert.Error(t, err)
+		})
+
+		t.Run("arguments", func(t *testing.T) {
+			i := NewSandboxed(nil, nil)
+			assert.NoError(t, i.Exec(`p(X) :- X = halt.`))
+			stmt, err := i.Prepare(`p(?).`)
+			assert.NoError(t, err)
+
+			_, err = stmt.Query(context.Background(), "foo")
+			assert.NoError(t, err)
+		})
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		// The query itself is accounted for even if it calls no procedures.
+		stmt, err := i.Prepare(`!.`)
+		assert.NoError(t, err)
+
+		sols, err := stmt.Query(engine.WithLimits(context.Background(), engine.Limits{Time: time.Nanosecond}))
+		assert.NoError(t, err)
+		assert.False(t, sols.Next())
+		assert.Error(t, sols.Err())
+		assert.NoError(t, sols.Close())
+	})
+}
+
+func TestInterpreter_Limits(t *testing.T) {
+	i := New(nil, nil)
+	assert.NoError(t, i.Exec(`
+loop :- loop.
+nat(0).
+nat(N) :- nat(M), N is M + 1.
+`))
+
+	t.Run("per query", func(t *testing.T) {
+		sols, err := i.QueryContext(engine.WithLimits(context.Background(), engine.Limits{Inferences: 1000}), `loop.`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.False(t, sols.Next())
+		assert.Error(t, sols.Err())
+	})
+
+	t.Run("default", func(t *testing.T) {
+		i := i.Clone()
+		i.Limits = engine.Limits{Time: 10 * time.Millisecond}
+
+		sols, err := i.Query(`catch(loop, error(resource_error(R), _), true).`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.True(t, sols.Next())
+		var s struct {
+			R string
+		}
+		assert.NoError(t, sols.Scan(&s))
+		assert.Equal(t, "time", s.R)
+	})
+
+	t.Run("call_with_inference_limit", func(t *testing.T) {
+		sols, err := i.Query(`call_with_inference_limit(nat(X), 100, R), X >= 2.`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.True(t, sols.Next())
+		var s struct {
+			X int
+			R string
+		}
+		assert.NoError(t, sols.Scan(&s))
+		assert.Equal(t, 2, s.X)
+		assert.Equal(t, "true", s.R)
+	})
+
+	t.Run("call_with_time_limit", func(t *testing.T) {
+		sols, err := i.Query(`catch(call_with_time_limit(0.01, loop), E, true).`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.True(t, sols.Next())
+		var s struct {
+			E string
+		}
+		assert.NoError(t, sols.Scan(&s))
+		assert.Equal(t, "time_limit_exceeded", s.E)
+	})
+}
+
+func TestInterpreter_Cancel(t *testing.T) {
+	i := New(nil, nil)
+	assert.NoError(t, i.Exec(`loop :- loop.`))
+
+	t.Run("query", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		sols, err := i.QueryContext(ctx, `loop.`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.False(t, sols.Next())
+		assert.True(t, errors.Is(sols.Err(), context.DeadlineExceeded))
+	})
+
+	t.Run("exec", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		assert.True(t, errors.Is(i.ExecContext(ctx, `:- loop.`), context.Canceled))
+	})
+
+	t.Run("deadline exception", func(t *testing.T) {
+		var cleaned bool
+		i := i.Clone()
+		i.Register0("cleaned", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			cleaned = true
+			return k(env)
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		sols, err := i.QueryContext(engine.WithDeadlineException(ctx), `catch(setup_call_cleanup(true, loop, cleaned), E, true).`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.True(t, sols.Next())
+		var s struct {
+			E string
+		}
+		assert.NoError(t, sols.Scan(&s))
+		assert.Equal(t, "time_limit_exceeded", s.E)
+		assert.True(t, cleaned)
+	})
+}
+
+func TestInterpreter_Halt(t *testing.T) {
+	var cleaned bool
+	i := New(nil, nil)
+	i.Register0("cleaned", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+		cleaned = true
+		return k(env)
+	})
+
+	t.Run("query", func(t *testing.T) {
+		sols, err := i.Query(`catch(setup_call_cleanup(true, halt(3), cleaned), _, true).`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.False(t, sols.Next())
+		var h *engine.HaltError
+		assert.True(t, errors.As(sols.Err(), &h))
+		assert.Equal(t, 3, h.Code)
+		assert.True(t, cleaned)
+	})
+
+	t.Run("exec", func(t *testing.T) {
+		assert.Equal(t, &engine.HaltError{Code: 0}, i.Exec(`:- halt.`))
+	})
+}
+
+func TestNewSandboxed(t *testing.T) {
+	i := NewSandboxed(nil, nil)
+	assert.NoError(t, i.Exec(`
+foo(X) :- X = a; X = b; X = c.
+bye :- halt.
+`))
+
+	t.Run("safe", func(t *testing.T) {
+		sols, err := i.Query(`findall(X, foo(X), L), length(L, N).`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.True(t, sols.Next())
+		var s struct {
+			N int
+		}
+		assert.NoError(t, sols.Scan(&s))
+		assert.Equal(t, 3, s.N)
+	})
+
+	t.Run("unsafe query", func(t *testing.T) {
+		_, err := i.Query(`once(bye).`)
+		assert.Error(t, err)
+	})
+
+	t.Run("unsafe directive", func(t *testing.T) {
+		assert.Error(t, i.Exec(`:- op(700, xfx, ===).`))
+	})
+
+	t.Run("unsafe directive by assertz", func(t *testing.T) {
+		i := i.Clone()
+		err := i.QuerySolution(`assertz((:- op(700, xfx, foo))).`).Err()
+		assert.Contains(t, err.Error(), "permission_error(call, sandboxed, ")
+		assert.Equal(t, ErrNoSolutions, i.QuerySolution(`current_op(_, _, foo).`).Err())
+
+		err = i.QuerySolution(`assertz((:- set_prolog_flag(unknown, fail))).`).Err()
+		assert.Contains(t, err.Error(), "permission_error(call, sandboxed, ")
+		assert.NoError(t, i.QuerySolution(`current_prolog_flag(unknown, error).`).Err())
+	})
+
+	t.Run("unsafe directive by AssertTerm", func(t *testing.T) {
+		assert.Error(t, i.AssertTerm(&term.Compound{Functor: ":-", Args: []term.Interface{
+			&term.Compound{Functor: "op", Args: []term.Interface{term.Integer(700), term.Atom("xfx"), term.Atom("===")}},
+		}}))
+		assert.Error(t, i.QuerySolution(`X = (a === b).`).Err())
+	})
+
+	t.Run("halt", func(t *testing.T) {
+		sols, err := i.Clone().Query(`catch(safe_goal(halt), error(permission_error(call, sandboxed, halt(C)), _), true).`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+
+		assert.True(t, sols.Next())
+		var s struct {
+			C int
+		}
+		assert.NoError(t, sols.Scan(&s))
+		assert.Equal(t, 0, s.C)
+	})
+
+	t.Run("open", func(t *testing.T) {
+		assert.Error(t, i.QuerySolution(`open('/etc/passwd', read, _).`).Err())
+	})
+
+	t.Run("modify system predicates", func(t *testing.T) {
+		assert.Error(t, i.Exec(`append(_, _, _) :- true.`))
+		assert.Error(t, i.QuerySolution(`retract(member(_, _)).`).Err())
+	})
+
+	t.Run("csv_load_file", func(t *testing.T) {
+		// It could append facts to any predicate by functor(F).
+		err := i.QuerySolution(`csv_load_file('users.csv', [functor(foo)]).`).Err()
+		assert.Contains(t, err.Error(), "permission_error(call, sandboxed, ")
+	})
+}
+
+func TestMisc(t *testing.T) {
+	t.Run("negation", func(t *testing.T) {
+		i := New(nil, nil)
+		sols, err := i.Query(`\+true.`)
+		assert.NoError(t, err)
+
+		assert.False(t, sols.Next())
+	})
+
+	t.Run("cut", func(t *testing.T) {
+		// https://www.cs.uleth.ca/~gaur/post/prolog-cut-negation/
+		t.Run("p", func(t *testing.T) {
+			i := New(nil, nil)
+			assert.NoError(t, i.Exec(`
+p(a).
+p(b):-!.
+p(c).
+`))
+
+			t.Run("single", func(t *testing.T) {
+				sols, err := i.Query(`p(X).`)
+				assert.NoError(t, err)
+				defer sols.Close()
+
+				var s struct {
+					X string
+				}
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, "a", s.X)
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, "b", s.X)
+
+				assert.False(t, sols.Next())
+			})
+
+			t.Run("double", func(t *testing.T) {
+				sols, err := i.Query(`p(X), p(Y).`)
+				assert.NoError(t, err)
+				defer sols.Close()
+
+				var s struct {
+					X string
+					Y string
+				}
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, "a", s.X)
+				assert.Equal(t, "a", s.Y)
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, "a", s.X)
+				assert.Equal(t, "b", s.Y)
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, "b", s.X)
+				assert.Equal(t, "a", s.Y)
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, "b", s.X)
+				assert.Equal(t, "b", s.Y)
+
+				assert.False(t, sols.Next())
+			})
+		})
+
+		// http://www.cse.unsw.edu.au/~billw/dictionaries/prolog/cut.html
+		t.Run("teaches", func(t *testing.T) {
+			i := New(nil, nil)
+			assert.NoError(t, i.Exec(`
+teaches(dr_fred, history).
+teaches(dr_fred, english).
+teaches(dr_fred, drama).
+teaches(dr_fiona, physics).
+studies(alice, english).
+studies(angus, english).
+studies(amelia, drama).
+studies(alex, physics).
+`))
+
+			t.Run("without cut", func(t *testing.T) {
+				sols, err := i.Query(`teaches(dr_fred, Course), studies(Student, Course).`)
+				assert.NoError(t, err)
+				defer func() {
+					assert.NoError(t, sols.Close())
+				}()
+
+				type cs struct {
+					Course  string
+					Student string
+				}
+				var s cs
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, cs{
+					Course:  "english",
+					Student: "alice",
+				}, s)
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, cs{
+					Course:  "english",
+					Student: "angus",
+				}, s)
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, cs{
+					Course:  "drama",
+					Student: "amelia",
+				}, s)
+
+				assert.False(t, sols.Next())
+			})
+
+			t.Run("with cut in the middle", func(t *testing.T) {
+				sols, err := i.Query(`teaches(dr_fred, Course), !, studies(Student, Course).`)
+				assert.NoError(t, err)
+				defer func() {
+					assert.NoError(t, sols.Close())
+				}()
+
+				assert.False(t, sols.Next())
+			})
+
+			t.Run("with cut at the end", func(t *testing.T) {
+				sols, err := i.Query(`teaches(dr_fred, Course), studies(Student, Course), !.`)
+				assert.NoError(t, err)
+				defer func() {
+					assert.NoError(t, sols.Close())
+				}()
+
+				type cs struct {
+					Course  string
+					Student string
+				}
+				var s cs
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, cs{
+					Course:  "english",
+					Student: "alice",
+				}, s)
+
+				assert.False(t, sols.Next())
+			})
+
+			t.Run("with cut at the beginning", func(t *testing.T) {
+				sols, err := i.Query(`!, teaches(dr_fred, Course), studies(Student, Course).`)
+				assert.NoError(t, err)
+				defer func() {
+					assert.NoError(t, sols.Close())
+				}()
+
+				type cs struct {
+					Course  string
+					Student string
+				}
+				var s cs
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, cs{
+					Course:  "english",
+					Student: "alice",
+				}, s)
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, cs{
+					Course:  "english",
+					Student: "angus",
+				}, s)
+
+				assert.True(t, sols.Next())
+				assert.NoError(t, sols.Scan(&s))
+				assert.Equal(t, cs{
+					Course:  "drama",
+					Student: "amelia",
+				}, s)
+
+				assert.False(t, sols.Next())
+			})
+		})
+
+		t.Run("call/1 makes a difference", func(t *testing.T) {
+			t.Run("with", func(t *testing.T) {
+				i := New(nil, nil)
+				sols, err := i.Query(`call(!), fail; true.`)
+				assert.NoError(t, err)
+				defer sols.Close()
+
+				assert.True(t, sols.Next())
+			})
+
+			t.Run("without", func(t *testing.T) {
+				i := New(nil, nil)
+				sols, err := i.Query(`!, fail; true.`)
+				assert.NoError(t, err)
+				defer sols.Close()
+
+				assert.False(t, sols.Next())
+			})
+		})
+	})
+
+	t.Run("control constructs", func(t *testing.T) {
+		i := New(nil, nil)
+		assert.NoError(t, i.Exec(`
+p(a).
+p(b).
+p(c).
+
+disj(X) :- (X = a, ! ; X = b).
+ite(X, Y) :- (p(X), ! -> Y = then ; Y = else).
+ite_cut(X) :- (true -> p(X), ! ; fail).
+soft(X) :- (p(X) *-> true ; X = none).
+soft_none(X) :- (fail *-> X = some ; X = none).
+not_cut :- \+ (!, fail).
+call_cut(X) :- call((p(X), !)).
+`))
+
+		collect := func(t *testing.T, query string) []string {
+			sols, err := i.Query(query)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			var xs []string
+			for sols.Next() {
+				var s struct {
+					X string
+				}
+				assert.NoError(t, sols.Scan(&s))
+				xs = append(xs, s.X)
+			}
+			assert.NoError(t, sols.Err())
+			return xs
+		}
+
+		t.Run("cut in disjunction cuts the clause", func(t *testing.T) {
+			assert.Equal(t, []string{"a"}, collect(t, `disj(X).`))
+		})
+
+		t.Run("cut in condition is local", func(t *testing.T) {
+			sols, err := i.Query(`ite(X, Y).`)
+			assert.NoError(t, err)
+			defer sols.Close()
+
+			var s struct {
+				X, Y string
+			}
+			assert.True(t, sols.Next())
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, "a", s.X)
+			assert.Equal(t, "then", s.Y)
+			assert.False(t, sols.Next())
+		})
+
+		t.Run("cut in then branch cuts the clause", func(t *testing.T) {
+			assert.Equal(t, []string{"a"}, collect(t, `ite_cut(X).`))
+		})
+
+		t.Run("soft-cut keeps alternatives of condition", func(t *testing.T) {
+			assert.Equal(t, []string{"a", "b", "c"}, collect(t, `soft(X).`))
+			assert.Equal(t, []string{"none"}, collect(t, `soft_none(X).`))
+		})
+
+		t.Run("if-then without else fails if condition fails", func(t *testing.T) {
+			assert.Empty(t, collect(t, `(fail -> X = a).`))
+			assert.Equal(t, []string{"a"}, collect(t, `(p(X) -> true).`))
+		})
+
+		t.Run("cut in negation is local", func(t *testing.T) {
+			assert.Equal(t, []string{""}, collect(t, `not_cut.`))
+		})
+
+		t.Run("cut in call/1 is local", func(t *testing.T) {
+			assert.Equal(t, []string{"a"}, collect(t, `call_cut(X).`))
+			assert.Equal(t, []string{"a", "b"}, collect(t, `(call((p(X), !)) ; X = b).`))
+		})
+
+		t.Run("call/1 with a variable goal", func(t *testing.T) {
+			assert.Equal(t, []string{"a", "b", "c"}, collect(t, `G = p(X), call(G).`))
+			assert.Equal(t, []string{"a", "b"}, collect(t, `G = (X = a ; X = b), G.`))
+		})
+
+		t.Run("clause/2 keeps a disjunction as a single clause", func(t *testing.T) {
+			sols, err := i.Query(`findall(B, clause(disj(_), B), Bs), length(Bs, N).`)
+			assert.NoError(t, err)
+			defer sols.Close()
+
+			var s struct {
+				N int
+			}
+			assert.True(t, sols.Next())
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, 1, s.N)
+		})
+	})
+
+	t.Run("setup_call_cleanup", func(t *testing.T) {
+		var cleaned int
+		i := New(nil, nil)
+		i.Register0("cleanup", func(k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			cleaned++
+			return k(env)
+		})
+
+		run := func(t *testing.T, query string, n int) {
+			cleaned = 0
+			sols, err := i.Query(query)
+			assert.NoError(t, err)
+			for j := 0; j < n; j++ {
+				assert.True(t, sols.Next())
+			}
+			assert.NoError(t, sols.Close())
+			assert.Equal(t, 1, cleaned)
+		}
+
+		t.Run("deterministic", func(t *testing.T) {
+			cleaned = 0
+			sols, err := i.Query(`setup_call_cleanup(true, true, cleanup).`)
+			assert.NoError(t, err)
+			assert.True(t, sols.Next())
+			assert.Equal(t, 1, cleaned)
+			assert.NoError(t, sols.Close())
+			assert.Equal(t, 1, cleaned)
+		})
+
+		t.Run("nondeterministic", func(t *testing.T) {
+			cleaned = 0
+			sols, err := i.Query(`setup_call_cleanup(true, (X = a; X = b), cleanup).`)
+			assert.NoError(t, err)
+			assert.True(t, sols.Next())
+			assert.Equal(t, 0, cleaned)
+			assert.True(t, sols.Next())
+			assert.Equal(t, 1, cleaned)
+			assert.False(t, sols.Next())
+			assert.NoError(t, sols.Close())
+			assert.Equal(t, 1, cleaned)
+		})
+
+		t.Run("failure", func(t *testing.T) {
+			run(t, `setup_call_cleanup(true, fail, cleanup); true.`, 1)
+		})
+
+		t.Run("exception", func(t *testing.T) {
+			run(t, `catch(setup_call_cleanup(true, throw(e), cleanup), e, true).`, 1)
+		})
+
+		t.Run("cut", func(t *testing.T) {
+			run(t, `setup_call_cleanup(true, (X = a; X = b), cleanup), !.`, 1)
+		})
+
+		t.Run("close", func(t *testing.T) {
+			run(t, `setup_call_cleanup(true, (X = a; X = b), cleanup).`, 1)
+		})
+
+		t.Run("setup fails", func(t *testing.T) {
+			cleaned = 0
+			sols, err := i.Query(`setup_call_cleanup(fail, true, cleanup).`)
+			assert.NoError(t, err)
+			assert.False(t, sols.Next())
+			assert.NoError(t, sols.Close())
+			assert.Equal(t, 0, cleaned)
+		})
+
+		t.Run("call_cleanup", func(t *testing.T) {
+			run(t, `call_cleanup(true, cleanup).`, 1)
+		})
+
+		t.Run("catch", func(t *testing.T) {
+			cleaned = 0
+			sols, err := i.Query(`catch(setup_call_cleanup(true, (X = a; X = b), cleanup), _, true).`)
+			assert.NoError(t, err)
+			assert.True(t, sols.Next())
+			assert.Equal(t, 0, cleaned)
+			assert.True(t, sols.Next())
+			assert.Equal(t, 1, cleaned)
+			assert.False(t, sols.Next())
+			assert.NoError(t, sols.Close())
+			assert.Equal(t, 1, cleaned)
+		})
+
+		t.Run("deadline", func(t *testing.T) {
+			i := i.Clone()
+			assert.NoError(t, i.Exec(`
+:- dynamic(cleaned/0).
+loop :- loop.
+`))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			// The cleanup runs even after the query exceeds its deadline.
+			sols, err := i.QueryContext(ctx, `setup_call_cleanup(true, loop, assertz(cleaned)).`)
+			assert.NoError(t, err)
+			assert.False(t, sols.Next())
+			assert.True(t, errors.Is(sols.Err(), context.DeadlineExceeded))
+			assert.NoError(t, sols.Close())
+
+			assert.NoError(t, i.QuerySolution(`cleaned.`).Err())
+		})
+
+		t.Run("cleanup timeout", func(t *testing.T) {
+			i := i.Clone()
+			i.CleanupTimeout = 10 * time.Millisecond
+			assert.NoError(t, i.Exec(`loop :- loop.`))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			// The cleanup which never terminates is stopped after the timeout.
+			sols, err := i.QueryContext(ctx, `setup_call_cleanup(true, true, loop).`)
+			assert.NoError(t, err)
+			assert.True(t, sols.Next())
+			<-ctx.Done()
+			assert.NoError(t, sols.Close())
+		})
+	})
+
+	t.Run("threads", func(t *testing.T) {
+		i := New(nil, nil)
+		assert.NoError(t, i.Exec(`
+:- dynamic(counter/1).
+counter(0).
+
+square(Parent, X) :- Y is X * X, thread_send_message(Parent, square(X, Y)).
+
+increment :- with_mutex(counter, (retract(counter(N)), M is N + 1, assertz(counter(M)))).
+`))
+
+		t.Run("message", func(t *testing.T) {
+			sols, err := i.Query(`thread_self(Self), thread_create(square(Self, 3), T1, []), thread_create(square(Self, 4), T2, []), thread_get_message(square(4, Y)), thread_get_message(square(3, X)), thread_join(T1, S1), thread_join(T2, S2).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				X, Y   int
+				S1, S2 string
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, 9, s.X)
+			assert.Equal(t, 16, s.Y)
+			assert.Equal(t, "true", s.S1)
+			assert.Equal(t, "true", s.S2)
+		})
+
+		t.Run("query threads", func(t *testing.T) {
+			// Each query is a thread of its own.
+			assert.NoError(t, i.QuerySolution(`thread_self(Self), Self \== main.`).Err())
+			assert.Error(t, i.QuerySolution(`thread_self(Self), thread_join(Self, _).`).Err())
+		})
 
-				assert.True(t, sols.Next())
+		t.Run("mutex between queries", func(t *testing.T) {
+			var inside, max int32
+			assert.NoError(t, i.RegisterFunc("enter", func() {
+				n := atomic.AddInt32(&inside, 1)
+				for {
+					m := atomic.LoadInt32(&max)
+					if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+			}))
+			assert.NoError(t, i.RegisterFunc("leave", func() {
+				atomic.AddInt32(&inside, -1)
+			}))
+
+			var wg sync.WaitGroup
+			for n := 0; n < 4; n++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					assert.NoError(t, i.QuerySolution(`with_mutex(critical, (enter, leave)).`).Err())
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, int32(1), max)
+		})
+
+		t.Run("mutex", func(t *testing.T) {
+			sols, err := i.Query(`thread_create(increment, T1, []), thread_create(increment, T2, []), thread_create(increment, T3, []), thread_join(T1, true), thread_join(T2, true), thread_join(T3, true), counter(N).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				N int
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, 3, s.N)
+		})
+
+		t.Run("message queue", func(t *testing.T) {
+			sols, err := i.Query(`message_queue_create(Q), thread_create(thread_send_message(Q, hello), T, [alias(sender)]), thread_get_message(Q, M), thread_join(sender, S).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				M, T, S string
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, "hello", s.M)
+			assert.Equal(t, "sender", s.T)
+			assert.Equal(t, "true", s.S)
+		})
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		i := New(nil, nil)
+		assert.NoError(t, i.Exec(`
+num(1).
+num(2).
+num(3).
+square(X, Y) :- Y is X * X.
+positive(X) :- X > 0.
+loop :- repeat, fail.
+`))
+
+		t.Run("concurrent_maplist", func(t *testing.T) {
+			sols, err := i.Query(`concurrent_maplist(positive, [1, 2, 3]), concurrent_maplist(square, [1, 2, 3], L).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				L []int
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, []int{1, 4, 9}, s.L)
+		})
+
+		t.Run("concurrent_forall", func(t *testing.T) {
+			sols, err := i.Query(`concurrent_forall(num(X), positive(X)), \+ concurrent_forall(num(X), X > 1).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+		})
+
+		t.Run("first_solution", func(t *testing.T) {
+			sols, err := i.Query(`first_solution(X, [loop, X = a], []).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				X string
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, "a", s.X)
+		})
+	})
+
+	t.Run("engines", func(t *testing.T) {
+		i := New(nil, nil)
+		assert.NoError(t, i.Exec(`
+nat(0).
+nat(N) :- nat(M), N is M + 1.
+
+sum(S) :- engine_fetch(X), S1 is S + X, engine_yield(S1), sum(S1).
+`))
+
+		t.Run("generator", func(t *testing.T) {
+			sols, err := i.Query(`engine_create(X, nat(X), E), engine_next(E, A), engine_next(E, B), engine_next(E, C), engine_destroy(E).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				A, B, C int
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, 0, s.A)
+			assert.Equal(t, 1, s.B)
+			assert.Equal(t, 2, s.C)
+		})
+
+		t.Run("engine_next_reified", func(t *testing.T) {
+			sols, err := i.Query(`engine_create(X, (X = a ; throw(b)), E), engine_next_reified(E, A), engine_next_reified(E, B), engine_next_reified(E, C), engine_destroy(E).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			m := map[string]term.Interface{}
+			assert.NoError(t, sols.Scan(m))
+			assert.Equal(t, &term.Compound{Functor: "the", Args: []term.Interface{term.Atom("a")}}, m["A"])
+			assert.Equal(t, &term.Compound{Functor: "throw", Args: []term.Interface{term.Atom("b")}}, m["B"])
+			assert.Equal(t, term.Atom("no"), m["C"])
+		})
+
+		t.Run("yield in catch", func(t *testing.T) {
+			// engine_yield/1 can't yield across catch/3 since the answers of its goal don't return to the engine.
+			sols, err := i.Query(`engine_create(X, catch((engine_yield(1), X = 2), error(X, _), true), E), engine_next(E, A), engine_destroy(E).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			m := map[string]term.Interface{}
+			assert.NoError(t, sols.Scan(m))
+			a, ok := m["A"].(*term.Compound)
+			assert.True(t, ok)
+			assert.Equal(t, term.Atom("permission_error"), a.Functor)
+			assert.Equal(t, []term.Interface{term.Atom("yield"), term.Atom("engine")}, a.Args[:2])
+		})
+
+		t.Run("yield in findall", func(t *testing.T) {
+			sols, err := i.Query(`engine_create(L, findall(X, (X = 1, engine_yield(X)), L), E), engine_next(E, A).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.False(t, sols.Next())
+			ex, ok := sols.Err().(*engine.Exception)
+			assert.True(t, ok)
+			e, ok := ex.Term.(*term.Compound).Args[0].(*term.Compound)
+			assert.True(t, ok)
+			assert.Equal(t, term.Atom("permission_error"), e.Functor)
+			assert.Equal(t, []term.Interface{term.Atom("yield"), term.Atom("engine")}, e.Args[:2])
+		})
+
+		t.Run("coroutine", func(t *testing.T) {
+			sols, err := i.Query(`engine_create(_, sum(0), E), engine_post(E, 1, A), engine_post(E, 2, B), engine_post(E, 3, C), engine_destroy(E).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				A, B, C int
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, 1, s.A)
+			assert.Equal(t, 3, s.B)
+			assert.Equal(t, 6, s.C)
+		})
+
+		t.Run("destroyed", func(t *testing.T) {
+			sols, err := i.Query(`engine_create(X, nat(X), E), engine_destroy(E), catch(engine_next(E, _), error(existence_error(engine, _), _), true).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			assert.NoError(t, sols.Err())
+		})
+
+		t.Run("query ends", func(t *testing.T) {
+			assert.NoError(t, i.Exec(`:- dynamic(reclaimed/0).`))
+
+			sols, err := i.Query(`engine_create(X, setup_call_cleanup(true, nat(X), assertz(reclaimed)), _, [alias(nats)]), engine_next(nats, _).`)
+			assert.NoError(t, err)
+			assert.True(t, sols.Next())
+			assert.NoError(t, sols.Close())
+
+			sols, err = i.Query(`reclaimed, catch(engine_next(nats, _), error(existence_error(engine, nats), _), true).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+			assert.True(t, sols.Next())
+			assert.NoError(t, sols.Err())
+		})
+	})
+
+	t.Run("delimited continuations", func(t *testing.T) {
+		i := New(nil, nil)
+		assert.NoError(t, i.Exec(`
+from_list([]).
+from_list([X|Xs]) :- shift(yield(X)), from_list(Xs).
+
+enumerate(G, L) :- reset(G, yield(X), C), (C == 0 -> L = [] ; L = [X|T], enumerate(C, T)).
+
+incr :- shift(get(S)), S1 is S + 1, shift(put(S1)).
+
+run_state(G, S0, S) :- reset(G, Cmd, C), (C == 0 -> S = S0 ; handle(Cmd, C, S0, S)).
+
+handle(get(S0), C, S0, S) :- run_state(C, S0, S).
+handle(put(S1), C, _, S) :- run_state(C, S1, S).
+
+local_cut(X) :- shift(a), X = 1, !.
+local_cut(2).
+
+alternatives(X) :- shift(a), (X = 1 ; X = 2).
+
+first(X) :- reset(alternatives(X), a, C), call(C), !.
+first(3).
+`))
+
+		t.Run("iterator", func(t *testing.T) {
+			sols, err := i.Query(`enumerate(from_list([a, b, c]), L).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				L []string
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, []string{"a", "b", "c"}, s.L)
+			assert.False(t, sols.Next())
+		})
+
+		t.Run("effect handler", func(t *testing.T) {
+			sols, err := i.Query(`run_state((incr, incr, incr), 0, S).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				S int
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, 3, s.S)
+		})
+
+		t.Run("nested", func(t *testing.T) {
+			sols, err := i.Query(`reset(reset((shift(outer), X = 1), inner, C1), outer, C2), var(X), var(C1), call(C2).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				X, C1 int
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, 1, s.X)
+			assert.Equal(t, 0, s.C1)
+		})
+
+		t.Run("backtracking into continuation", func(t *testing.T) {
+			sols, err := i.Query(`reset(alternatives(X), a, C), call(C).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			var xs []int
+			for sols.Next() {
+				var s struct {
+					X int
+				}
 				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, cs{
-					Course:  "english",
-					Student: "angus",
-				}, s)
+				xs = append(xs, s.X)
+			}
+			assert.Equal(t, []int{1, 2}, xs)
+		})
 
-				assert.True(t, sols.Next())
+		t.Run("backtracking into reset", func(t *testing.T) {
+			sols, err := i.Query(`reset(((Y = 1 ; Y = 2), shift(Y)), B, _).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			var bs []int
+			for sols.Next() {
+				var s struct {
+					B int
+				}
 				assert.NoError(t, sols.Scan(&s))
-				assert.Equal(t, cs{
-					Course:  "drama",
-					Student: "amelia",
-				}, s)
+				bs = append(bs, s.B)
+			}
+			assert.Equal(t, []int{1, 2}, bs)
+		})
 
-				assert.False(t, sols.Next())
-			})
+		t.Run("cut in continuation is local", func(t *testing.T) {
+			sols, err := i.Query(`findall(X, (reset(local_cut(X), a, C), (C == 0 -> true ; (call(C) ; X = 3))), L).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				L []int
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, []int{1, 3, 2}, s.L)
 		})
 
-		t.Run("call/1 makes a difference", func(t *testing.T) {
-			t.Run("with", func(t *testing.T) {
-				i := New(nil, nil)
-				sols, err := i.Query(`call(!), fail; true.`)
-				assert.NoError(t, err)
-				defer sols.Close()
+		t.Run("cut after continuation", func(t *testing.T) {
+			sols, err := i.Query(`findall(X, first(X), L).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
 
-				assert.True(t, sols.Next())
-			})
+			assert.True(t, sols.Next())
+			var s struct {
+				L []int
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, []int{1}, s.L)
+		})
 
-			t.Run("without", func(t *testing.T) {
-				i := New(nil, nil)
-				sols, err := i.Query(`!, fail; true.`)
-				assert.NoError(t, err)
-				defer sols.Close()
+		t.Run("shift in catch", func(t *testing.T) {
+			// It's a deliberate limitation that the continuation can't be captured across catch/3 since the answers of
+			// its goal don't return to reset/3.
+			sols, err := i.Query(`reset(catch((shift(x), X = 1), error(E, _), true), B, C).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
 
-				assert.False(t, sols.Next())
-			})
+			assert.True(t, sols.Next())
+			m := map[string]term.Interface{}
+			assert.NoError(t, sols.Scan(m))
+			assert.Equal(t, &term.Compound{Functor: "permission_error", Args: []term.Interface{term.Atom("capture"), term.Atom("continuation"), term.Atom("x")}}, m["E"])
+			assert.Equal(t, term.Integer(0), m["C"])
+		})
+
+		t.Run("catch around reset", func(t *testing.T) {
+			// An effect handler catches the exceptions outside of reset/3.
+			sols, err := i.Query(`catch(reset((shift(x), X = 1), B, C), _, fail), call(C).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.True(t, sols.Next())
+			var s struct {
+				X int
+				B string
+			}
+			assert.NoError(t, sols.Scan(&s))
+			assert.Equal(t, 1, s.X)
+			assert.Equal(t, "x", s.B)
+		})
+
+		t.Run("shift in findall", func(t *testing.T) {
+			sols, err := i.Query(`reset(findall(Y, ((Y = 1 ; Y = 2), shift(Y)), L), B, C).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.False(t, sols.Next())
+			ex, ok := sols.Err().(*engine.Exception)
+			assert.True(t, ok)
+			assert.Equal(t, "error(permission_error(capture, continuation, 1), 'shift(1) is called in a nested search such as catch/3 or findall/3.')", ex.Term.String())
+		})
+
+		t.Run("no reset", func(t *testing.T) {
+			sols, err := i.Query(`shift(a).`)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, sols.Close())
+			}()
+
+			assert.False(t, sols.Next())
+			assert.Error(t, sols.Err())
 		})
 	})
 
@@ -393,3 +2351,157 @@ studies(alex, physics).
 		assert.True(t, sols.Next())
 	})
 }
+
+func TestInterpreter_Clone(t *testing.T) {
+	i := New(nil, nil)
+	assert.NoError(t, i.Exec(`
+:- dynamic(foo/1).
+foo(a).
+`))
+
+	c := i.Clone()
+	assert.NoError(t, c.Exec(`:- assertz(foo(b)).`))
+	assert.NoError(t, i.Exec(`:- assertz(foo(c)).`))
+	assert.NoError(t, c.Exec(`:- retract(foo(a)).`))
+
+	all := func(i *Interpreter) []string {
+		sols, err := i.Query(`findall(X, foo(X), L).`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+		assert.True(t, sols.Next())
+		var s struct {
+			L []string
+		}
+		assert.NoError(t, sols.Scan(&s))
+		return s.L
+	}
+
+	assert.Equal(t, []string{"a", "c"}, all(i))
+	assert.Equal(t, []string{"b"}, all(c))
+
+	t.Run("overridden builtin", func(t *testing.T) {
+		i := New(nil, nil)
+		i.Register2("atom_length", func(_, length term.Interface, k func(*term.Env) *nondet.Promise, env *term.Env) *nondet.Promise {
+			return engine.Unify(length, term.Integer(42), k, env)
+		})
+
+		c := i.Clone()
+		var s struct {
+			N int
+		}
+		assert.NoError(t, c.QuerySolution(`atom_length(foo, N).`).Scan(&s))
+		assert.Equal(t, 42, s.N)
+	})
+}
+
+func BenchmarkNew(b *testing.B) {
+	b.Run("cached", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			_ = New(nil, nil)
+		}
+	})
+
+	// What New did for each interpreter before it cached the bootstrapped one.
+	b.Run("uncached", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			var i Interpreter
+			i.registerBuiltin()
+			if err := i.Exec(bootstrap); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSolutions_Next(b *testing.B) {
+	i := New(nil, nil)
+
+	// The context can be canceled so that the search polls it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sols, err := i.QueryContext(ctx, `repeat.`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = sols.Close()
+	}()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if !sols.Next() {
+			b.Fatal("no solution")
+		}
+	}
+}
+
+func BenchmarkInterpreter_Query(b *testing.B) {
+	i := New(nil, nil)
+	if err := i.Exec(`user(1, alice).`); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		sols, err := i.Query(`user(?, Name).`, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !sols.Next() {
+			b.Fatal("no solution")
+		}
+		_ = sols.Close()
+	}
+}
+
+func BenchmarkInterpreter_AssertFacts(b *testing.B) {
+	rows := make([][]interface{}, 1000)
+	for j := range rows {
+		rows[j] = []interface{}{fmt.Sprintf("user%d", j), j}
+	}
+	for n := 0; n < b.N; n++ {
+		i := New(nil, nil)
+		if err := i.AssertFacts("age/2", rows); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInterpreter_Exec_facts(b *testing.B) {
+	var sb strings.Builder
+	for j := 0; j < 1000; j++ {
+		fmt.Fprintf(&sb, "age(user%d, %d).\n", j, j)
+	}
+	facts := sb.String()
+	for n := 0; n < b.N; n++ {
+		i := New(nil, nil)
+		if err := i.Exec(facts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStmt_Query(b *testing.B) {
+	i := New(nil, nil)
+	if err := i.Exec(`user(1, alice).`); err != nil {
+		b.Fatal(err)
+	}
+	stmt, err := i.Prepare(`user(?, Name).`)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		sols, err := stmt.Query(context.Background(), 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !sols.Next() {
+			b.Fatal("no solution")
+		}
+		_ = sols.Close()
+	}
+}
@@ -2,15 +2,63 @@ package nondet
 
 import (
 	"context"
-	"errors"
+	"sync/atomic"
+	"time"
 )
 
+// pollInterval is the number of steps of the trampoline between the checks of the context.
+const pollInterval = 64
+
+// CanceledError is returned when the trampoline stops because the context is done.
+type CanceledError struct {
+	Err error // either context.Canceled or context.DeadlineExceeded.
+}
+
+func (e *CanceledError) Error() string {
+	return "canceled: " + e.Err.Error()
+}
+
+// Unwrap returns the error of the context.
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+type softDeadlineKey struct{}
+
+// WithSoftDeadline returns a context with which the trampoline doesn't stop at the deadline of ctx. It still stops
+// when ctx is canceled. The deadline is supposed to be handled by the caller by other means.
+func WithSoftDeadline(ctx context.Context) context.Context {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, softDeadlineKey{}, d)
+}
+
+// softDeadline checks if the deadline of ctx is the one marked by WithSoftDeadline. A derived context with an earlier
+// deadline doesn't inherit the softness.
+func softDeadline(ctx context.Context) bool {
+	s, ok := ctx.Value(softDeadlineKey{}).(time.Time)
+	if !ok {
+		return false
+	}
+	d, _ := ctx.Deadline()
+	return d.Equal(s)
+}
+
 // Promise is a delayed execution that results in (bool, error). The zero value for Promise is equivalent to Bool(false).
 type Promise struct {
 	delayed []func(context.Context) *Promise
 
-	cutParent *Promise
-	repeat    bool
+	cutParent  *Promise
+	cutBarrier *Promise
+	repeat     bool
+
+	cleanup func()
+	exit    *exit
+
+	value *scope // the key-value pair which this promise adds to the scope.
+	scope *scope
 
 	ok  bool
 	err error
@@ -35,6 +83,7 @@ func Error(err error) *Promise {
 
 var dummyCutParent Promise
 
+// Cut returns a promise that eliminates the alternatives up to parent and then continues with k.
 func Cut(parent *Promise, k func(context.Context) *Promise) *Promise {
 	if parent == nil {
 		parent = &dummyCutParent
@@ -45,6 +94,13 @@ func Cut(parent *Promise, k func(context.Context) *Promise) *Promise {
 	}
 }
 
+// CutWithin is like Cut but it stops eliminating the alternatives at barrier. The barrier itself stays intact.
+func CutWithin(parent, barrier *Promise, k func(context.Context) *Promise) *Promise {
+	p := Cut(parent, k)
+	p.cutBarrier = barrier
+	return p
+}
+
 func Repeat(k func(context.Context) *Promise) *Promise {
 	return &Promise{
 		delayed: []func(context.Context) *Promise{k},
@@ -52,49 +108,247 @@ func Repeat(k func(context.Context) *Promise) *Promise {
 	}
 }
 
+// Cleanup returns a promise that calls cleanup exactly once when it's exhausted, cut, or abandoned as a result of
+// Force returning.
+func Cleanup(cleanup func(), k func(context.Context) *Promise) *Promise {
+	return &Promise{
+		delayed: []func(context.Context) *Promise{k},
+		cleanup: cleanup,
+	}
+}
+
+// WithValue returns a promise that continues with k. k and the promises which follow from it receive a context which
+// carries val for key until another WithValue overrides it.
+func WithValue(key, val interface{}, k func(context.Context) *Promise) *Promise {
+	return &Promise{
+		delayed: []func(context.Context) *Promise{k},
+		value:   &scope{key: key, val: val},
+	}
+}
+
+type exit struct {
+	marker *Promise
+	det    func()
+}
+
+// Exit returns a promise that calls det if there are no choice points left after marker and then continues with k.
+func Exit(marker *Promise, det func(), k func(context.Context) *Promise) *Promise {
+	return &Promise{
+		delayed: []func(context.Context) *Promise{k},
+		exit:    &exit{marker: marker, det: det},
+	}
+}
+
 // Force enforces the delayed execution and returns the result. (i.e. trampoline)
 func (p *Promise) Force(ctx context.Context) (bool, error) {
-	stack := promiseStack{p}
-	for len(stack) > 0 {
-		select {
-		case <-ctx.Done():
-			return false, errors.New("canceled")
-		default:
-			p := stack.pop()
-
-			if len(p.delayed) == 0 {
-				switch {
-				case p.err != nil:
-					return false, p.err
-				case p.ok:
-					return true, nil
-				default:
-					continue
-				}
+	it := p.Iterator()
+	defer it.Close()
+	return it.Next(ctx)
+}
+
+// Iterator returns an iterator which searches for the solutions of the promise one by one.
+func (p *Promise) Iterator() *Iterator {
+	if p.value != nil {
+		p.scope = p.scope.with(p.value.key, p.value.val)
+	}
+	return &Iterator{stack: promiseStack{p}}
+}
+
+// Iterator is a resumable trampoline. Unlike Force, it keeps the choice points after finding a solution so that the
+// search can be resumed from there.
+type Iterator struct {
+	stack promiseStack
+}
+
+// Next searches for the next solution. It returns false if there's no more solutions or if there's an error. The
+// remaining choice points are abandoned on failure or on error.
+func (it *Iterator) Next(ctx context.Context) (bool, error) {
+	limit, _ := ctx.Value(stackLimitKey{}).(*stackLimit)
+	if limit != nil {
+		// The trampolines nested in this one share the budget with this one.
+		limit = &stackLimit{n: limit.n, err: limit.err, base: int(atomic.LoadInt64(&limit.depth))}
+		ctx = context.WithValue(ctx, stackLimitKey{}, limit)
+	}
+	done, soft := ctx.Done(), softDeadline(ctx)
+	var (
+		s      *scope
+		scoped = ctx
+	)
+	stack := it.stack
+	defer func() {
+		it.stack = stack
+	}()
+	for steps := 0; len(stack) > 0; steps++ {
+		// Checking the context on every step is costly. So we check it once in a while.
+		if done != nil && steps%pollInterval == 0 {
+			if err := canceled(ctx, done, soft); err != nil {
+				stack.abandon()
+				return false, err
 			}
+		}
+
+		p := stack.pop()
+
+		if len(p.delayed) == 0 {
+			p.runCleanup()
+			switch {
+			case p.err != nil:
+				stack.abandon()
+				return false, p.err
+			case p.ok:
+				return true, nil
+			default:
+				continue
+			}
+		}
 
-			// If cut, we eliminate other possibilities.
-			if p.cutParent != nil {
-				for len(stack) > 0 {
-					if pop := stack.pop(); pop == p.cutParent {
-						break
-					}
+		// If cut, we eliminate other possibilities.
+		if p.cutParent != nil {
+			for len(stack) > 0 && stack[len(stack)-1] != p.cutBarrier {
+				pop := stack.pop()
+				pop.runCleanup()
+				if pop == p.cutParent {
+					break
 				}
-				p.cutParent = nil // we don't have to do this again when we revisit.
 			}
+			p.cutParent, p.cutBarrier = nil, nil // we don't have to do this again when we revisit.
+		}
 
-			// Try the alternatives from left to right.
-			var q *Promise
-			q = p.delayed[0](ctx)
-			if !p.repeat {
-				p.delayed, p.delayed[0] = p.delayed[1:], nil
+		// If exit, we check if there are choice points left.
+		if p.exit != nil {
+			if stack.det(p.exit.marker) {
+				p.exit.det()
 			}
-			stack = append(stack, p, q)
+			p.exit = nil
+		}
+
+		// Try the alternatives from left to right.
+		if limit != nil {
+			atomic.StoreInt64(&limit.depth, int64(limit.base+len(stack)))
+		}
+		if p.scope != s {
+			s = p.scope
+			scoped = s.context(ctx)
+		}
+		var q *Promise
+		q = p.delayed[0](scoped)
+		if !p.repeat {
+			p.delayed, p.delayed[0] = p.delayed[1:], nil
+		}
+		q.scope = p.scope
+		if q.value != nil {
+			q.scope = q.scope.with(q.value.key, q.value.val)
+		}
+		stack = append(stack, p, q)
+		if limit != nil && limit.base+len(stack) > limit.n {
+			stack.abandon()
+			return false, limit.err
 		}
 	}
 	return false, nil
 }
 
+// canceled returns an error if ctx is done. If soft, it ignores the deadline.
+func canceled(ctx context.Context, done <-chan struct{}, soft bool) error {
+	select {
+	case <-done:
+		if err := ctx.Err(); !soft || err != context.DeadlineExceeded {
+			return &CanceledError{Err: err}
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Det reports whether there are no choice points left.
+func (it *Iterator) Det() bool {
+	for _, p := range it.stack {
+		if len(p.delayed) > 0 || p.repeat {
+			return false
+		}
+	}
+	return true
+}
+
+type stackLimitKey struct{}
+
+type stackLimit struct {
+	n     int
+	err   error
+	base  int   // the size of the stacks of the enclosing trampolines.
+	depth int64 // base plus the size of the stack of the running trampoline. accessed atomically.
+}
+
+// WithStackLimit returns a context with which the trampoline fails with err if its stack grows beyond n promises. The
+// trampolines nested in a trampoline, e.g. by calling Force in a delayed execution, count towards the same limit. If n
+// is not positive, the trampoline isn't limited.
+func WithStackLimit(ctx context.Context, n int, err error) context.Context {
+	if n <= 0 {
+		return context.WithValue(ctx, stackLimitKey{}, (*stackLimit)(nil))
+	}
+	return context.WithValue(ctx, stackLimitKey{}, &stackLimit{n: n, err: err})
+}
+
+// Close abandons the remaining choice points.
+func (it *Iterator) Close() {
+	it.stack.abandon()
+}
+
+func (p *Promise) runCleanup() {
+	if p.cleanup == nil {
+		return
+	}
+	f := p.cleanup
+	p.cleanup = nil
+	f()
+}
+
+// scope is the key-value pairs which a promise carries in the context. Each key appears at most once.
+type scope struct {
+	key, val interface{}
+	parent   *scope
+}
+
+func (s *scope) with(key, val interface{}) *scope {
+	return &scope{key: key, val: val, parent: s.without(key)}
+}
+
+func (s *scope) without(key interface{}) *scope {
+	switch {
+	case s == nil:
+		return nil
+	case s.key == key:
+		return s.parent
+	}
+	parent := s.parent.without(key)
+	if parent == s.parent {
+		return s
+	}
+	return &scope{key: s.key, val: s.val, parent: parent}
+}
+
+func (s *scope) context(ctx context.Context) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return &scopedContext{Context: ctx, scope: s}
+}
+
+type scopedContext struct {
+	context.Context
+	scope *scope
+}
+
+func (c *scopedContext) Value(key interface{}) interface{} {
+	for s := c.scope; s != nil; s = s.parent {
+		if s.key == key {
+			return s.val
+		}
+	}
+	return c.Context.Value(key)
+}
+
 type promiseStack []*Promise
 
 func (s *promiseStack) pop() *Promise {
@@ -102,3 +356,24 @@ func (s *promiseStack) pop() *Promise {
 	p, *s, (*s)[len(*s)-1] = (*s)[len(*s)-1], (*s)[:len(*s)-1], nil
 	return p
 }
+
+// det checks if there are no choice points between the top of the stack and marker.
+func (s promiseStack) det(marker *Promise) bool {
+	for i := len(s) - 1; i >= 0; i-- {
+		p := s[i]
+		if p == marker {
+			return true
+		}
+		if len(p.delayed) > 0 || p.repeat {
+			return false
+		}
+	}
+	return false
+}
+
+// abandon calls the cleanups of the remaining promises from the top of the stack.
+func (s *promiseStack) abandon() {
+	for len(*s) > 0 {
+		s.pop().runCleanup()
+	}
+}
@@ -2,7 +2,9 @@ package nondet
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -44,3 +46,385 @@ func TestPromise_Force(t *testing.T) {
 
 	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}, res)
 }
+
+func TestCleanup(t *testing.T) {
+	t.Run("exhausted", func(t *testing.T) {
+		var called int
+		ok, err := Cleanup(func() {
+			called++
+		}, func(context.Context) *Promise {
+			return Delay(func(context.Context) *Promise {
+				return Bool(false)
+			}, func(context.Context) *Promise {
+				return Bool(false)
+			})
+		}).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, 1, called)
+	})
+
+	t.Run("cut", func(t *testing.T) {
+		var called int
+		parent := Delay(func(context.Context) *Promise {
+			return Bool(false)
+		})
+		parent = Delay(func(context.Context) *Promise {
+			return Cleanup(func() {
+				called++
+			}, func(context.Context) *Promise {
+				return Delay(func(context.Context) *Promise {
+					return Cut(parent, func(context.Context) *Promise {
+						assert.Equal(t, 1, called)
+						return Bool(false)
+					})
+				}, func(context.Context) *Promise {
+					assert.Fail(t, "unreachable")
+					return Bool(false)
+				})
+			})
+		})
+		ok, err := parent.Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, 1, called)
+	})
+
+	t.Run("abandoned", func(t *testing.T) {
+		var called int
+		ok, err := Cleanup(func() {
+			called++
+		}, func(context.Context) *Promise {
+			return Delay(func(context.Context) *Promise {
+				return Bool(true)
+			}, func(context.Context) *Promise {
+				return Bool(false)
+			})
+		}).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 1, called)
+	})
+}
+
+func TestExit(t *testing.T) {
+	t.Run("deterministic", func(t *testing.T) {
+		var det bool
+		var marker *Promise
+		marker = Delay(func(context.Context) *Promise {
+			return Delay(func(context.Context) *Promise {
+				return Exit(marker, func() {
+					det = true
+				}, func(context.Context) *Promise {
+					return Bool(true)
+				})
+			})
+		})
+		ok, err := marker.Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.True(t, det)
+	})
+
+	t.Run("nondeterministic", func(t *testing.T) {
+		var det []bool
+		var marker *Promise
+		marker = Delay(func(context.Context) *Promise {
+			k := func(context.Context) *Promise {
+				d := false
+				return Exit(marker, func() {
+					d = true
+				}, func(context.Context) *Promise {
+					det = append(det, d)
+					return Bool(false)
+				})
+			}
+			return Delay(k, k)
+		})
+		ok, err := marker.Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, []bool{false, true}, det)
+	})
+}
+
+func TestCutWithin(t *testing.T) {
+	var tried []int
+	var parent, barrier *Promise
+	parent = Delay(func(context.Context) *Promise {
+		barrier = Delay(func(context.Context) *Promise {
+			return Delay(func(context.Context) *Promise {
+				return CutWithin(parent, barrier, func(context.Context) *Promise {
+					tried = append(tried, 1)
+					return Bool(false)
+				})
+			}, func(context.Context) *Promise {
+				assert.Fail(t, "unreachable")
+				return Bool(false)
+			})
+		})
+		return barrier
+	}, func(context.Context) *Promise {
+		tried = append(tried, 2)
+		return Bool(true)
+	})
+	ok, err := parent.Force(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []int{1, 2}, tried)
+}
+
+func TestWithValue(t *testing.T) {
+	type key struct{}
+	type other struct{}
+	var seen []interface{}
+	see := func(ctx context.Context) {
+		seen = append(seen, ctx.Value(key{}), ctx.Value(other{}))
+	}
+	ctx := context.WithValue(context.Background(), other{}, "base")
+	ok, err := WithValue(key{}, 1, func(ctx context.Context) *Promise {
+		see(ctx)
+		return Delay(func(ctx context.Context) *Promise {
+			return WithValue(key{}, 2, func(ctx context.Context) *Promise {
+				see(ctx)
+				return Bool(false)
+			})
+		}, func(ctx context.Context) *Promise {
+			// The alternative is back in the scope where it was created.
+			see(ctx)
+			return WithValue(other{}, "overridden", func(ctx context.Context) *Promise {
+				see(ctx)
+				return Bool(true)
+			})
+		})
+	}).Force(ctx)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{1, "base", 2, "base", 1, "base", 1, "overridden"}, seen)
+}
+
+func TestIterator(t *testing.T) {
+	var cleaned bool
+	it := Cleanup(func() {
+		cleaned = true
+	}, func(context.Context) *Promise {
+		return Delay(func(context.Context) *Promise {
+			return Bool(true)
+		}, func(context.Context) *Promise {
+			return Bool(false)
+		}, func(context.Context) *Promise {
+			return Bool(true)
+		})
+	}).Iterator()
+
+	ok, err := it.Next(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, cleaned)
+
+	ok, err = it.Next(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, cleaned)
+
+	ok, err = it.Next(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.True(t, cleaned)
+
+	t.Run("close", func(t *testing.T) {
+		var cleaned bool
+		it := Cleanup(func() {
+			cleaned = true
+		}, func(context.Context) *Promise {
+			return Delay(func(context.Context) *Promise {
+				return Bool(true)
+			}, func(context.Context) *Promise {
+				return Bool(true)
+			})
+		}).Iterator()
+
+		ok, err := it.Next(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		it.Close()
+		assert.True(t, cleaned)
+
+		ok, err = it.Next(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var cleaned bool
+		it := Cleanup(func() {
+			cleaned = true
+		}, func(context.Context) *Promise {
+			return Delay(func(context.Context) *Promise {
+				return Error(errors.New("failed"))
+			}, func(context.Context) *Promise {
+				return Bool(true)
+			})
+		}).Iterator()
+
+		_, err := it.Next(context.Background())
+		assert.Error(t, err)
+		assert.True(t, cleaned)
+
+		ok, err := it.Next(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+}
+
+func TestIterator_Det(t *testing.T) {
+	it := Delay(func(context.Context) *Promise {
+		return Bool(true)
+	}, func(context.Context) *Promise {
+		return Bool(true)
+	}).Iterator()
+
+	ok, err := it.Next(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, it.Det())
+
+	ok, err = it.Next(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, it.Det())
+}
+
+func TestWithStackLimit(t *testing.T) {
+	var k func(context.Context) *Promise
+	k = func(context.Context) *Promise {
+		return Delay(k, k)
+	}
+
+	errTooDeep := errors.New("too deep")
+	ok, err := Delay(k).Force(WithStackLimit(context.Background(), 100, errTooDeep))
+	assert.Equal(t, errTooDeep, err)
+	assert.False(t, ok)
+
+	t.Run("nested", func(t *testing.T) {
+		// Each level nests another trampoline at the bottom of a stack of 10 promises.
+		var nest func(int) *Promise
+		nest = func(n int) *Promise {
+			if n == 0 {
+				return Bool(true)
+			}
+			var p func(int) *Promise
+			p = func(m int) *Promise {
+				if m == 0 {
+					return Delay(func(ctx context.Context) *Promise {
+						ok, err := nest(n - 1).Force(ctx)
+						if err != nil {
+							return Error(err)
+						}
+						return Bool(ok)
+					})
+				}
+				return Delay(func(context.Context) *Promise {
+					return p(m - 1)
+				}, func(context.Context) *Promise {
+					return Bool(false)
+				})
+			}
+			return p(5)
+		}
+
+		ok, err := nest(5).Force(WithStackLimit(context.Background(), 100, errTooDeep))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = nest(20).Force(WithStackLimit(context.Background(), 100, errTooDeep))
+		assert.Equal(t, errTooDeep, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		var n int
+		var deep func(context.Context) *Promise
+		deep = func(context.Context) *Promise {
+			if n++; n > 1000 {
+				return Bool(true)
+			}
+			return Delay(deep, deep)
+		}
+
+		ok, err := Delay(func(ctx context.Context) *Promise {
+			ok, err := Delay(deep).Force(WithStackLimit(ctx, 0, nil))
+			if err != nil {
+				return Error(err)
+			}
+			return Bool(ok)
+		}).Force(WithStackLimit(context.Background(), 100, errTooDeep))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+}
+
+func TestCanceledError(t *testing.T) {
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		ok, err := Repeat(func(context.Context) *Promise {
+			return Bool(false)
+		}).Force(ctx)
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.False(t, ok)
+	})
+
+	t.Run("exhausted after canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ok, err := Delay(func(context.Context) *Promise {
+			cancel()
+			return Bool(false)
+		}).Force(ctx)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+}
+
+func TestWithSoftDeadline(t *testing.T) {
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+
+		ok, err := Delay(func(ctx context.Context) *Promise {
+			<-ctx.Done()
+			return Bool(true)
+		}).Force(WithSoftDeadline(ctx))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("earlier deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+		ctx, cancel = context.WithTimeout(WithSoftDeadline(ctx), time.Millisecond)
+		defer cancel()
+
+		ok, err := Repeat(func(context.Context) *Promise {
+			return Bool(false)
+		}).Force(ctx)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.False(t, ok)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		ctx = WithSoftDeadline(ctx)
+		cancel()
+
+		ok, err := Repeat(func(context.Context) *Promise {
+			return Bool(false)
+		}).Force(ctx)
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.False(t, ok)
+	})
+}
@@ -1,11 +1,15 @@
 package prolog
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"time"
 
 	"github.com/ichiban/prolog/engine"
+	"github.com/ichiban/prolog/nondet"
 
 	"github.com/ichiban/prolog/term"
 )
@@ -13,29 +17,83 @@ import (
 // Solutions is the result of a query. Everytime the Next method is called, it searches for the next solution.
 // By calling the Scan method, you can retrieve the content of the solution.
 type Solutions struct {
+	ctx  context.Context
+	exit func()
+	it   *nondet.Iterator
 	env  *term.Env
 	vars []term.Variable
-	more chan<- bool
-	next <-chan *term.Env
 	err  error
 }
 
-// Close closes the Solutions and terminates the search for other solutions.
+// newSolutions starts the search for the solutions of the goal which call calls with the continuation k.
+func newSolutions(ctx context.Context, vars []term.Variable, call func(k func(*term.Env) *nondet.Promise) *nondet.Promise) *Solutions {
+	sols := Solutions{
+		vars: vars,
+	}
+	sols.ctx, sols.exit = engine.WithThread(ctx)
+	sols.it = call(func(env *term.Env) *nondet.Promise {
+		sols.env = env
+		return nondet.Bool(true)
+	}).Iterator()
+	return &sols
+}
+
+// Close closes the Solutions and terminates the search for other solutions. It also destroys the engines created by
+// the query. The pending cleanup handlers have been run when it returns, except for those of the engines running
+// goals for other threads which run as soon as the goals stop.
 func (s *Solutions) Close() error {
-	close(s.more)
+	s.it.Close()
+	s.exit()
 	return nil
 }
 
 // Next prepares the next solution for reading with the Scan method. It returns true if it finds another solution,
 // or false if there's no further solutions or if there's an error.
 func (s *Solutions) Next() bool {
-	s.more <- true
-	var ok bool
-	s.env, ok = <-s.next
+	ok, err := s.it.Next(s.ctx)
+	if err != nil {
+		s.err = err
+	}
 	return ok
 }
 
+// Deterministic reports whether there are certainly no more solutions. If it returns false, there might be more
+// solutions which Next can find.
+func (s *Solutions) Deterministic() bool {
+	return s.it.Det()
+}
+
+// Collect searches for at most limit solutions and returns the variable values of them. If limit is negative, it
+// searches for all the solutions.
+func (s *Solutions) Collect(limit int) ([]map[string]term.Interface, error) {
+	var ms []map[string]term.Interface
+	for limit < 0 || len(ms) < limit {
+		if !s.Next() {
+			return ms, s.Err()
+		}
+		m := map[string]term.Interface{}
+		if err := s.Scan(m); err != nil {
+			return ms, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
 // Scan copies the variable values of the current solution into the specified struct/map.
+// The values are converted into the Go types of the fields/elements as below:
+//
+//	bool: true or false
+//	int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64: integers within the range
+//	float32, float64: floats or integers
+//	string: atoms
+//	time.Time: integers or floats as Unix time, or atoms in RFC 3339
+//	slices: lists
+//	maps: lists of Key-Value pairs
+//	structs: compounds by position, or lists of Name-Value pairs by field name or `prolog:"name"` tag
+//	pointers: any of the above, or nil for unbound variables
+//	interface{}, term.Interface: any terms as they are
+//	Unmarshaler: any terms which UnmarshalProlog accepts
 func (s *Solutions) Scan(dest interface{}) error {
 	o := reflect.ValueOf(dest)
 	switch o.Kind() {
@@ -43,16 +101,9 @@ func (s *Solutions) Scan(dest interface{}) error {
 		o = o.Elem()
 		switch o.Kind() {
 		case reflect.Struct:
-			t := o.Type()
-
 			fields := map[string]reflect.Value{}
-			for i := 0; i < t.NumField(); i++ {
-				f := t.Field(i)
-				name := f.Name
-				if alias, ok := f.Tag.Lookup("prolog"); ok {
-					name = alias
-				}
-				fields[name] = o.Field(i)
+			for _, f := range structFields(o.Type()) {
+				fields[f.name] = o.FieldByIndex(f.index)
 			}
 
 			for _, v := range s.vars {
@@ -63,9 +114,9 @@ func (s *Solutions) Scan(dest interface{}) error {
 
 				val, err := convert(s.env.Simplify(v), f.Type(), s.env)
 				if err != nil {
-					return err
+					return scanError(v, err)
 				}
-				fields[string(v)].Set(val)
+				f.Set(val)
 			}
 		}
 		return nil
@@ -82,7 +133,7 @@ func (s *Solutions) Scan(dest interface{}) error {
 
 			val, err := convert(s.env.Simplify(v), t.Elem(), s.env)
 			if err != nil {
-				return err
+				return scanError(v, err)
 			}
 			o.SetMapIndex(reflect.ValueOf(string(v)), val)
 		}
@@ -92,27 +143,155 @@ func (s *Solutions) Scan(dest interface{}) error {
 	}
 }
 
+// Unmarshaler is the interface implemented by types that can convert a term into themselves.
+type Unmarshaler interface {
+	UnmarshalProlog(t term.Interface) error
+}
+
+var errOutOfRange = errors.New("out of range")
+
+// ScanError is returned by Scan if it fails to convert a variable value into the Go type.
+type ScanError struct {
+	Var  string         // the name of the variable.
+	Term term.Interface // the term which failed to be converted. It may be a part of the variable value.
+	Type reflect.Type   // the Go type into which the term failed to be converted.
+	Err  error          // the error returned by Unmarshaler or by the conversion if any.
+}
+
+func (e *ScanError) Error() string {
+	msg := fmt.Sprintf("failed to convert %s of %s into %s", e.Term, e.Var, e.Type)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+func scanError(v term.Variable, err error) error {
+	var e *ScanError
+	if errors.As(err, &e) {
+		e.Var = string(v)
+	}
+	return err
+}
+
+type structField struct {
+	name  string
+	index []int
+}
+
+// structFields returns the exported fields of a struct type in order. A field tagged `prolog:"-"` is omitted.
+func structFields(t reflect.Type) []structField {
+	fs := make([]structField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if alias, ok := f.Tag.Lookup("prolog"); ok {
+			if alias == "-" {
+				continue
+			}
+			name = alias
+		}
+		fs = append(fs, structField{name: name, index: f.Index})
+	}
+	return fs
+}
+
+var (
+	interfaceType   = reflect.TypeOf((*interface{})(nil)).Elem()
+	termType        = reflect.TypeOf((*term.Interface)(nil)).Elem()
+	timeType        = reflect.TypeOf(time.Time{})
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
 func convert(t term.Interface, typ reflect.Type, env *term.Env) (reflect.Value, error) {
+	t = env.Resolve(t)
+
+	if reflect.PtrTo(typ).Implements(unmarshalerType) {
+		v := reflect.New(typ)
+		if err := v.Interface().(Unmarshaler).UnmarshalProlog(t); err != nil {
+			return reflect.Value{}, &ScanError{Term: t, Type: typ, Err: err}
+		}
+		return v.Elem(), nil
+	}
+
 	switch typ {
-	case reflect.TypeOf((*interface{})(nil)).Elem(), reflect.TypeOf((*term.Interface)(nil)).Elem():
-		return reflect.ValueOf(t), nil
+	case interfaceType, termType:
+		return reflect.ValueOf(&t).Elem().Convert(typ), nil
+	case timeType:
+		switch t := t.(type) {
+		case term.Integer:
+			return reflect.ValueOf(time.Unix(int64(t), 0)), nil
+		case term.Float:
+			sec, frac := math.Modf(float64(t))
+			return reflect.ValueOf(time.Unix(int64(sec), int64(frac*1e9))), nil
+		case term.Atom:
+			tm, err := time.Parse(time.RFC3339, string(t))
+			if err != nil {
+				return reflect.Value{}, &ScanError{Term: t, Type: typ, Err: err}
+			}
+			return reflect.ValueOf(tm), nil
+		}
+		return reflect.Value{}, &ScanError{Term: t, Type: typ}
 	}
 
 	switch typ.Kind() {
+	case reflect.Bool:
+		switch t {
+		case term.Atom("true"):
+			return reflect.ValueOf(true).Convert(typ), nil
+		case term.Atom("false"):
+			return reflect.ValueOf(false).Convert(typ), nil
+		}
 	case reflect.Float32, reflect.Float64:
-		if f, ok := t.(term.Float); ok {
-			return reflect.ValueOf(f).Convert(typ), nil
+		switch t := t.(type) {
+		case term.Float:
+			return reflect.ValueOf(t).Convert(typ), nil
+		case term.Integer:
+			return reflect.ValueOf(t).Convert(typ), nil
 		}
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		if i, ok := t.(term.Integer); ok {
-			return reflect.ValueOf(i).Convert(typ), nil
+			v := reflect.New(typ).Elem()
+			if v.OverflowInt(int64(i)) {
+				return reflect.Value{}, &ScanError{Term: t, Type: typ, Err: errOutOfRange}
+			}
+			v.SetInt(int64(i))
+			return v, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i, ok := t.(term.Integer); ok {
+			v := reflect.New(typ).Elem()
+			if i < 0 || v.OverflowUint(uint64(i)) {
+				return reflect.Value{}, &ScanError{Term: t, Type: typ, Err: errOutOfRange}
+			}
+			v.SetUint(uint64(i))
+			return v, nil
 		}
 	case reflect.String:
 		if a, ok := t.(term.Atom); ok {
-			return reflect.ValueOf(string(a)), nil
+			return reflect.ValueOf(string(a)).Convert(typ), nil
+		}
+	case reflect.Ptr:
+		if _, ok := t.(term.Variable); ok {
+			return reflect.Zero(typ), nil
+		}
+		e, err := convert(t, typ.Elem(), env)
+		if err != nil {
+			return reflect.Value{}, err
 		}
+		p := reflect.New(typ.Elem())
+		p.Elem().Set(e)
+		return p, nil
 	case reflect.Slice:
-		r := reflect.MakeSlice(reflect.SliceOf(typ.Elem()), 0, 0)
+		r := reflect.MakeSlice(typ, 0, 0)
 		if err := engine.Each(t, func(elem term.Interface) error {
 			e, err := convert(elem, typ.Elem(), env)
 			if err != nil {
@@ -121,11 +300,99 @@ func convert(t term.Interface, typ reflect.Type, env *term.Env) (reflect.Value,
 			r = reflect.Append(r, e)
 			return nil
 		}, env); err != nil {
-			return reflect.Value{}, err
+			return reflect.Value{}, convertError(t, typ, err)
 		}
 		return r, nil
+	case reflect.Map:
+		m := reflect.MakeMap(typ)
+		if err := eachPair(t, func(k, v term.Interface) error {
+			key, err := convert(k, typ.Key(), env)
+			if err != nil {
+				return err
+			}
+			val, err := convert(v, typ.Elem(), env)
+			if err != nil {
+				return err
+			}
+			m.SetMapIndex(key, val)
+			return nil
+		}, env); err != nil {
+			return reflect.Value{}, convertError(t, typ, err)
+		}
+		return m, nil
+	case reflect.Struct:
+		return convertStruct(t, typ, env)
+	}
+	return reflect.Value{}, &ScanError{Term: t, Type: typ}
+}
+
+func convertStruct(t term.Interface, typ reflect.Type, env *term.Env) (reflect.Value, error) {
+	v := reflect.New(typ).Elem()
+	fs := structFields(typ)
+
+	// A list of Name-Value pairs.
+	if c, ok := t.(*term.Compound); t == term.Atom("[]") || ok && c.Functor == "." && len(c.Args) == 2 {
+		fields := make(map[string]reflect.Value, len(fs))
+		for _, f := range fs {
+			fields[f.name] = v.FieldByIndex(f.index)
+		}
+		if err := eachPair(t, func(k, val term.Interface) error {
+			name, ok := env.Resolve(k).(term.Atom)
+			if !ok {
+				return &ScanError{Term: k, Type: typ, Err: errors.New("not a field name")}
+			}
+			f, ok := fields[string(name)]
+			if !ok {
+				return &ScanError{Term: k, Type: typ, Err: errors.New("unknown field")}
+			}
+			e, err := convert(val, f.Type(), env)
+			if err != nil {
+				return err
+			}
+			f.Set(e)
+			return nil
+		}, env); err != nil {
+			return reflect.Value{}, convertError(t, typ, err)
+		}
+		return v, nil
+	}
+
+	// A compound of which arguments are the fields in order.
+	c, ok := t.(*term.Compound)
+	if !ok {
+		return reflect.Value{}, &ScanError{Term: t, Type: typ}
+	}
+	if len(c.Args) != len(fs) {
+		return reflect.Value{}, &ScanError{Term: t, Type: typ, Err: fmt.Errorf("expected %d arguments", len(fs))}
 	}
-	return reflect.Value{}, fmt.Errorf("failed to convert: %s", typ)
+	for i, f := range fs {
+		e, err := convert(c.Args[i], v.FieldByIndex(f.index).Type(), env)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v.FieldByIndex(f.index).Set(e)
+	}
+	return v, nil
+}
+
+// eachPair iterates over a list of Key-Value pairs.
+func eachPair(list term.Interface, f func(k, v term.Interface) error, env *term.Env) error {
+	return engine.Each(list, func(elem term.Interface) error {
+		p, ok := env.Resolve(elem).(*term.Compound)
+		if !ok || p.Functor != "-" || len(p.Args) != 2 {
+			return errors.New("not a pair")
+		}
+		return f(p.Args[0], p.Args[1])
+	}, env)
+}
+
+// convertError returns err if it's from the conversion of an element. Otherwise, err is about the term itself.
+func convertError(t term.Interface, typ reflect.Type, err error) error {
+	var e *ScanError
+	if errors.As(err, &e) {
+		return err
+	}
+	return &ScanError{Term: t, Type: typ, Err: err}
 }
 
 // Err returns the error if exists.
@@ -141,3 +408,38 @@ func (s *Solutions) Vars() []string {
 	}
 	return ns
 }
+
+var (
+	// ErrNoSolutions is reported by *Solution when the query has no solutions.
+	ErrNoSolutions = errors.New("no solutions")
+
+	// ErrMultipleSolutions is reported by *Solution when the query is expected to have exactly one solution but has more.
+	ErrMultipleSolutions = errors.New("multiple solutions")
+)
+
+// Solution is the result of a query for a single solution.
+type Solution struct {
+	sols *Solutions
+	err  error
+}
+
+// Scan copies the variable values of the solution into the specified struct/map.
+func (s *Solution) Scan(dest interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.sols.Scan(dest)
+}
+
+// Err returns the error if exists.
+func (s *Solution) Err() error {
+	return s.err
+}
+
+// Vars returns variable names.
+func (s *Solution) Vars() []string {
+	if s.sols == nil {
+		return nil
+	}
+	return s.sols.Vars()
+}
@@ -0,0 +1,165 @@
+package prolog
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ichiban/prolog/engine"
+	"github.com/ichiban/prolog/nondet"
+	"github.com/ichiban/prolog/term"
+)
+
+// Stmt is a prepared query. It's parsed and compiled once and executed many times with different arguments.
+// Stmt is safe for concurrent use by multiple goroutines.
+type Stmt struct {
+	i          *Interpreter
+	query      term.Interface
+	params     []term.Variable
+	goal       *engine.CompiledGoal
+	positional int
+	named      map[string]int // the indices of the arguments for :name.
+	vars       []term.Variable
+}
+
+// Prepare parses and compiles a query for later execution. The query may have ? and :name placeholders of which
+// arguments are given to Query.
+func (i *Interpreter) Prepare(query string) (*Stmt, error) {
+	return i.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext parses and compiles a query for later execution with context. The context is used for the check
+// by safe_goal/1 if the interpreter is sandboxed. The check is done again on each execution since the clauses the
+// query calls may have changed.
+func (i *Interpreter) PrepareContext(ctx context.Context, query string) (*Stmt, error) {
+	p := i.Parser(strings.NewReader(query), nil)
+	params := p.Parameterize("?")
+	t, err := p.Term()
+	if err != nil {
+		return nil, err
+	}
+
+	var env *term.Env
+
+	if err := i.checkSafe(ctx, t, env); err != nil {
+		return nil, err
+	}
+
+	// The parameters are followed by the variables of the query so that their bindings are visible to Solutions.
+	ps := append([]term.Variable{}, params.Positional...)
+	named := make(map[string]int, len(params.Named))
+	for n, v := range params.Named {
+		named[string(n)] = len(ps)
+		ps = append(ps, v)
+	}
+	isParam := make(map[term.Variable]bool, len(ps))
+	for _, v := range ps {
+		isParam[v] = true
+	}
+	var vars []term.Variable
+	for _, v := range env.FreeVariables(t) {
+		if !isParam[v] {
+			vars = append(vars, v)
+		}
+	}
+
+	g, err := engine.CompileGoal(t, append(ps, vars...), env)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stmt{
+		i:          i,
+		query:      t,
+		params:     ps,
+		goal:       g,
+		positional: len(params.Positional),
+		named:      named,
+		vars:       vars,
+	}, nil
+}
+
+// Query executes the prepared query with the arguments for the placeholders and returns *Solutions. If the query has
+// :name placeholders, args is a single Named.
+func (s *Stmt) Query(ctx context.Context, args ...interface{}) (*Solutions, error) {
+	as, err := s.args(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// The clauses may have changed since Prepare and the arguments may be goals.
+	var env *term.Env
+	for i, p := range s.params {
+		env = env.Bind(p, as[i])
+	}
+	if err := s.i.checkSafe(ctx, s.query, env); err != nil {
+		return nil, err
+	}
+
+	// The variables in the arguments are also the variables of the query.
+	vars := s.vars
+	if fvs := env.FreeVariables(as[:len(as)-len(s.vars)]...); len(fvs) > 0 {
+		vars = append(vars[:len(vars):len(vars)], fvs...)
+	}
+
+	return newSolutions(s.i.Limit(ctx), vars, func(k func(*term.Env) *nondet.Promise) *nondet.Promise {
+		return s.goal.Call(&s.i.VM, as, k, nil)
+	}), nil
+}
+
+// args returns the arguments of the compiled goal.
+func (s *Stmt) args(args []interface{}) ([]term.Interface, error) {
+	as := make([]term.Interface, s.positional+len(s.named), s.positional+len(s.named)+len(s.vars))
+
+	if len(s.named) > 0 {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected named arguments: %v", args)
+		}
+		n, ok := args[0].(Named)
+		if !ok {
+			return nil, fmt.Errorf("expected named arguments: %v", args[0])
+		}
+		if s.positional > 0 {
+			return nil, fmt.Errorf("no arguments for placeholders: ?")
+		}
+		var unused []string
+		for k, v := range n {
+			i, ok := s.named[k]
+			if !ok {
+				unused = append(unused, ":"+k)
+				continue
+			}
+			t, err := TermOf(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			as[i] = t
+		}
+		if len(unused) > 0 {
+			sort.Strings(unused)
+			return nil, fmt.Errorf("no placeholders for arguments: %s", strings.Join(unused, ", "))
+		}
+		for k, i := range s.named {
+			if as[i] == nil {
+				return nil, fmt.Errorf("no argument for placeholder: :%s", k)
+			}
+		}
+	} else {
+		if len(args) != s.positional {
+			return nil, fmt.Errorf("expected %d arguments for placeholders: %v", s.positional, args)
+		}
+		for i, a := range args {
+			t, err := TermOf(a)
+			if err != nil {
+				return nil, err
+			}
+			as[i] = t
+		}
+	}
+
+	for _, v := range s.vars {
+		as = append(as, v)
+	}
+	return as, nil
+}
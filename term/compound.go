@@ -203,6 +203,15 @@ func (c *Compound) Unify(t Interface, occursCheck bool, env *Env) (*Env, bool) {
 	}
 }
 
+// NewCompound returns a compound of functor and args. It returns the atom functor if args is empty since a compound
+// has at least one argument.
+func NewCompound(functor Atom, args ...Interface) Interface {
+	if len(args) == 0 {
+		return functor
+	}
+	return &Compound{Functor: functor, Args: args}
+}
+
 // Cons returns a list consists of a first element car and the rest cdr.
 func Cons(car, cdr Interface) Interface {
 	return &Compound{
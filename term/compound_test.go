@@ -164,3 +164,8 @@ func TestSet(t *testing.T) {
 	assert.Equal(t, List(Atom("a")), Set(Atom("a"), Atom("a"), Atom("a")))
 	assert.Equal(t, List(Atom("a"), Atom("b"), Atom("c")), Set(Atom("c"), Atom("b"), Atom("a")))
 }
+
+func TestNewCompound(t *testing.T) {
+	assert.Equal(t, &Compound{Functor: "f", Args: []Interface{Atom("a"), Variable("X")}}, NewCompound("f", Atom("a"), Variable("X")))
+	assert.Equal(t, Atom("f"), NewCompound("f"))
+}
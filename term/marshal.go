@@ -0,0 +1,182 @@
+package term
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Marshaler is the interface implemented by types that can convert themselves into terms.
+type Marshaler interface {
+	MarshalProlog() (Interface, error)
+}
+
+var (
+	marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	termType      = reflect.TypeOf((*Interface)(nil)).Elem()
+	timeType      = reflect.TypeOf(time.Time{})
+	bytesType     = reflect.TypeOf([]byte(nil))
+)
+
+// TermOf converts a Go value into a term as below:
+//
+//	Interface: as it is
+//	Marshaler: the result of MarshalProlog
+//	bool: true or false
+//	integers and floats: integers and floats
+//	string: an atom
+//	time.Time: an atom in RFC 3339
+//	[]byte: a list of codes
+//	arrays and slices: a list
+//	maps: a list of Key-Value pairs sorted by the keys
+//	structs: a compound of which arguments are the exported fields in order. The functor is the prolog tag of the
+//	  blank field _ if any, or the type name in snake case. A field tagged `prolog:"-"` is omitted.
+//	pointers: the term of the value it points to
+//	nil: a fresh variable
+func TermOf(v interface{}) (Interface, error) {
+	return termOf(reflect.ValueOf(v))
+}
+
+func termOf(o reflect.Value) (Interface, error) {
+	if !o.IsValid() {
+		return NewVariable(), nil
+	}
+
+	typ := o.Type()
+	switch {
+	case typ.Implements(termType):
+		if (o.Kind() == reflect.Ptr || o.Kind() == reflect.Interface) && o.IsNil() {
+			return NewVariable(), nil
+		}
+		return o.Interface().(Interface), nil
+	case typ.Implements(marshalerType):
+		if (o.Kind() == reflect.Ptr || o.Kind() == reflect.Interface) && o.IsNil() {
+			return NewVariable(), nil
+		}
+		return o.Interface().(Marshaler).MarshalProlog()
+	case typ == timeType:
+		return Atom(o.Interface().(time.Time).Format(time.RFC3339Nano)), nil
+	case typ == bytesType:
+		bs := o.Bytes()
+		es := make([]Interface, len(bs))
+		for i, b := range bs {
+			es[i] = Integer(b)
+		}
+		return List(es...), nil
+	}
+
+	switch o.Kind() {
+	case reflect.Bool:
+		if o.Bool() {
+			return Atom("true"), nil
+		}
+		return Atom("false"), nil
+	case reflect.Float32, reflect.Float64:
+		return Float(o.Float()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Integer(o.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := o.Uint()
+		if u > math.MaxInt64 {
+			return nil, fmt.Errorf("can't convert to term: %d is out of range", u)
+		}
+		return Integer(u), nil
+	case reflect.String:
+		return Atom(o.String()), nil
+	case reflect.Array, reflect.Slice:
+		l := o.Len()
+		es := make([]Interface, l)
+		for i := 0; i < l; i++ {
+			var err error
+			es[i], err = termOf(o.Index(i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return List(es...), nil
+	case reflect.Map:
+		ps := make([]*Compound, 0, o.Len())
+		iter := o.MapRange()
+		for iter.Next() {
+			k, err := termOf(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			v, err := termOf(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			ps = append(ps, &Compound{Functor: "-", Args: []Interface{k, v}})
+		}
+		sort.Slice(ps, func(i, j int) bool {
+			return Compare(ps[i].Args[0], ps[j].Args[0], nil) < 0
+		})
+		es := make([]Interface, len(ps))
+		for i, p := range ps {
+			es[i] = p
+		}
+		return List(es...), nil
+	case reflect.Struct:
+		return structTermOf(o)
+	case reflect.Ptr, reflect.Interface:
+		if o.IsNil() {
+			return NewVariable(), nil
+		}
+		return termOf(o.Elem())
+	default:
+		return nil, fmt.Errorf("can't convert to term: %v", o)
+	}
+}
+
+func structTermOf(o reflect.Value) (Interface, error) {
+	typ := o.Type()
+	functor := Atom(snakeCase(typ.Name()))
+	var args []Interface
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag, ok := f.Tag.Lookup("prolog")
+		if f.Name == "_" {
+			if ok {
+				functor = Atom(tag)
+			}
+			continue
+		}
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		a, err := termOf(o.Field(i))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	if functor == "" {
+		return nil, fmt.Errorf("can't convert to term: %v has no functor", typ)
+	}
+	if len(args) == 0 {
+		return functor, nil
+	}
+	return &Compound{Functor: functor, Args: args}, nil
+}
+
+// snakeCase converts a Go identifier into snake case, e.g. HTTPRequest into http_request.
+func snakeCase(s string) string {
+	rs := []rune(s)
+	var sb strings.Builder
+	for i, r := range rs {
+		if unicode.IsUpper(r) {
+			// A boundary is before an upper case letter following a lower case letter, or before the last upper case
+			// letter of an acronym followed by a lower case letter.
+			if i > 0 && (unicode.IsLower(rs[i-1]) || i+1 < len(rs) && unicode.IsUpper(rs[i-1]) && unicode.IsLower(rs[i+1])) {
+				sb.WriteRune('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,89 @@
+package term
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type point struct {
+	X, Y int
+}
+
+type celsius float64
+
+func (c celsius) MarshalProlog() (Interface, error) {
+	return &Compound{Functor: "celsius", Args: []Interface{Float(c)}}, nil
+}
+
+func TestTermOf(t *testing.T) {
+	type HTTPRequest struct {
+		Method  string
+		Secret  string `prolog:"-"`
+		private int
+	}
+	type tagged struct {
+		_    struct{} `prolog:"person"`
+		Name string
+	}
+
+	var nilPoint *point
+	for _, tc := range []struct {
+		title string
+		v     interface{}
+		t     Interface
+	}{
+		{title: "term", v: Atom("foo"), t: Atom("foo")},
+		{title: "bool", v: true, t: Atom("true")},
+		{title: "int", v: int8(-1), t: Integer(-1)},
+		{title: "uint", v: uint16(1), t: Integer(1)},
+		{title: "float", v: 1.5, t: Float(1.5)},
+		{title: "string", v: "foo", t: Atom("foo")},
+		{title: "bytes", v: []byte("ab"), t: List(Integer('a'), Integer('b'))},
+		{title: "slice", v: []string{"a", "b"}, t: List(Atom("a"), Atom("b"))},
+		{title: "map", v: map[string]int{"b": 2, "a": 1}, t: List(
+			&Compound{Functor: "-", Args: []Interface{Atom("a"), Integer(1)}},
+			&Compound{Functor: "-", Args: []Interface{Atom("b"), Integer(2)}},
+		)},
+		{title: "struct", v: point{X: 1, Y: 2}, t: &Compound{Functor: "point", Args: []Interface{Integer(1), Integer(2)}}},
+		{title: "struct in snake case", v: HTTPRequest{Method: "GET", Secret: "x", private: 1}, t: &Compound{Functor: "http_request", Args: []Interface{Atom("GET")}}},
+		{title: "struct with functor", v: tagged{Name: "alice"}, t: &Compound{Functor: "person", Args: []Interface{Atom("alice")}}},
+		{title: "pointer", v: &point{X: 1, Y: 2}, t: &Compound{Functor: "point", Args: []Interface{Integer(1), Integer(2)}}},
+		{title: "time", v: time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC), t: Atom("2020-09-13T12:26:40Z")},
+		{title: "marshaler", v: celsius(20), t: &Compound{Functor: "celsius", Args: []Interface{Float(20)}}},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			term, err := TermOf(tc.v)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.t, term)
+		})
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		for _, v := range []interface{}{nil, nilPoint} {
+			term, err := TermOf(v)
+			assert.NoError(t, err)
+			_, ok := term.(Variable)
+			assert.True(t, ok)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, v := range []interface{}{
+			uint64(1 << 63),
+			struct{}{},
+			make(chan int),
+		} {
+			_, err := TermOf(v)
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestSnakeCase(t *testing.T) {
+	assert.Equal(t, "person", snakeCase("Person"))
+	assert.Equal(t, "person_name", snakeCase("PersonName"))
+	assert.Equal(t, "http_request", snakeCase("HTTPRequest"))
+	assert.Equal(t, "point", snakeCase("point"))
+}
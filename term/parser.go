@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -20,6 +21,10 @@ type Parser struct {
 	operators    *Operators
 	placeholder  Atom
 	args         []Interface
+	named        map[Atom]Interface
+	unused       map[Atom]struct{}
+	partial      bool
+	params       *Parameters
 	doubleQuotes DoubleQuotes
 	vars         *[]ParsedVariable
 }
@@ -81,32 +86,64 @@ func (p *Parser) Replace(placeholder Atom, args ...interface{}) error {
 	return nil
 }
 
-func termOf(o reflect.Value) (Interface, error) {
-	if t, ok := o.Interface().(Interface); ok {
-		return t, nil
+// ReplaceNamed registers named arguments. Every occurrence of :name will be replaced by the argument of the name.
+// A placeholder without an argument or an argument without a placeholder raises an error.
+func (p *Parser) ReplaceNamed(args map[string]interface{}) error {
+	p.named = make(map[Atom]Interface, len(args))
+	p.unused = make(map[Atom]struct{}, len(args))
+	for n, a := range args {
+		t, err := TermOf(a)
+		if err != nil {
+			return fmt.Errorf("%s: %w", n, err)
+		}
+		p.named[Atom(n)] = t
+		p.unused[Atom(n)] = struct{}{}
 	}
+	return nil
+}
 
-	switch o.Kind() {
-	case reflect.Float32, reflect.Float64:
-		return Float(o.Float()), nil
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return Integer(o.Int()), nil
-	case reflect.String:
-		return Atom(o.String()), nil
-	case reflect.Array, reflect.Slice:
-		l := o.Len()
-		es := make([]Interface, l)
-		for i := 0; i < l; i++ {
-			var err error
-			es[i], err = termOf(o.Index(i))
-			if err != nil {
-				return nil, err
-			}
+// Partial makes Term leave the arguments without placeholders to the following terms instead of raising an error.
+// It's for a text of several terms which share a set of arguments. Call Unused after the last term.
+func (p *Parser) Partial() {
+	p.partial = true
+}
+
+// Continue makes p take over the arguments which prev hasn't replaced yet along with its partialness. It's for
+// reading a text with a new parser for each term.
+func (p *Parser) Continue(prev *Parser) {
+	p.placeholder, p.args, p.named, p.unused, p.partial = prev.placeholder, prev.args, prev.named, prev.unused, prev.partial
+}
+
+// Unused returns an error if there are arguments without placeholders.
+func (p *Parser) Unused() error {
+	if len(p.args) != 0 {
+		return fmt.Errorf("too many arguments for placeholders: %s", p.args)
+	}
+
+	if len(p.unused) != 0 {
+		ns := make([]string, 0, len(p.unused))
+		for n := range p.unused {
+			ns = append(ns, ":"+string(n))
 		}
-		return List(es...), nil
-	default:
-		return nil, fmt.Errorf("can't convert to term: %v", o)
+		sort.Strings(ns)
+		return fmt.Errorf("no placeholders for arguments: %s", strings.Join(ns, ", "))
 	}
+
+	return nil
+}
+
+// Parameters are the variables which placeholders are replaced by.
+type Parameters struct {
+	Positional []Variable        // for the placeholder in order of occurrence.
+	Named      map[Atom]Variable // for :name.
+}
+
+// Parameterize makes the parser replace placeholder and :name by variables instead of arguments so that the parsed
+// term can be used many times with different arguments. The variables are recorded in the returned Parameters.
+func (p *Parser) Parameterize(placeholder Atom) *Parameters {
+	p.placeholder = placeholder
+	p.params = &Parameters{Named: map[Atom]Variable{}}
+	return p.params
 }
 
 func (p *Parser) accept(k syntax.TokenKind, vals ...string) (string, error) {
@@ -235,8 +272,10 @@ func (p *Parser) Term() (Interface, error) {
 		return nil, err
 	}
 
-	if len(p.args) != 0 {
-		return nil, fmt.Errorf("too many arguments for placeholders: %s", p.args)
+	if !p.partial {
+		if err := p.Unused(); err != nil {
+			return nil, err
+		}
 	}
 
 	return t, nil
@@ -377,6 +416,21 @@ func (p *Parser) lhs(allowComma bool) (Interface, error) {
 
 	if a, err := p.acceptAtom(allowComma); err == nil {
 		if _, err := p.accept(syntax.TokenParenL); err != nil {
+			if p.params != nil && p.placeholder == a {
+				v := NewVariable()
+				p.params.Positional = append(p.params.Positional, v)
+				return v, nil
+			}
+			if p.params != nil && a == ":" {
+				if n, err := p.accept(syntax.TokenAtom); err == nil {
+					v, ok := p.params.Named[Atom(n)]
+					if !ok {
+						v = NewVariable()
+						p.params.Named[Atom(n)] = v
+					}
+					return v, nil
+				}
+			}
 			if p.placeholder != "" && p.placeholder == a {
 				if len(p.args) == 0 {
 					return nil, errors.New("not enough arguments for placeholders")
@@ -385,6 +439,16 @@ func (p *Parser) lhs(allowComma bool) (Interface, error) {
 				t, p.args = p.args[0], p.args[1:]
 				return t, nil
 			}
+			if p.named != nil && a == ":" {
+				if n, err := p.accept(syntax.TokenAtom); err == nil {
+					t, ok := p.named[Atom(n)]
+					if !ok {
+						return nil, fmt.Errorf("no argument for placeholder: :%s", n)
+					}
+					delete(p.unused, Atom(n))
+					return t, nil
+				}
+			}
 			return a, nil
 		}
 
@@ -363,3 +363,88 @@ func TestParser_Replace(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestParser_ReplaceNamed(t *testing.T) {
+	ops := Operators{
+		{Priority: 700, Specifier: `xfx`, Name: `=`},
+		{Priority: 50, Specifier: `xfx`, Name: `:`},
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		p := NewParser(bufio.NewReader(strings.NewReader(`f(:id, :name, :id, m:n, X = :name).`)), nil, WithOperators(&ops))
+		assert.NoError(t, p.ReplaceNamed(map[string]interface{}{"id": 42, "name": "alice"}))
+
+		f, err := p.Term()
+		assert.NoError(t, err)
+		assert.Equal(t, &Compound{
+			Functor: "f",
+			Args: []Interface{
+				Integer(42),
+				Atom("alice"),
+				Integer(42),
+				&Compound{Functor: ":", Args: []Interface{Atom("m"), Atom("n")}},
+				&Compound{Functor: "=", Args: []Interface{Variable("X"), Atom("alice")}},
+			},
+		}, f)
+	})
+
+	t.Run("missing argument", func(t *testing.T) {
+		p := NewParser(bufio.NewReader(strings.NewReader(`f(:id, :name).`)), nil, WithOperators(&ops))
+		assert.NoError(t, p.ReplaceNamed(map[string]interface{}{"id": 42}))
+
+		_, err := p.Term()
+		assert.Error(t, err)
+	})
+
+	t.Run("unused argument", func(t *testing.T) {
+		p := NewParser(bufio.NewReader(strings.NewReader(`f(:id).`)), nil, WithOperators(&ops))
+		assert.NoError(t, p.ReplaceNamed(map[string]interface{}{"id": 42, "name": "alice"}))
+
+		_, err := p.Term()
+		assert.EqualError(t, err, "no placeholders for arguments: :name")
+	})
+
+	t.Run("invalid argument", func(t *testing.T) {
+		p := NewParser(bufio.NewReader(strings.NewReader(`f(:id).`)), nil, WithOperators(&ops))
+		assert.Error(t, p.ReplaceNamed(map[string]interface{}{"id": make(chan int)}))
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		r := bufio.NewReader(strings.NewReader(`f(:id). g(:name, :id).`))
+		p := NewParser(r, nil, WithOperators(&ops))
+		assert.NoError(t, p.ReplaceNamed(map[string]interface{}{"id": 42, "name": "alice"}))
+		p.Partial()
+
+		f, err := p.Term()
+		assert.NoError(t, err)
+		assert.Equal(t, &Compound{Functor: "f", Args: []Interface{Integer(42)}}, f)
+		assert.EqualError(t, p.Unused(), "no placeholders for arguments: :name")
+
+		q := NewParser(r, nil, WithOperators(&ops))
+		q.Continue(p)
+		g, err := q.Term()
+		assert.NoError(t, err)
+		assert.Equal(t, &Compound{Functor: "g", Args: []Interface{Atom("alice"), Integer(42)}}, g)
+		assert.NoError(t, q.Unused())
+	})
+}
+
+func TestParser_Parameterize(t *testing.T) {
+	p := NewParser(bufio.NewReader(strings.NewReader(`f(?, :id, ?, :id, :name).`)), nil)
+	params := p.Parameterize("?")
+
+	f, err := p.Term()
+	assert.NoError(t, err)
+	assert.Len(t, params.Positional, 2)
+	assert.Len(t, params.Named, 2)
+	assert.Equal(t, &Compound{
+		Functor: "f",
+		Args: []Interface{
+			params.Positional[0],
+			params.Named["id"],
+			params.Positional[1],
+			params.Named["id"],
+			params.Named["name"],
+		},
+	}, f)
+}
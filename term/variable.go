@@ -14,8 +14,17 @@ type Variable string
 var varCounter uint64
 
 func NewVariable() Variable {
-	atomic.AddUint64(&varCounter, 1)
-	return Variable(fmt.Sprintf("_%d", varCounter))
+	n := atomic.AddUint64(&varCounter, 1)
+	return Variable(fmt.Sprintf("_%d", n))
+}
+
+// Vars returns the variables of the names.
+func Vars(names ...string) Variables {
+	vs := make(Variables, len(names))
+	for i, n := range names {
+		vs[i] = Variable(n)
+	}
+	return vs
 }
 
 var anonVarPattern = regexp.MustCompile(`\A_\d+\z`)
@@ -44,3 +44,8 @@ func TestVariable_WriteTerm(t *testing.T) {
 		assert.Regexp(t, `\A_\d+\z`, buf.String())
 	})
 }
+
+func TestVars(t *testing.T) {
+	assert.Equal(t, Variables{"X", "Y"}, Vars("X", "Y"))
+	assert.Empty(t, Vars())
+}